@@ -0,0 +1,168 @@
+package apperror
+
+import (
+	"encoding/json"
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/routeinfo"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MIMEProblemJSON is the RFC 7807 media type
+const MIMEProblemJSON = "application/problem+json"
+
+// hiddenDetail replaces the message of server errors in production
+const hiddenDetail = "An unexpected error occurred. Please try again later."
+
+// Renderer renders error pages; services.TemplateRenderer satisfies it
+type Renderer interface {
+	Render(c *fiber.Ctx, templateName string, data interface{}) error
+}
+
+// HandlerConfig configures Handler
+type HandlerConfig struct {
+	// Renderer renders errors/404, errors/403 and errors/500 for browsers
+	Renderer Renderer
+	// Production hides the messages of 5xx errors from clients
+	Production bool
+}
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+	// Errors maps input fields to what is wrong with them
+	Errors     map[string]string
+	Extensions map[string]interface{}
+}
+
+// MarshalJSON flattens the extension members into the object
+func (p Problem) MarshalJSON() ([]byte, error) {
+	body := make(map[string]interface{}, len(p.Extensions)+6)
+	for key, value := range p.Extensions {
+		body[key] = value
+	}
+	body["type"] = p.Type
+	body["title"] = p.Title
+	body["status"] = p.Status
+	if p.Detail != "" {
+		body["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		body["instance"] = p.Instance
+	}
+	if len(p.Errors) > 0 {
+		body["errors"] = p.Errors
+	}
+	return json.Marshal(body)
+}
+
+// Handler is the app's fiber.ErrorHandler. API requests and clients that
+// prefer JSON get problem+json; everyone else gets an error page. Server
+// errors are logged with their cause.
+func Handler(config HandlerConfig) fiber.ErrorHandler {
+	routes := &routeinfo.Matcher{}
+
+	return func(c *fiber.Ctx, err error) error {
+		problem := config.problemFor(c, err, routes)
+		if problem.Status >= http.StatusInternalServerError {
+			logging.FromCtx(c).Error("request failed", "method", c.Method(), "path", routes.Path(c), "error", err)
+		}
+
+		// Anything the failed handler already wrote is discarded
+		c.Response().ResetBody()
+		c.Status(problem.Status)
+
+		if WantsJSON(c) {
+			body, err := json.Marshal(problem)
+			if err != nil {
+				return err
+			}
+			c.Set(fiber.HeaderContentType, MIMEProblemJSON)
+			return c.Send(body)
+		}
+
+		if config.Renderer != nil {
+			renderErr := config.Renderer.Render(c, pageFor(problem.Status), fiber.Map{
+				"Title":  problem.Title + " - Fresh",
+				"Status": problem.Status,
+				"Error":  problem.Detail,
+			})
+			if renderErr == nil {
+				return nil
+			}
+			logging.FromCtx(c).Error("failed to render error page", "error", renderErr)
+		}
+
+		c.Response().ResetBody()
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+		return c.SendString(problem.Title)
+	}
+}
+
+// WantsJSON reports whether the client should get JSON rather than HTML:
+// API routes, bearer-authenticated requests, JSON request bodies and Accept
+// headers preferring JSON
+func WantsJSON(c *fiber.Ctx) bool {
+	if strings.HasPrefix(c.Path(), "/api/") || c.Is("json") {
+		return true
+	}
+	if scheme, _, _ := strings.Cut(c.Get(fiber.HeaderAuthorization), " "); strings.EqualFold(scheme, "Bearer") {
+		return true
+	}
+	accepted := c.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON, MIMEProblemJSON)
+	return accepted == fiber.MIMEApplicationJSON || accepted == MIMEProblemJSON
+}
+
+// problemFor describes err. The instance is the masked path without the
+// query, so tokens in reset and verification links stay out of the body.
+func (config HandlerConfig) problemFor(c *fiber.Ctx, err error, routes *routeinfo.Matcher) Problem {
+	problem := Problem{
+		Type:     "about:blank",
+		Status:   http.StatusInternalServerError,
+		Instance: routes.Path(c),
+	}
+
+	var fiberErr *fiber.Error
+	if appErr, ok := As(err); ok {
+		problem.Status = appErr.Kind.Status()
+		problem.Detail = appErr.Message
+		problem.Errors = appErr.Fields
+		problem.Extensions = appErr.Extensions
+		if appErr.Kind == KindInternal {
+			problem.Detail = appErr.Error()
+		}
+	} else if errors.As(err, &fiberErr) {
+		problem.Status = fiberErr.Code
+		problem.Detail = fiberErr.Message
+	} else {
+		problem.Detail = err.Error()
+	}
+
+	problem.Title = http.StatusText(problem.Status)
+	if problem.Title == "" {
+		problem.Title = "Error"
+	}
+	if config.Production && problem.Status >= http.StatusInternalServerError {
+		problem.Detail = hiddenDetail
+	}
+
+	return problem
+}
+
+func pageFor(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return "errors/404"
+	case http.StatusForbidden:
+		return "errors/403"
+	default:
+		return "errors/500"
+	}
+}
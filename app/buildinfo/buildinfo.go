@@ -0,0 +1,50 @@
+// Package buildinfo describes the running binary for /version and the logs.
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is set at build time:
+//
+//	go build -ldflags "-X fresh/app/buildinfo.Version=v1.2.3"
+//
+// make build sets it from git describe.
+var Version = "dev"
+
+// Info is what /version reports
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	// Modified is set when the binary was built from a tree with uncommitted
+	// changes
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information. The commit and its time come from the
+// VCS stamp the go command embeds when building inside a git checkout.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+	}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.BuildTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
@@ -0,0 +1,192 @@
+// Package cli implements the fresh command: the web server plus the database
+// and user tasks that run against the same configuration, so servers don't
+// need psql or make.
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"fresh/config"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+	"gorm.io/gorm"
+)
+
+const usage = `Usage: fresh <command> [arguments]
+
+Commands:
+  serve                             start the web server (the default)
+  routes                            list every route
+
+  db create                         create the database
+  db drop [-force]                  drop the database
+  db reset [-force]                 drop, create, migrate and seed the database
+  db migrate                        apply every pending migration
+  db rollback [steps]               revert the last applied migrations (default 1)
+  db status                         list migrations and whether they are applied
+  db seed                           create the built-in roles and permissions
+  db new [-go] <name>               create an SQL migration, or a Go one with -go
+
+  user create [-admin] <email>      create a verified account
+  user reset-password <email>       set a new password, signing the user out
+  user promote [-role r] <email>    grant a role (default admin)
+
+Passwords are read from the terminal, or from the first line of stdin.
+Database settings come from config/database.yml and the ENV variable.`
+
+// UsageError is returned for a command line that doesn't parse. The usage has
+// already been written to Stderr.
+type UsageError struct {
+	msg string
+}
+
+func (e *UsageError) Error() string {
+	return e.msg
+}
+
+// CLI runs fresh commands. The zero value is not usable; start from New.
+type CLI struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// DatabaseConfig loads the database settings for the current environment
+	DatabaseConfig func() (*config.DatabaseConfig, error)
+	// OpenDatabase connects to the database for the current environment
+	OpenDatabase func() (*gorm.DB, error)
+	// CloseDatabase releases a connection from OpenDatabase once a command
+	// is done with it
+	CloseDatabase func(db *gorm.DB) error
+
+	// MigrationsDir is where "db new" writes migrations
+	MigrationsDir string
+	// Now stamps new migrations
+	Now func() time.Time
+
+	stdin *bufio.Reader
+}
+
+// New returns a CLI wired to the process's standard streams and the
+// configuration files under config/
+func New() *CLI {
+	c := &CLI{
+		Stdin:         os.Stdin,
+		Stdout:        os.Stdout,
+		Stderr:        os.Stderr,
+		MigrationsDir: "db/migrations",
+		Now:           time.Now,
+	}
+	c.DatabaseConfig = func() (*config.DatabaseConfig, error) {
+		dbConfig, err := config.LoadConfig("config/database.yml")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load database config: %w", err)
+		}
+		return dbConfig.GetDatabaseConfig("")
+	}
+	c.OpenDatabase = func() (*gorm.DB, error) {
+		dbConfig, err := c.DatabaseConfig()
+		if err != nil {
+			return nil, err
+		}
+		return dbConfig.Connect("")
+	}
+	c.CloseDatabase = func(db *gorm.DB) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.Close()
+	}
+	return c
+}
+
+// Run executes the command named by args, which exclude the program name.
+// Without arguments it starts the server, as the binary always has.
+func (c *CLI) Run(args []string) error {
+	if len(args) == 0 {
+		return c.serve(nil)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return c.serve(args)
+	case "routes":
+		return c.routes(args)
+	case "db":
+		return c.db(args)
+	case "user":
+		return c.user(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprintln(c.Stdout, usage)
+		return nil
+	default:
+		return c.usageError("unknown command %q", command)
+	}
+}
+
+// usageError prints the usage and returns an error describing what was wrong
+func (c *CLI) usageError(format string, args ...interface{}) error {
+	fmt.Fprintln(c.Stderr, usage)
+	return &UsageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// closeDatabase closes a connection from OpenDatabase, for commands to defer.
+// The command's work is done by then, so a failure is only reported.
+func (c *CLI) closeDatabase(db *gorm.DB) {
+	if err := c.CloseDatabase(db); err != nil {
+		fmt.Fprintf(c.Stderr, "failed to close the database: %v\n", err)
+	}
+}
+
+// parseFlags parses a subcommand's flags and checks it got want positional
+// arguments
+func (c *CLI) parseFlags(flags *flag.FlagSet, args []string, want int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		return c.usageError("%s: %v", flags.Name(), err)
+	}
+	if flags.NArg() != want {
+		return c.usageError("%s takes %d argument(s), got %d", flags.Name(), want, flags.NArg())
+	}
+	return nil
+}
+
+// readPassword prompts for a password. On a terminal it isn't echoed and has
+// to be typed twice; otherwise the first line of stdin is used, so scripts
+// can pipe it in.
+func (c *CLI) readPassword() (string, error) {
+	if f, ok := c.Stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(c.Stderr, "Password: ")
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(c.Stderr, "Confirm password: ")
+		confirm, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(password) != string(confirm) {
+			return "", errors.New("passwords don't match")
+		}
+		return string(password), nil
+	}
+
+	if c.stdin == nil {
+		c.stdin = bufio.NewReader(c.Stdin)
+	}
+	line, err := c.stdin.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("no password on stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
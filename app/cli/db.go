@@ -0,0 +1,268 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"fresh/app/models"
+	"fresh/config"
+	"fresh/db/migrate"
+	"fresh/db/migrations"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func (c *CLI) db(args []string) error {
+	if len(args) == 0 {
+		return c.usageError("db needs a subcommand")
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "create":
+		return c.dbCreate(args)
+	case "drop":
+		return c.dbDrop(args)
+	case "reset":
+		return c.dbReset(args)
+	case "migrate":
+		return c.dbMigrate(args)
+	case "rollback":
+		return c.dbRollback(args)
+	case "status":
+		return c.dbStatus(args)
+	case "seed":
+		return c.dbSeed(args)
+	case "new":
+		return c.dbNew(args)
+	default:
+		return c.usageError("unknown db command %q", command)
+	}
+}
+
+func (c *CLI) dbCreate(args []string) error {
+	if err := c.parseFlags(flag.NewFlagSet("db create", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	dbConfig, err := c.DatabaseConfig()
+	if err != nil {
+		return err
+	}
+	return c.createDatabase(dbConfig)
+}
+
+func (c *CLI) dbDrop(args []string) error {
+	flags := flag.NewFlagSet("db drop", flag.ContinueOnError)
+	force := flags.Bool("force", false, "allow dropping the production database")
+	if err := c.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	dbConfig, err := c.destructible(*force)
+	if err != nil {
+		return err
+	}
+	return c.dropDatabase(dbConfig)
+}
+
+// dbReset drops and recreates the database, then brings it up to date
+func (c *CLI) dbReset(args []string) error {
+	flags := flag.NewFlagSet("db reset", flag.ContinueOnError)
+	force := flags.Bool("force", false, "allow resetting the production database")
+	if err := c.parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	dbConfig, err := c.destructible(*force)
+	if err != nil {
+		return err
+	}
+	if err := c.dropDatabase(dbConfig); err != nil {
+		return err
+	}
+	if err := c.createDatabase(dbConfig); err != nil {
+		return err
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	if err := c.migrateUp(db); err != nil {
+		return err
+	}
+	return c.seed(db)
+}
+
+func (c *CLI) dbMigrate(args []string) error {
+	if err := c.parseFlags(flag.NewFlagSet("db migrate", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	return c.migrateUp(db)
+}
+
+func (c *CLI) dbRollback(args []string) error {
+	flags := flag.NewFlagSet("db rollback", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return c.usageError("db rollback takes an optional number of steps")
+	}
+	steps := 1
+	if flags.NArg() == 1 {
+		n, err := strconv.Atoi(flags.Arg(0))
+		if err != nil || n < 1 {
+			return c.usageError("steps must be a positive number, got %q", flags.Arg(0))
+		}
+		steps = n
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	reverted, err := migrator.Rollback(steps)
+	for _, migration := range reverted {
+		fmt.Fprintf(c.Stdout, "Rolled back %s\n", migration)
+	}
+	if err != nil {
+		return err
+	}
+	if len(reverted) == 0 {
+		fmt.Fprintln(c.Stdout, "Nothing to roll back")
+	}
+	return nil
+}
+
+func (c *CLI) dbStatus(args []string) error {
+	if err := c.parseFlags(flag.NewFlagSet("db status", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.Stdout, "%-8s %-14s %-20s %s\n", "Status", "Version", "Applied at", "Name")
+	for _, status := range statuses {
+		state, appliedAt := "pending", ""
+		if status.Applied() {
+			state = "up"
+			appliedAt = status.AppliedAt.Local().Format(time.DateTime)
+		}
+		if status.Missing {
+			state = "missing"
+		}
+		fmt.Fprintf(c.Stdout, "%-8s %-14d %-20s %s\n", state, status.Migration.Version, appliedAt, status.Migration.Name)
+	}
+	return nil
+}
+
+func (c *CLI) dbSeed(args []string) error {
+	if err := c.parseFlags(flag.NewFlagSet("db seed", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	return c.seed(db)
+}
+
+// dbNew writes a migration skeleton; it doesn't touch the database
+func (c *CLI) dbNew(args []string) error {
+	flags := flag.NewFlagSet("db new", flag.ContinueOnError)
+	goMigration := flags.Bool("go", false, "write a Go migration instead of SQL")
+	if err := c.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	kind := migrate.KindSQL
+	if *goMigration {
+		kind = migrate.KindGo
+	}
+	paths, err := migrate.Create(c.MigrationsDir, flags.Arg(0), kind, c.Now())
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		fmt.Fprintf(c.Stdout, "Created %s\n", path)
+	}
+	return nil
+}
+
+// destructible loads the database settings for drop and reset, which refuse
+// to run in production unless forced
+func (c *CLI) destructible(force bool) (*config.DatabaseConfig, error) {
+	if config.GetEnvironment() == "production" && !force {
+		return nil, errors.New("refusing to drop the production database without -force")
+	}
+	return c.DatabaseConfig()
+}
+
+func (c *CLI) createDatabase(dbConfig *config.DatabaseConfig) error {
+	created, err := dbConfig.CreateDatabase()
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Fprintf(c.Stdout, "Created database '%s'\n", dbConfig.Database)
+	} else {
+		fmt.Fprintf(c.Stdout, "Database '%s' already exists\n", dbConfig.Database)
+	}
+	return nil
+}
+
+func (c *CLI) dropDatabase(dbConfig *config.DatabaseConfig) error {
+	if err := dbConfig.DropDatabase(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.Stdout, "Dropped database '%s'\n", dbConfig.Database)
+	return nil
+}
+
+func (c *CLI) migrateUp(db *gorm.DB) error {
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	for _, migration := range applied {
+		fmt.Fprintf(c.Stdout, "Applied %s\n", migration)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Fprintln(c.Stdout, "Nothing to migrate")
+	}
+	return nil
+}
+
+// seed creates the built-in roles and permissions; existing ones are kept
+func (c *CLI) seed(db *gorm.DB) error {
+	if err := models.NewRoleRepository(db).Seed(models.DefaultRoles()); err != nil {
+		return fmt.Errorf("failed to seed roles: %w", err)
+	}
+	fmt.Fprintln(c.Stdout, "Seeded roles and permissions")
+	return nil
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"fresh/app/services"
+	"fresh/routes"
+	"log/slog"
+	"sort"
+	"text/tabwriter"
+)
+
+// routes prints every registered route. The app is built with empty
+// dependencies: nothing is served, so no database or templates are needed.
+func (c *CLI) routes(args []string) error {
+	if err := c.parseFlags(flag.NewFlagSet("routes", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	app := newApp(slog.Default(), routes.Dependencies{AuthService: services.NewAuthService(nil, nil)})
+
+	list := app.GetRoutes(true)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Path != list[j].Path {
+			return list[i].Path < list[j].Path
+		}
+		return list[i].Method < list[j].Method
+	})
+
+	w := tabwriter.NewWriter(c.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tPATH")
+	for _, route := range list {
+		// Fiber registers a HEAD route alongside every GET
+		if route.Method == "HEAD" {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\n", route.Method, route.Path)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,319 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"fresh/app/apperror"
+	"fresh/app/controllers"
+	"fresh/app/health"
+	"fresh/app/lifecycle"
+	"fresh/app/logging"
+	"fresh/app/metrics"
+	"fresh/app/middleware"
+	"fresh/app/models"
+	"fresh/app/services"
+	"fresh/app/tracing"
+	"fresh/config"
+	"fresh/db/migrations"
+	"fresh/routes"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// serve migrates the database and runs the web server on $PORT until SIGTERM
+// or SIGINT, then drains requests and closes the database
+func (c *CLI) serve(args []string) error {
+	if err := c.parseFlags(flag.NewFlagSet("serve", flag.ContinueOnError), args, 0); err != nil {
+		return err
+	}
+
+	// Load application settings and initialize database
+	appConfig, err := config.LoadAppConfig("config/app.yml", "")
+	if err != nil {
+		return fmt.Errorf("failed to load app config: %w", err)
+	}
+	logger, err := logging.New(appConfig.Log, c.Stdout)
+	if err != nil {
+		return fmt.Errorf("invalid log config: %w", err)
+	}
+	// The log package, and so anything still using it, goes through it too
+	slog.SetDefault(logger)
+	shutdownTimeout, err := time.ParseDuration(appConfig.Server.ShutdownTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid server shutdown_timeout: %w", err)
+	}
+	drainDelay, err := time.ParseDuration(appConfig.Server.DrainDelay)
+	if err != nil {
+		return fmt.Errorf("invalid server drain_delay: %w", err)
+	}
+
+	// Released in reverse order once the server has stopped
+	hooks := &lifecycle.Hooks{}
+	defer hooks.Run(context.Background())
+
+	// Added first so it runs last, flushing spans once everything has stopped
+	shutdownTracing, err := tracing.Setup(appConfig.Tracing)
+	if err != nil {
+		return err
+	}
+	hooks.Add("tracing", shutdownTracing)
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	if err := tracing.InstrumentGORM(db); err != nil {
+		return fmt.Errorf("failed to trace database queries: %w", err)
+	}
+	hooks.Add("database", func(context.Context) error {
+		return c.CloseDatabase(db)
+	})
+	if err := config.MigrateDatabase(db); err != nil {
+		return fmt.Errorf("migration error: %w", err)
+	}
+
+	// Metrics for HTTP traffic, the connection pool and logins
+	var appMetrics *metrics.Metrics
+	if appConfig.Metrics.Enabled {
+		if config.GetEnvironment() == "production" && appConfig.Metrics.Token == "" && appConfig.Metrics.Listen == "" {
+			return fmt.Errorf("metrics: set a token or a listen address to expose them in production")
+		}
+		appMetrics = metrics.New()
+		if err := appMetrics.RegisterDB(db); err != nil {
+			return fmt.Errorf("failed to register database metrics: %w", err)
+		}
+	}
+
+	// Initialize template service
+	templateService, err := services.NewTemplateService()
+	if err != nil {
+		return fmt.Errorf("failed to initialize templates: %w", err)
+	}
+	if appConfig.Templates.Reload {
+		if config.GetEnvironment() == "production" {
+			return fmt.Errorf("templates: reload is for development; production parses templates once")
+		}
+		pollInterval, err := time.ParseDuration(appConfig.Templates.PollInterval)
+		if err != nil {
+			return fmt.Errorf("invalid templates poll_interval: %w", err)
+		}
+		stopWatching := templateService.Watch(pollInterval)
+		hooks.Add("templates", func(context.Context) error {
+			stopWatching()
+			return nil
+		})
+		slog.Info("reloading templates on change", "dir", "web/templates")
+	}
+
+	// Initialize repositories
+	userRepo := models.NewUserRepository(db)
+	roleRepo := models.NewRoleRepository(db)
+	resetTokenRepo := models.NewPasswordResetTokenRepository(db)
+	recoveryCodeRepo := models.NewRecoveryCodeRepository(db)
+	identityRepo := models.NewUserIdentityRepository(db)
+	apiTokenRepo := models.NewAPITokenRepository(db)
+
+	// Make sure the built-in roles exist
+	if err := roleRepo.Seed(models.DefaultRoles()); err != nil {
+		return fmt.Errorf("failed to seed roles: %w", err)
+	}
+
+	// Initialize sessions
+	sessionStore, err := services.NewSessionStore(appConfig.Session, appConfig.SecretKeyBase, db)
+	if err != nil {
+		return fmt.Errorf("failed to initialize session store: %w", err)
+	}
+	sessionConfig, err := services.NewSessionConfig(appConfig.Session)
+	if err != nil {
+		return fmt.Errorf("failed to configure sessions: %w", err)
+	}
+
+	// Initialize login throttling
+	attemptStore, err := services.NewAttemptStore(appConfig.Auth.RateLimit, db)
+	if err != nil {
+		return fmt.Errorf("failed to initialize rate limit store: %w", err)
+	}
+	throttleConfig, err := services.NewLoginThrottleConfig(appConfig.Auth)
+	if err != nil {
+		return fmt.Errorf("failed to configure login throttling: %w", err)
+	}
+
+	verificationConfig, err := services.NewEmailVerificationConfig(appConfig.Auth)
+	if err != nil {
+		return fmt.Errorf("failed to configure email verification: %w", err)
+	}
+
+	// Initialize mail delivery
+	mailer, err := services.NewMailer(appConfig.Mail)
+	if err != nil {
+		return fmt.Errorf("failed to initialize mailer: %w", err)
+	}
+
+	// Initialize services
+	twoFactorService, err := services.NewTwoFactorService(userRepo, recoveryCodeRepo, appConfig.SecretKeyBase, appConfig.Auth.TwoFactor.Issuer)
+	if err != nil {
+		return fmt.Errorf("failed to initialize two-factor authentication: %w", err)
+	}
+	oidcService, err := services.NewOIDCService(appConfig.OIDC, userRepo, identityRepo, appConfig.SecretKeyBase, appConfig.BaseURL)
+	if err != nil {
+		return fmt.Errorf("failed to configure social login: %w", err)
+	}
+	authOptions := []services.AuthOption{
+		services.WithSessionConfig(sessionConfig),
+		services.WithLoginThrottle(throttleConfig, attemptStore),
+		services.WithPasswordResetTokens(resetTokenRepo),
+		services.WithEmailVerification(appConfig.SecretKeyBase, verificationConfig),
+		services.WithTwoFactor(twoFactorService),
+		services.WithMailer(mailer, templateService, appConfig.BaseURL),
+	}
+	if appMetrics != nil {
+		authOptions = append(authOptions, services.WithMetrics(appMetrics))
+	}
+	authService := services.NewAuthService(userRepo, sessionStore, authOptions...)
+	// Reset emails queued by requests still in flight go out before the
+	// database closes
+	hooks.Add("mail", func(context.Context) error {
+		authService.Wait()
+		return nil
+	})
+
+	userAdminService := services.NewUserAdminService(userRepo, roleRepo, sessionStore, authService)
+	apiTokenService := services.NewAPITokenService(apiTokenRepo, userRepo)
+
+	// Garbage-collect expired sessions and stale login attempts
+	gcInterval, err := time.ParseDuration(appConfig.Session.GCInterval)
+	if err != nil {
+		return fmt.Errorf("invalid session gc_interval: %w", err)
+	}
+	stopCleanup := services.StartCleanup(gcInterval, sessionStore.DeleteExpired, authService.PruneLoginAttempts, func(ctx context.Context) error {
+		return resetTokenRepo.WithContext(ctx).DeleteExpired()
+	})
+	hooks.Add("cleanup", func(context.Context) error {
+		stopCleanup()
+		return nil
+	})
+
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	// Readiness: the database answers, the schema is current and templates
+	// parsed; it fails as soon as shutdown begins
+	healthChecks := health.NewRegistry(
+		health.Database(db),
+		health.Migrations(migrator),
+		health.CheckFunc("templates", func(context.Context) error {
+			return templateService.Loaded()
+		}),
+	)
+	hooks.Notify(healthChecks.MarkShuttingDown)
+
+	// Metrics go on the app's port unless they have their own address
+	var metricsHandler fiber.Handler
+	if appMetrics != nil {
+		metricsHandler = appMetrics.Handler(appConfig.Metrics.Token)
+		if listen := appConfig.Metrics.Listen; listen != "" {
+			if err := serveMetrics(listen, metricsHandler, hooks); err != nil {
+				return err
+			}
+			metricsHandler = nil
+		}
+	}
+
+	app := newApp(logger, routes.Dependencies{
+		AuthController:         controllers.NewAuthController(authService, oidcService, templateService),
+		DashboardController:    controllers.NewDashboardController(authService, templateService),
+		PasswordController:     controllers.NewPasswordController(authService, templateService),
+		VerificationController: controllers.NewVerificationController(authService, templateService),
+		TwoFactorController:    controllers.NewTwoFactorController(authService, twoFactorService, templateService),
+		OIDCController:         controllers.NewOIDCController(authService, oidcService, templateService),
+		AdminUsersController:   controllers.NewAdminUsersController(authService, userAdminService, templateService),
+		APITokenController:     controllers.NewAPITokenController(authService, apiTokenService, templateService),
+		APIAuthController:      controllers.NewAPIAuthController(authService),
+		APIMeController:        controllers.NewAPIMeController(authService),
+		HealthController:       controllers.NewHealthController(healthChecks, config.GetEnvironment() == "production"),
+		AuthService:            authService,
+		APITokenService:        apiTokenService,
+		TemplateService:        templateService,
+		Metrics:                appMetrics,
+		MetricsHandler:         metricsHandler,
+	})
+
+	// Start server
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	// A second signal kills the process the usual way
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	slog.Info("server running", "port", port)
+	return lifecycle.Serve(ctx, app, ln, lifecycle.Config{
+		ShutdownTimeout: shutdownTimeout,
+		DrainDelay:      drainDelay,
+	}, hooks)
+}
+
+// serveMetrics serves /metrics on its own address until the shutdown hooks
+// run, so it stays scrapeable while the app drains
+func serveMetrics(addr string, handler fiber.Handler, hooks *lifecycle.Hooks) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+
+	app := fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		ErrorHandler:          apperror.Handler(apperror.HandlerConfig{Production: true}),
+	})
+	app.Get("/metrics", handler)
+	go app.Listener(ln)
+
+	hooks.Add("metrics", func(ctx context.Context) error {
+		return app.ShutdownWithContext(ctx)
+	})
+	slog.Info("serving metrics", "address", ln.Addr().String())
+	return nil
+}
+
+// newApp builds the Fiber app with its middleware, static files and routes
+func newApp(logger *slog.Logger, deps routes.Dependencies) *fiber.App {
+	app := fiber.New(fiber.Config{
+		// Startup is logged like everything else
+		DisableStartupMessage: true,
+		// problem+json for API clients, error pages for browsers
+		ErrorHandler: apperror.Handler(apperror.HandlerConfig{
+			Renderer:   deps.TemplateService,
+			Production: config.GetEnvironment() == "production",
+		}),
+	})
+
+	// Tag every request and its log lines with an ID, then log it
+	app.Use(middleware.RequestID(logger))
+	app.Use(middleware.AccessLog())
+
+	// Static files
+	app.Static("/static", "./web/static")
+
+	routes.SetupRoutes(app, deps)
+	return app
+}
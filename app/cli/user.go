@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"fresh/app/models"
+	"fresh/app/services"
+	"strings"
+)
+
+func (c *CLI) user(args []string) error {
+	if len(args) == 0 {
+		return c.usageError("user needs a subcommand")
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "create":
+		return c.userCreate(args)
+	case "reset-password":
+		return c.userResetPassword(args)
+	case "promote":
+		return c.userPromote(args)
+	default:
+		return c.usageError("unknown user command %q", command)
+	}
+}
+
+// userCreate creates an account with a verified email, for the first admin
+// or anyone who can't sign up themselves
+func (c *CLI) userCreate(args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	admin := flags.Bool("admin", false, "grant the admin role")
+	if err := c.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+	email := strings.TrimSpace(flags.Arg(0))
+
+	password, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+	if err := services.ValidatePassword(password); err != nil {
+		return err
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	userRepo := models.NewUserRepository(db)
+	roleRepo := models.NewRoleRepository(db)
+
+	user, err := services.NewAuthService(userRepo, nil).Register(context.Background(), email, password)
+	if err != nil {
+		return err
+	}
+	if err := userRepo.MarkEmailVerified(user); err != nil {
+		return err
+	}
+	if *admin {
+		if err := assignRole(userRepo, roleRepo, user, models.RoleAdmin); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(c.Stdout, "Created user %s (id %d)\n", user.Email, user.ID)
+	return nil
+}
+
+// userResetPassword sets a new password. Sessions started before the change
+// stop working, and any lockout is cleared.
+func (c *CLI) userResetPassword(args []string) error {
+	flags := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	if err := c.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	userRepo := models.NewUserRepository(db)
+	user, err := findUser(userRepo, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	password, err := c.readPassword()
+	if err != nil {
+		return err
+	}
+	if err := services.ValidatePassword(password); err != nil {
+		return err
+	}
+	if err := userRepo.UpdatePassword(user, password); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.Stdout, "Password changed for %s\n", user.Email)
+	return nil
+}
+
+func (c *CLI) userPromote(args []string) error {
+	flags := flag.NewFlagSet("user promote", flag.ContinueOnError)
+	role := flags.String("role", models.RoleAdmin, "the role to grant")
+	if err := c.parseFlags(flags, args, 1); err != nil {
+		return err
+	}
+
+	db, err := c.OpenDatabase()
+	if err != nil {
+		return err
+	}
+	defer c.closeDatabase(db)
+	userRepo := models.NewUserRepository(db)
+	user, err := findUser(userRepo, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := assignRole(userRepo, models.NewRoleRepository(db), user, *role); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.Stdout, "Granted %s to %s\n", *role, user.Email)
+	return nil
+}
+
+func findUser(userRepo *models.UserRepository, email string) (*models.User, error) {
+	user, err := userRepo.FindByEmail(strings.TrimSpace(email))
+	if err != nil {
+		return nil, fmt.Errorf("no user with email %s", email)
+	}
+	return user, nil
+}
+
+// assignRole grants the role unless the user already has it
+func assignRole(userRepo *models.UserRepository, roleRepo *models.RoleRepository, user *models.User, name string) error {
+	if _, err := roleRepo.FindByName(name); err != nil {
+		return fmt.Errorf("role %s doesn't exist; run \"fresh db seed\" to create the built-in roles", name)
+	}
+	if err := userRepo.LoadRoles(user); err != nil {
+		return err
+	}
+	if user.HasRole(name) {
+		return nil
+	}
+	return roleRepo.AssignRole(user, name)
+}
@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"fresh/app/logging"
+	"fresh/app/models"
+	"fresh/app/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// adminUserNotices are the messages shown after an action redirects back
+var adminUserNotices = map[string]string{
+	"locked":   "The account has been locked and signed out everywhere.",
+	"unlocked": "The account has been unlocked.",
+	"reset":    "The password was cleared and a reset link has been emailed.",
+	"roles":    "Roles have been updated.",
+	"deleted":  "The account has been deleted.",
+}
+
+type AdminUsersController struct {
+	authService     *services.AuthService
+	adminService    *services.UserAdminService
+	templateService services.TemplateRenderer
+}
+
+func NewAdminUsersController(authService *services.AuthService, adminService *services.UserAdminService, templateService services.TemplateRenderer) *AdminUsersController {
+	return &AdminUsersController{
+		authService:     authService,
+		adminService:    adminService,
+		templateService: templateService,
+	}
+}
+
+// Index lists users, optionally filtered by ?q= and paged with ?page=
+func (ac *AdminUsersController) Index(c *fiber.Ctx) error {
+	query := c.Query("q")
+	page, err := ac.adminService.List(c.UserContext(), models.UserListOptions{
+		Query: query,
+		Page:  c.QueryInt("page", 1),
+	})
+	if err != nil {
+		return err
+	}
+
+	return ac.templateService.Render(c, "admin/users/index", fiber.Map{
+		"Title":  "Users - Fresh Admin",
+		"Query":  query,
+		"Page":   page,
+		"Notice": adminUserNotices[c.Query("notice")],
+	})
+}
+
+func (ac *AdminUsersController) Show(c *fiber.Ctx) error {
+	user, err := ac.findUser(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := ac.showData(c, user)
+	if err != nil {
+		return err
+	}
+	data["Notice"] = adminUserNotices[c.Query("notice")]
+
+	return ac.templateService.Render(c, "admin/users/show", data)
+}
+
+func (ac *AdminUsersController) Lock(c *fiber.Ctx) error {
+	return ac.act(c, "locked", func(actor, user *models.User) error {
+		return ac.adminService.Lock(c.UserContext(), actor, user)
+	})
+}
+
+func (ac *AdminUsersController) Unlock(c *fiber.Ctx) error {
+	return ac.act(c, "unlocked", func(actor, user *models.User) error {
+		return ac.adminService.Unlock(c.UserContext(), user)
+	})
+}
+
+func (ac *AdminUsersController) ForcePasswordReset(c *fiber.Ctx) error {
+	return ac.act(c, "reset", func(actor, user *models.User) error {
+		return ac.adminService.ForcePasswordReset(c.UserContext(), user)
+	})
+}
+
+// UpdateRoles replaces the user's roles with the checked "roles" boxes
+func (ac *AdminUsersController) UpdateRoles(c *fiber.Ctx) error {
+	var names []string
+	for _, value := range c.Request().PostArgs().PeekMulti("roles") {
+		names = append(names, string(value))
+	}
+
+	return ac.act(c, "roles", func(actor, user *models.User) error {
+		return ac.adminService.SetRoles(c.UserContext(), actor, user, names)
+	})
+}
+
+func (ac *AdminUsersController) Delete(c *fiber.Ctx) error {
+	actor, err := ac.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+	user, err := ac.findUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err := ac.adminService.Delete(c.UserContext(), actor, user); err != nil {
+		return ac.renderActionError(c, user, err)
+	}
+	logging.FromCtx(c).Info("admin deleted user", "admin_id", actor.ID, "user_id", user.ID)
+
+	return c.Redirect("/admin/users?notice=deleted")
+}
+
+// act runs an action against the user in the URL and redirects back to
+// their page with a notice
+func (ac *AdminUsersController) act(c *fiber.Ctx, notice string, action func(actor, user *models.User) error) error {
+	actor, err := ac.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+	user, err := ac.findUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err := action(actor, user); err != nil {
+		return ac.renderActionError(c, user, err)
+	}
+	logging.FromCtx(c).Info("admin action", "admin_id", actor.ID, "action", notice, "user_id", user.ID)
+
+	return c.Redirect(fmt.Sprintf("/admin/users/%d?notice=%s", user.ID, notice))
+}
+
+func (ac *AdminUsersController) renderActionError(c *fiber.Ctx, user *models.User, err error) error {
+	logging.FromCtx(c).Warn("admin action failed", "user_id", user.ID, "error", err)
+
+	data, dataErr := ac.showData(c, user)
+	if dataErr != nil {
+		return dataErr
+	}
+
+	var unknownRole *services.UnknownRoleError
+	if errors.Is(err, services.ErrCannotModifySelf) || errors.As(err, &unknownRole) {
+		c.Status(fiber.StatusUnprocessableEntity)
+		data["Error"] = err.Error()
+	} else {
+		c.Status(fiber.StatusInternalServerError)
+		data["Error"] = "Something went wrong. Please try again."
+	}
+
+	return ac.templateService.Render(c, "admin/users/show", data)
+}
+
+func (ac *AdminUsersController) findUser(c *fiber.Ctx) (*models.User, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return nil, fiber.ErrNotFound
+	}
+
+	user, err := ac.adminService.Find(c.UserContext(), uint(id))
+	if err != nil {
+		return nil, fiber.ErrNotFound
+	}
+	return user, nil
+}
+
+func (ac *AdminUsersController) showData(c *fiber.Ctx, user *models.User) (fiber.Map, error) {
+	roles, err := ac.adminService.Roles(c.UserContext())
+	if err != nil {
+		return nil, err
+	}
+
+	return fiber.Map{
+		"Title":   user.Email + " - Fresh Admin",
+		"Account": user,
+		"Roles":   roles,
+	}, nil
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/apperror"
+	"fresh/app/models"
+	"fresh/app/services"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiUser is how the API presents a user
+type apiUser struct {
+	ID               uint      `json:"id"`
+	Email            string    `json:"email"`
+	EmailVerified    bool      `json:"email_verified"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	Roles            []string  `json:"roles"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+func newAPIUser(user *models.User) apiUser {
+	roles := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, role.Name)
+	}
+
+	return apiUser{
+		ID:               user.ID,
+		Email:            user.Email,
+		EmailVerified:    user.EmailVerified(),
+		TwoFactorEnabled: user.TwoFactorEnabled(),
+		Roles:            roles,
+		CreatedAt:        user.CreatedAt,
+	}
+}
+
+// errInvalidJSON is returned for request bodies that don't parse
+var errInvalidJSON = fiber.NewError(fiber.StatusBadRequest, "invalid JSON body")
+
+// apiThrottled returns a 429 error with Retry-After set if err is a
+// *services.TooManyAttemptsError, and nil otherwise
+func apiThrottled(c *fiber.Ctx, err error) error {
+	var throttled *services.TooManyAttemptsError
+	if !errors.As(err, &throttled) {
+		return nil
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+	return apperror.TooManyRequests(err.Error())
+}
+
+// requiredFields reports each empty value as a validation error
+func requiredFields(values map[string]string) error {
+	fields := make(map[string]string)
+	for name, value := range values {
+		if value == "" {
+			fields[name] = "is required"
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return apperror.Validation("some fields are missing", fields)
+}
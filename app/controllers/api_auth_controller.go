@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/apperror"
+	"fresh/app/logging"
+	"fresh/app/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type credentialsRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Code is the TOTP or recovery code for accounts with 2FA
+	Code string `json:"code"`
+}
+
+// APIAuthController signs API clients in and out and registers accounts.
+// Sessions are the same cookie sessions the web app uses.
+type APIAuthController struct {
+	authService *services.AuthService
+}
+
+func NewAPIAuthController(authService *services.AuthService) *APIAuthController {
+	return &APIAuthController{authService: authService}
+}
+
+// CreateSession signs in with email and password, plus a code if the
+// account has two-factor authentication
+func (ac *APIAuthController) CreateSession(c *fiber.Ctx) error {
+	var req credentialsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return errInvalidJSON
+	}
+	if err := requiredFields(map[string]string{"email": req.Email, "password": req.Password}); err != nil {
+		return err
+	}
+
+	user, err := ac.authService.Login(c.UserContext(), req.Email, req.Password, c.IP())
+	if err != nil {
+		logging.FromCtx(c).Info("api login failed", "email", req.Email, "ip", c.IP(), "error", err)
+		if throttled := apiThrottled(c, err); throttled != nil {
+			return throttled
+		}
+		if errors.Is(err, services.ErrAccountLocked) {
+			return apperror.Forbidden(err.Error())
+		}
+		return apperror.Unauthorized("invalid credentials")
+	}
+
+	if ac.authService.RequiresSecondFactor(user) {
+		if req.Code == "" {
+			return apperror.Unauthorized("a two-factor authentication code is required").
+				With("two_factor_required", true)
+		}
+		if err := ac.authService.VerifySecondFactor(c.UserContext(), user, req.Code); err != nil {
+			logging.FromCtx(c).Info("api second factor failed", "user_id", user.ID, "ip", c.IP(), "error", err)
+			if throttled := apiThrottled(c, err); throttled != nil {
+				return throttled
+			}
+			return apperror.Unauthorized(err.Error())
+		}
+	}
+
+	if err := ac.authService.SetUserSession(c, user); err != nil {
+		return err
+	}
+	logging.FromCtx(c).Info("api login succeeded", "user_id", user.ID)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"user": newAPIUser(user)})
+}
+
+// DestroySession signs out. It succeeds even without a session.
+func (ac *APIAuthController) DestroySession(c *fiber.Ctx) error {
+	if err := ac.authService.ClearUserSession(c); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Register creates an account, signs it in and sends the verification email
+func (ac *APIAuthController) Register(c *fiber.Ctx) error {
+	var req credentialsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return errInvalidJSON
+	}
+	if err := requiredFields(map[string]string{"email": req.Email, "password": req.Password}); err != nil {
+		return err
+	}
+
+	user, err := ac.authService.Register(c.UserContext(), req.Email, req.Password)
+	if err != nil {
+		logging.FromCtx(c).Info("api registration failed", "email", req.Email, "ip", c.IP(), "error", err)
+		if errors.Is(err, services.ErrEmailTaken) {
+			return apperror.Conflict(err.Error())
+		}
+		return apperror.Validation(err.Error(), nil)
+	}
+	logging.FromCtx(c).Info("api registration succeeded", "user_id", user.ID)
+
+	if err := ac.authService.SetUserSession(c, user); err != nil {
+		return err
+	}
+	if err := ac.authService.SendEmailVerification(c.UserContext(), user); err != nil {
+		logging.FromCtx(c).Error("verification email failed", "user_id", user.ID, "error", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"user": newAPIUser(user)})
+}
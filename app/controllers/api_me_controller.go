@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/apperror"
+	"fresh/app/logging"
+	"fresh/app/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type updateMeRequest struct {
+	// CurrentPassword is required for any change
+	CurrentPassword string  `json:"current_password"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+}
+
+// APIMeController serves the signed-in user's own account
+type APIMeController struct {
+	authService *services.AuthService
+}
+
+func NewAPIMeController(authService *services.AuthService) *APIMeController {
+	return &APIMeController{authService: authService}
+}
+
+func (mc *APIMeController) Show(c *fiber.Ctx) error {
+	user, err := mc.authService.GetCurrentUser(c)
+	if err != nil {
+		return apperror.Unauthorized("authentication required")
+	}
+
+	return c.JSON(fiber.Map{"user": newAPIUser(user)})
+}
+
+// Update changes the email address and/or password
+func (mc *APIMeController) Update(c *fiber.Ctx) error {
+	user, err := mc.authService.GetCurrentUser(c)
+	if err != nil {
+		return apperror.Unauthorized("authentication required")
+	}
+
+	var req updateMeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return errInvalidJSON
+	}
+	if req.Email == nil && req.Password == nil {
+		return apperror.Validation("nothing to update; send email and/or password", nil)
+	}
+
+	changes := services.AccountChanges{Email: req.Email, Password: req.Password}
+	if err := mc.authService.UpdateAccount(c.UserContext(), user, req.CurrentPassword, changes); err != nil {
+		return mc.updateError(c, user.ID, err)
+	}
+
+	// A new password ended every session; a cookie caller gets a new one
+	if req.Password != nil && c.Locals(services.APITokenKey) == nil {
+		if err := mc.authService.SetUserSession(c, user); err != nil {
+			return err
+		}
+	}
+
+	logging.FromCtx(c).Info("api account updated", "user_id", user.ID)
+
+	return c.JSON(fiber.Map{"user": newAPIUser(user)})
+}
+
+func (mc *APIMeController) updateError(c *fiber.Ctx, userID uint, err error) error {
+	logging.FromCtx(c).Info("api account update failed", "user_id", userID, "error", err)
+
+	if throttled := apiThrottled(c, err); throttled != nil {
+		return throttled
+	}
+	if errors.Is(err, services.ErrEmailTaken) {
+		return apperror.Conflict(err.Error())
+	}
+	return apperror.Validation(err.Error(), nil)
+}
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/models"
+	"fresh/app/services"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiTokenLifetimes are the expiry choices on the token form, in days.
+// "0" means the token doesn't expire.
+var apiTokenLifetimes = []string{"30", "90", "365", "0"}
+
+type APITokenController struct {
+	authService     *services.AuthService
+	tokenService    *services.APITokenService
+	templateService services.TemplateRenderer
+}
+
+func NewAPITokenController(authService *services.AuthService, tokenService *services.APITokenService, templateService services.TemplateRenderer) *APITokenController {
+	return &APITokenController{
+		authService:     authService,
+		tokenService:    tokenService,
+		templateService: templateService,
+	}
+}
+
+// Index lists the user's tokens
+func (tc *APITokenController) Index(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	data, err := tc.indexData(c, user)
+	if err != nil {
+		return err
+	}
+	if c.Query("revoked") != "" {
+		data["Notice"] = "The token has been revoked."
+	}
+
+	return tc.templateService.Render(c, "api_tokens", data)
+}
+
+// Create issues a token and shows it, the only time it is ever shown
+func (tc *APITokenController) Create(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	var scopes []string
+	for _, value := range c.Request().PostArgs().PeekMulti("scopes") {
+		scopes = append(scopes, string(value))
+	}
+
+	var plaintext string
+	var token *models.APIToken
+	lifetime := c.FormValue("expires_in", "30")
+	if slices.Contains(apiTokenLifetimes, lifetime) {
+		days, _ := strconv.Atoi(lifetime)
+		plaintext, token, err = tc.tokenService.Create(c.UserContext(), user, c.FormValue("name"), scopes, time.Duration(days)*24*time.Hour)
+	} else {
+		err = services.ErrAPITokenLifetime
+	}
+
+	data, dataErr := tc.indexData(c, user)
+	if dataErr != nil {
+		return dataErr
+	}
+
+	if err != nil {
+		logging.FromCtx(c).Info("api token creation failed", "user_id", user.ID, "error", err)
+		if errors.Is(err, services.ErrAPITokenName) || errors.Is(err, services.ErrAPITokenScopes) ||
+			errors.Is(err, services.ErrAPITokenLifetime) {
+			c.Status(fiber.StatusUnprocessableEntity)
+			data["Error"] = err.Error()
+		} else {
+			c.Status(fiber.StatusInternalServerError)
+			data["Error"] = "We couldn't create the token. Please try again."
+		}
+		data["Name"] = c.FormValue("name")
+		return tc.templateService.Render(c, "api_tokens", data)
+	}
+
+	logging.FromCtx(c).Info("api token created", "token_id", token.ID, "user_id", user.ID)
+
+	data["NewToken"] = plaintext
+	data["NewTokenName"] = token.Name
+	return tc.templateService.Render(c, "api_tokens", data)
+}
+
+func (tc *APITokenController) Revoke(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil || id <= 0 {
+		return fiber.ErrNotFound
+	}
+	if err := tc.tokenService.Revoke(c.UserContext(), user, uint(id)); err != nil {
+		return fiber.ErrNotFound
+	}
+
+	logging.FromCtx(c).Info("api token revoked", "token_id", id, "user_id", user.ID)
+
+	return c.Redirect("/account/tokens?revoked=1")
+}
+
+func (tc *APITokenController) indexData(c *fiber.Ctx, user *models.User) (fiber.Map, error) {
+	tokens, err := tc.tokenService.List(c.UserContext(), user)
+	if err != nil {
+		return nil, err
+	}
+
+	return fiber.Map{
+		"Title":     "API Tokens - Fresh",
+		"Tokens":    tokens,
+		"Scopes":    models.APIScopes(),
+		"Lifetimes": apiTokenLifetimes,
+	}, nil
+}
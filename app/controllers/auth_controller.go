@@ -1,48 +1,80 @@
 package controllers
 
 import (
-	"fmt"
+	"errors"
+	"fresh/app/logging"
 	"fresh/app/services"
+	"math"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 type AuthController struct {
 	authService     *services.AuthService
+	oidcService     *services.OIDCService
 	templateService services.TemplateRenderer
 }
 
-func NewAuthController(authService *services.AuthService, templateService services.TemplateRenderer) *AuthController {
+// NewAuthController builds the password login controller. oidcService may be
+// nil when no social login providers are configured.
+func NewAuthController(authService *services.AuthService, oidcService *services.OIDCService, templateService services.TemplateRenderer) *AuthController {
 	return &AuthController{
 		authService:     authService,
+		oidcService:     oidcService,
 		templateService: templateService,
 	}
 }
 
 func (ac *AuthController) ShowLogin(c *fiber.Ctx) error {
-	return ac.templateService.Render(c, "login", fiber.Map{
-		"Title": "Login - Fresh",
-	})
+	data := fiber.Map{
+		"Title":     "Login - Fresh",
+		"Providers": ac.oidcService.Providers(),
+	}
+	if c.Query("reset") != "" {
+		data["Notice"] = "Your password has been reset. Please sign in with your new password."
+	}
+	if c.Query("verified") != "" {
+		data["Notice"] = "Your email address has been verified. Please sign in."
+	}
+
+	return ac.templateService.Render(c, "login", data)
 }
 
 func (ac *AuthController) HandleLogin(c *fiber.Ctx) error {
 	email := c.FormValue("email")
 	password := c.FormValue("password")
 
-	// Debug logging
-	fmt.Printf("Login attempt - Email: %s, IP: %s\n", email, c.IP())
-
-	user, err := ac.authService.Login(email, password)
+	user, err := ac.authService.Login(c.UserContext(), email, password, c.IP())
 	if err != nil {
-		fmt.Printf("Login failed: %v\n", err)
+		logging.FromCtx(c).Info("login failed", "email", email, "ip", c.IP(), "error", err)
+
+		var throttled *services.TooManyAttemptsError
+		if errors.As(err, &throttled) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			c.Status(fiber.StatusTooManyRequests)
+		}
+
 		return ac.templateService.Render(c, "login", fiber.Map{
-			"Title": "Login - Fresh",
-			"Error": err.Error(),
+			"Title":     "Login - Fresh",
+			"Error":     err.Error(),
+			"Email":     email,
+			"Providers": ac.oidcService.Providers(),
 		})
 	}
 
-	ac.authService.SetUserSession(c, user)
-	fmt.Printf("Login successful for user ID %d (email: %s)\n", user.ID, email)
+	// Users with 2FA get no session until they pass the code step
+	if ac.authService.RequiresSecondFactor(user) {
+		if err := ac.authService.BeginSecondFactor(c, user); err != nil {
+			return err
+		}
+		return c.Redirect("/login/2fa")
+	}
+
+	if err := ac.authService.SetUserSession(c, user); err != nil {
+		return err
+	}
+	logging.FromCtx(c).Info("login succeeded", "user_id", user.ID)
 
 	return c.Redirect("/dashboard")
 }
@@ -57,28 +89,34 @@ func (ac *AuthController) HandleRegister(c *fiber.Ctx) error {
 	email := c.FormValue("email")
 	password := c.FormValue("password")
 
-	fmt.Printf("Registration attempt - Email: %s, IP: %s\n", email, c.IP())
-
-	user, err := ac.authService.Register(email, password)
+	user, err := ac.authService.Register(c.UserContext(), email, password)
 	if err != nil {
-		fmt.Printf("Registration failed: %v\n", err)
+		logging.FromCtx(c).Info("registration failed", "email", email, "ip", c.IP(), "error", err)
 		return ac.templateService.Render(c, "register", fiber.Map{
 			"Title": "Register - Fresh",
 			"Error": err.Error(),
 		})
 	}
 
-	fmt.Printf("Registration successful for user ID %d (email: %s)\n", user.ID, email)
+	logging.FromCtx(c).Info("registration succeeded", "user_id", user.ID)
 
 	// Automatically log in the user after successful registration
-	ac.authService.SetUserSession(c, user)
-	fmt.Printf("User automatically logged in after registration\n")
+	if err := ac.authService.SetUserSession(c, user); err != nil {
+		return err
+	}
 
-	return c.Redirect("/dashboard")
+	// The account works without a delivered email; the notice page can resend
+	if err := ac.authService.SendEmailVerification(c.UserContext(), user); err != nil {
+		logging.FromCtx(c).Error("verification email failed", "user_id", user.ID, "error", err)
+	}
+
+	return c.Redirect("/verify-email")
 }
 
 func (ac *AuthController) HandleLogout(c *fiber.Ctx) error {
-	ac.authService.ClearUserSession(c)
-	fmt.Printf("User logged out, IP: %s\n", c.IP())
+	if err := ac.authService.ClearUserSession(c); err != nil {
+		return err
+	}
+	logging.FromCtx(c).Info("logged out")
 	return c.Redirect("/login")
 }
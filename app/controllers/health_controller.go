@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"fresh/app/buildinfo"
+	"fresh/app/health"
+	"fresh/app/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HealthController serves the orchestrator's probes and the build version
+type HealthController struct {
+	checks *health.Registry
+	// production hides check errors, which can name internal hosts, from
+	// the response; they are logged instead
+	production bool
+}
+
+func NewHealthController(checks *health.Registry, production bool) *HealthController {
+	return &HealthController{checks: checks, production: production}
+}
+
+// Healthz is the liveness probe: it answers as long as the process can serve
+// requests at all, and checks nothing else, so a database outage doesn't get
+// the app restarted
+func (hc *HealthController) Healthz(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{"status": health.StatusOK})
+}
+
+// Readyz is the readiness probe: 200 when every registered check passes,
+// 503 otherwise, including once shutdown has begun
+func (hc *HealthController) Readyz(c *fiber.Ctx) error {
+	report := hc.checks.Run(c.UserContext())
+
+	status := fiber.StatusOK
+	if !report.OK() {
+		status = fiber.StatusServiceUnavailable
+	}
+	for i, result := range report.Checks {
+		if result.Error == "" {
+			continue
+		}
+		logging.FromCtx(c).Warn("readiness check failed", "check", result.Name, "error", result.Error)
+		if hc.production {
+			report.Checks[i].Error = ""
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(status).JSON(report)
+}
+
+// Version reports the build the process is running
+func (hc *HealthController) Version(c *fiber.Ctx) error {
+	return c.JSON(buildinfo.Get())
+}
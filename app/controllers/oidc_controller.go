@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/services"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// oidcFlowCookieName holds the sealed state, nonce and PKCE verifier while
+// the user is at the provider
+const oidcFlowCookieName = "fresh_oidc"
+
+// oidcTimeout bounds discovery and the code exchange
+const oidcTimeout = 10 * time.Second
+
+type OIDCController struct {
+	authService     *services.AuthService
+	oidcService     *services.OIDCService
+	templateService services.TemplateRenderer
+}
+
+func NewOIDCController(authService *services.AuthService, oidcService *services.OIDCService, templateService services.TemplateRenderer) *OIDCController {
+	return &OIDCController{
+		authService:     authService,
+		oidcService:     oidcService,
+		templateService: templateService,
+	}
+}
+
+// Redirect sends the user to the provider's sign-in page
+func (oc *OIDCController) Redirect(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), oidcTimeout)
+	defer cancel()
+
+	authURL, flow, err := oc.oidcService.AuthCodeURL(ctx, c.Params("provider"))
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownProvider) {
+			return fiber.ErrNotFound
+		}
+		logging.FromCtx(c).Error("oidc redirect failed", "provider", c.Params("provider"), "error", err)
+		return oc.renderLoginError(c, "Sign-in with this provider is unavailable right now. Please try again later.")
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcFlowCookieName,
+		Value:    flow,
+		Path:     "/auth",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HTTPOnly: true,
+		Secure:   oc.authService.SessionConfig().Secure,
+		// Lax so the cookie comes back on the provider's top-level redirect
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect(authURL)
+}
+
+// Callback completes the sign-in when the provider redirects back
+func (oc *OIDCController) Callback(c *fiber.Ctx) error {
+	provider := c.Params("provider")
+	flow := c.Cookies(oidcFlowCookieName)
+
+	// The flow cookie is single use whatever the outcome
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcFlowCookieName,
+		Value:    "",
+		Path:     "/auth",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Secure:   oc.authService.SessionConfig().Secure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	if providerError := c.Query("error"); providerError != "" {
+		logging.FromCtx(c).Info("oidc provider returned an error", "provider", provider, "error", providerError)
+		return oc.renderLoginError(c, "Sign-in was cancelled or denied by the provider.")
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), oidcTimeout)
+	defer cancel()
+
+	claims, err := oc.oidcService.Exchange(ctx, provider, flow, c.Query("state"), c.Query("code"))
+	if err != nil {
+		logging.FromCtx(c).Warn("oidc sign-in failed", "provider", provider, "error", err)
+		if errors.Is(err, services.ErrUnknownProvider) {
+			return fiber.ErrNotFound
+		}
+		if errors.Is(err, services.ErrInvalidOIDCFlow) {
+			return oc.renderLoginError(c, err.Error())
+		}
+		return oc.renderLoginError(c, "We couldn't sign you in with this provider. Please try again.")
+	}
+
+	current, _ := oc.authService.GetCurrentUser(c)
+
+	user, err := oc.oidcService.ResolveUser(c.UserContext(), provider, claims, current)
+	if err != nil {
+		logging.FromCtx(c).Info("oidc account resolution failed", "provider", provider, "error", err)
+		return oc.renderLoginError(c, err.Error())
+	}
+
+	if current != nil {
+		logging.FromCtx(c).Info("oidc identity connected", "provider", provider, "user_id", user.ID)
+		return c.Redirect("/dashboard")
+	}
+
+	if oc.authService.RequiresSecondFactor(user) {
+		if err := oc.authService.BeginSecondFactor(c, user); err != nil {
+			return err
+		}
+		return c.Redirect("/login/2fa")
+	}
+
+	if err := oc.authService.SetUserSession(c, user); err != nil {
+		return err
+	}
+	logging.FromCtx(c).Info("login succeeded", "user_id", user.ID, "provider", provider)
+
+	return c.Redirect("/dashboard")
+}
+
+func (oc *OIDCController) renderLoginError(c *fiber.Ctx, message string) error {
+	return oc.templateService.Render(c, "login", fiber.Map{
+		"Title":     "Login - Fresh",
+		"Error":     message,
+		"Providers": oc.oidcService.Providers(),
+	})
+}
@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/services"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// forgotPasswordNotice is shown whether or not the email is registered
+const forgotPasswordNotice = "If an account exists for that email, we've sent a link to reset its password."
+
+type PasswordController struct {
+	authService     *services.AuthService
+	templateService services.TemplateRenderer
+}
+
+func NewPasswordController(authService *services.AuthService, templateService services.TemplateRenderer) *PasswordController {
+	return &PasswordController{
+		authService:     authService,
+		templateService: templateService,
+	}
+}
+
+func (pc *PasswordController) ShowForgot(c *fiber.Ctx) error {
+	return pc.templateService.Render(c, "forgot_password", fiber.Map{
+		"Title": "Forgot Password - Fresh",
+	})
+}
+
+func (pc *PasswordController) HandleForgot(c *fiber.Ctx) error {
+	email := c.FormValue("email")
+
+	if err := pc.authService.RequestPasswordReset(c.UserContext(), email, c.IP()); err != nil {
+		logging.FromCtx(c).Warn("password reset request failed", "email", email, "ip", c.IP(), "error", err)
+
+		var throttled *services.TooManyAttemptsError
+		if errors.As(err, &throttled) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			c.Status(fiber.StatusTooManyRequests)
+		}
+		if email == "" || throttled != nil {
+			return pc.templateService.Render(c, "forgot_password", fiber.Map{
+				"Title": "Forgot Password - Fresh",
+				"Error": err.Error(),
+			})
+		}
+	}
+
+	// Same response for known and unknown addresses
+	return pc.templateService.Render(c, "forgot_password", fiber.Map{
+		"Title":  "Forgot Password - Fresh",
+		"Notice": forgotPasswordNotice,
+	})
+}
+
+func (pc *PasswordController) ShowReset(c *fiber.Ctx) error {
+	token := c.Params("token")
+
+	data := fiber.Map{
+		"Title": "Reset Password - Fresh",
+		"Token": token,
+	}
+	if err := pc.authService.ValidatePasswordResetToken(c.UserContext(), token); err != nil {
+		data["Error"] = err.Error()
+		data["Invalid"] = true
+	}
+
+	return pc.templateService.Render(c, "reset_password", data)
+}
+
+func (pc *PasswordController) HandleReset(c *fiber.Ctx) error {
+	token := c.Params("token")
+	password := c.FormValue("password")
+
+	if password != c.FormValue("password_confirmation") {
+		return pc.templateService.Render(c, "reset_password", fiber.Map{
+			"Title": "Reset Password - Fresh",
+			"Token": token,
+			"Error": "passwords do not match",
+		})
+	}
+
+	user, err := pc.authService.ResetPassword(c.UserContext(), token, password)
+	if err != nil {
+		logging.FromCtx(c).Info("password reset failed", "ip", c.IP(), "error", err)
+		return pc.templateService.Render(c, "reset_password", fiber.Map{
+			"Title":   "Reset Password - Fresh",
+			"Token":   token,
+			"Error":   err.Error(),
+			"Invalid": err == services.ErrInvalidResetToken,
+		})
+	}
+
+	logging.FromCtx(c).Info("password reset", "user_id", user.ID)
+
+	// Signed out everywhere, including this browser
+	if err := pc.authService.ClearUserSession(c); err != nil {
+		return err
+	}
+
+	return c.Redirect("/login?reset=1")
+}
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/models"
+	"fresh/app/services"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type TwoFactorController struct {
+	authService      *services.AuthService
+	twoFactorService *services.TwoFactorService
+	templateService  services.TemplateRenderer
+}
+
+func NewTwoFactorController(authService *services.AuthService, twoFactorService *services.TwoFactorService, templateService services.TemplateRenderer) *TwoFactorController {
+	return &TwoFactorController{
+		authService:      authService,
+		twoFactorService: twoFactorService,
+		templateService:  templateService,
+	}
+}
+
+// ShowChallenge asks for the code after a successful password step
+func (tc *TwoFactorController) ShowChallenge(c *fiber.Ctx) error {
+	if _, err := tc.authService.PendingSecondFactorUser(c); err != nil {
+		return c.Redirect("/login")
+	}
+
+	return tc.templateService.Render(c, "login_two_factor", fiber.Map{
+		"Title": "Two-Factor Authentication - Fresh",
+	})
+}
+
+func (tc *TwoFactorController) HandleChallenge(c *fiber.Ctx) error {
+	user, err := tc.authService.CompleteSecondFactor(c, c.FormValue("code"))
+	if err != nil {
+		logging.FromCtx(c).Info("second factor failed", "ip", c.IP(), "error", err)
+
+		if errors.Is(err, services.ErrNoPendingSecondFactor) {
+			return c.Redirect("/login")
+		}
+
+		var throttled *services.TooManyAttemptsError
+		if errors.As(err, &throttled) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			c.Status(fiber.StatusTooManyRequests)
+		}
+
+		return tc.templateService.Render(c, "login_two_factor", fiber.Map{
+			"Title": "Two-Factor Authentication - Fresh",
+			"Error": err.Error(),
+		})
+	}
+
+	logging.FromCtx(c).Info("login succeeded", "user_id", user.ID, "two_factor", true)
+
+	return c.Redirect("/dashboard")
+}
+
+// Show is the 2FA settings page
+func (tc *TwoFactorController) Show(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	data, err := tc.settingsData(c, user)
+	if err != nil {
+		return err
+	}
+	if c.Query("disabled") != "" {
+		data["Notice"] = "Two-factor authentication has been turned off."
+	}
+
+	return tc.templateService.Render(c, "two_factor", data)
+}
+
+// BeginSetup generates a new secret and shows the QR code
+func (tc *TwoFactorController) BeginSetup(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+	if user.TwoFactorEnabled() {
+		return c.Redirect("/account/2fa")
+	}
+
+	enrollment, err := tc.twoFactorService.BeginEnrollment(c.UserContext(), user)
+	if err != nil {
+		return err
+	}
+
+	return tc.templateService.Render(c, "two_factor_setup", fiber.Map{
+		"Title":      "Set Up Two-Factor Authentication - Fresh",
+		"Enrollment": enrollment,
+	})
+}
+
+// ShowSetup shows the pending enrollment again, e.g. after a reload
+func (tc *TwoFactorController) ShowSetup(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	enrollment, err := tc.twoFactorService.PendingEnrollment(user)
+	if err != nil {
+		return c.Redirect("/account/2fa")
+	}
+
+	return tc.templateService.Render(c, "two_factor_setup", fiber.Map{
+		"Title":      "Set Up Two-Factor Authentication - Fresh",
+		"Enrollment": enrollment,
+	})
+}
+
+// ConfirmSetup enables 2FA with the first code from the user's app and
+// shows the recovery codes once
+func (tc *TwoFactorController) ConfirmSetup(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	codes, err := tc.twoFactorService.ConfirmEnrollment(c.UserContext(), user, c.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, services.ErrTwoFactorNotPending) {
+			return c.Redirect("/account/2fa")
+		}
+
+		enrollment, pendingErr := tc.twoFactorService.PendingEnrollment(user)
+		if pendingErr != nil {
+			return pendingErr
+		}
+		return tc.templateService.Render(c, "two_factor_setup", fiber.Map{
+			"Title":      "Set Up Two-Factor Authentication - Fresh",
+			"Enrollment": enrollment,
+			"Error":      err.Error(),
+		})
+	}
+
+	logging.FromCtx(c).Info("two-factor authentication enabled", "user_id", user.ID)
+
+	data, err := tc.settingsData(c, user)
+	if err != nil {
+		return err
+	}
+	data["Notice"] = "Two-factor authentication is on."
+	data["RecoveryCodes"] = codes
+
+	return tc.templateService.Render(c, "two_factor", data)
+}
+
+func (tc *TwoFactorController) Disable(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	if err := tc.authService.ConfirmPassword(c.UserContext(), user, c.FormValue("password")); err != nil {
+		return tc.renderSettingsError(c, user, err)
+	}
+	if err := tc.twoFactorService.Disable(c.UserContext(), user); err != nil {
+		return tc.renderSettingsError(c, user, err)
+	}
+
+	logging.FromCtx(c).Info("two-factor authentication disabled", "user_id", user.ID)
+
+	return c.Redirect("/account/2fa?disabled=1")
+}
+
+func (tc *TwoFactorController) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	user, err := tc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+
+	if err := tc.authService.ConfirmPassword(c.UserContext(), user, c.FormValue("password")); err != nil {
+		return tc.renderSettingsError(c, user, err)
+	}
+	codes, err := tc.twoFactorService.RegenerateRecoveryCodes(c.UserContext(), user)
+	if err != nil {
+		return tc.renderSettingsError(c, user, err)
+	}
+
+	data, err := tc.settingsData(c, user)
+	if err != nil {
+		return err
+	}
+	data["Notice"] = "New recovery codes generated. Your old codes no longer work."
+	data["RecoveryCodes"] = codes
+
+	return tc.templateService.Render(c, "two_factor", data)
+}
+
+func (tc *TwoFactorController) renderSettingsError(c *fiber.Ctx, user *models.User, cause error) error {
+	data, err := tc.settingsData(c, user)
+	if err != nil {
+		return err
+	}
+	data["Error"] = cause.Error()
+
+	var throttled *services.TooManyAttemptsError
+	switch {
+	case errors.As(cause, &throttled):
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		c.Status(fiber.StatusTooManyRequests)
+	case errors.Is(cause, services.ErrInvalidPassword):
+		c.Status(fiber.StatusUnprocessableEntity)
+	}
+	return tc.templateService.Render(c, "two_factor", data)
+}
+
+func (tc *TwoFactorController) settingsData(c *fiber.Ctx, user *models.User) (fiber.Map, error) {
+	data := fiber.Map{
+		"Title":   "Two-Factor Authentication - Fresh",
+		"User":    user,
+		"Enabled": user.TwoFactorEnabled(),
+	}
+
+	if user.TwoFactorEnabled() {
+		remaining, err := tc.twoFactorService.RemainingRecoveryCodes(c.UserContext(), user)
+		if err != nil {
+			return nil, err
+		}
+		data["RemainingRecoveryCodes"] = remaining
+	}
+
+	return data, nil
+}
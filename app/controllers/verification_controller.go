@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/services"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type VerificationController struct {
+	authService     *services.AuthService
+	templateService services.TemplateRenderer
+}
+
+func NewVerificationController(authService *services.AuthService, templateService services.TemplateRenderer) *VerificationController {
+	return &VerificationController{
+		authService:     authService,
+		templateService: templateService,
+	}
+}
+
+// ShowNotice asks a signed-in, unverified user to check their inbox
+func (vc *VerificationController) ShowNotice(c *fiber.Ctx) error {
+	user, err := vc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+	if user.EmailVerified() {
+		return c.Redirect("/dashboard")
+	}
+
+	return vc.templateService.Render(c, "verify_email", fiber.Map{
+		"Title": "Verify Your Email - Fresh",
+		"User":  user,
+	})
+}
+
+func (vc *VerificationController) HandleResend(c *fiber.Ctx) error {
+	user, err := vc.authService.GetCurrentUser(c)
+	if err != nil {
+		return c.Redirect("/login")
+	}
+	if user.EmailVerified() {
+		return c.Redirect("/dashboard")
+	}
+
+	data := fiber.Map{
+		"Title": "Verify Your Email - Fresh",
+		"User":  user,
+	}
+
+	if err := vc.authService.SendEmailVerification(c.UserContext(), user); err != nil {
+		logging.FromCtx(c).Warn("verification email failed", "user_id", user.ID, "error", err)
+
+		var throttled *services.TooManyAttemptsError
+		if errors.As(err, &throttled) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+			c.Status(fiber.StatusTooManyRequests)
+			data["Error"] = err.Error()
+		} else {
+			data["Error"] = "We couldn't send the verification email. Please try again later."
+		}
+
+		return vc.templateService.Render(c, "verify_email", data)
+	}
+
+	data["Notice"] = "We've sent a new verification link to " + user.Email + "."
+	return vc.templateService.Render(c, "verify_email", data)
+}
+
+// Verify handles the link from the verification email. It works without a
+// session, since the link may be opened in a different browser.
+func (vc *VerificationController) Verify(c *fiber.Ctx) error {
+	user, err := vc.authService.VerifyEmail(c.UserContext(), c.Params("token"))
+	if err != nil {
+		logging.FromCtx(c).Info("email verification failed", "error", err)
+		return vc.templateService.Render(c, "verify_email", fiber.Map{
+			"Title":   "Verify Your Email - Fresh",
+			"Error":   err.Error(),
+			"Invalid": true,
+		})
+	}
+
+	logging.FromCtx(c).Info("email verified", "user_id", user.ID)
+
+	if _, err := vc.authService.GetCurrentUser(c); err == nil {
+		return c.Redirect("/dashboard")
+	}
+	return c.Redirect("/login?verified=1")
+}
@@ -0,0 +1,197 @@
+// Package health runs the readiness checks behind /readyz. Subsystems
+// contribute a Checker to the Registry; every check runs on each probe,
+// concurrently and with a deadline.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fresh/db/migrate"
+
+	"gorm.io/gorm"
+)
+
+// Statuses of a check and of the whole report
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// DefaultTimeout bounds each check, so one hung dependency can't hold up the
+// probe past the orchestrator's own timeout
+const DefaultTimeout = 2 * time.Second
+
+// Checker reports whether one subsystem can serve traffic
+type Checker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type checkFunc struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func (c checkFunc) Name() string                    { return c.name }
+func (c checkFunc) Check(ctx context.Context) error { return c.fn(ctx) }
+
+// CheckFunc turns a function into a Checker
+func CheckFunc(name string, fn func(ctx context.Context) error) Checker {
+	return checkFunc{name: name, fn: fn}
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// Report is the outcome of every check; Status is ok only if all passed
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// OK reports whether every check passed
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// ErrShuttingDown fails readiness once shutdown has begun
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// Registry holds the readiness checks
+type Registry struct {
+	// Timeout bounds each check; zero means DefaultTimeout
+	Timeout time.Duration
+
+	mu           sync.RWMutex
+	checkers     []Checker
+	shuttingDown atomic.Bool
+}
+
+// NewRegistry returns a registry with the given checks
+func NewRegistry(checkers ...Checker) *Registry {
+	return &Registry{checkers: checkers}
+}
+
+// Register adds a check. Names should be unique; they identify the check in
+// the report.
+func (r *Registry) Register(checker Checker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkers = append(r.checkers, checker)
+}
+
+// MarkShuttingDown makes every later report fail, so load balancers stop
+// routing here while in-flight requests drain
+func (r *Registry) MarkShuttingDown() {
+	r.shuttingDown.Store(true)
+}
+
+// Run runs every check concurrently and reports them in registration order
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.RLock()
+	checkers := append([]Checker(nil), r.checkers...)
+	r.mu.RUnlock()
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	results := make([]Result, len(checkers))
+	var wg sync.WaitGroup
+	for i, checker := range checkers {
+		wg.Add(1)
+		go func(i int, checker Checker) {
+			defer wg.Done()
+			results[i] = run(ctx, checker, timeout)
+		}(i, checker)
+	}
+	wg.Wait()
+
+	if r.shuttingDown.Load() {
+		results = append([]Result{{Name: "shutdown", Status: StatusFail, Error: ErrShuttingDown.Error()}}, results...)
+	}
+
+	report := Report{Status: StatusOK, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFail
+		}
+	}
+	return report
+}
+
+func run(ctx context.Context, checker Checker, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := checkWithDeadline(ctx, checker)
+	result := Result{
+		Name:      checker.Name(),
+		Status:    StatusOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkWithDeadline returns when the check does or when ctx expires,
+// whichever is first, for checks that don't watch ctx themselves
+func checkWithDeadline(ctx context.Context, checker Checker) (err error) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("check panicked: %v", p)
+			}
+		}()
+		done <- checker.Check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	}
+}
+
+// Database pings the database through the connection pool
+func Database(db *gorm.DB) Checker {
+	return CheckFunc("database", func(ctx context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	})
+}
+
+// Migrations fails while migrations are pending, such as during a deploy
+// whose new code is up before the schema. It only reads the database.
+func Migrations(migrator *migrate.Migrator) Checker {
+	return CheckFunc("migrations", func(ctx context.Context) error {
+		pending, err := migrator.PendingReadOnly(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d pending, starting with %s", len(pending), pending[0])
+		}
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+// Package lifecycle runs the HTTP server until the process is asked to stop,
+// then drains in-flight requests and releases what the app holds open.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrDrainTimeout is returned by Serve when requests were still running
+// when the shutdown timeout ran out
+var ErrDrainTimeout = errors.New("in-flight requests did not finish before the shutdown timeout")
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Hooks are cleanup functions run once the server has stopped: closing the
+// database, stopping background jobs, flushing queued mail. They run in
+// reverse order of registration, so something registered after what it
+// depends on is stopped before it.
+type Hooks struct {
+	mu       sync.Mutex
+	hooks    []hook
+	notifies []func()
+}
+
+// Notify registers fn to be called as soon as shutdown begins, while
+// requests are still being served; readiness checks use it to start failing
+func (h *Hooks) Notify(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.notifies = append(h.notifies, fn)
+}
+
+func (h *Hooks) notify() {
+	h.mu.Lock()
+	notifies := h.notifies
+	h.mu.Unlock()
+
+	for _, fn := range notifies {
+		fn()
+	}
+}
+
+// Add registers fn under a name used in logs and errors
+func (h *Hooks) Add(name string, fn func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, hook{name: name, fn: fn})
+}
+
+// Run calls every hook, newest first, even when some fail, and returns the
+// failures joined. Hooks should give up when ctx is done. Each hook runs once;
+// a second Run does nothing.
+func (h *Hooks) Run(ctx context.Context) error {
+	h.mu.Lock()
+	hooks := h.hooks
+	h.hooks = nil
+	h.mu.Unlock()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown hook %s: %w", hooks[i].name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Config tunes how Serve shuts down
+type Config struct {
+	// ShutdownTimeout bounds draining in-flight requests, and then running
+	// the hooks
+	ShutdownTimeout time.Duration
+	// DrainDelay keeps accepting requests for a while after the signal, with
+	// readiness failing, so load balancers stop routing here before the
+	// listener closes
+	DrainDelay time.Duration
+}
+
+// Serve serves app on ln until ctx is done, typically on SIGTERM or SIGINT.
+// The Notify functions are then called and, after the drain delay, the
+// listener is closed, in-flight requests get up to the shutdown timeout to
+// finish and the hooks run with the same allowance. If the server fails to
+// start or stops by itself, the hooks still run and the error is returned.
+func Serve(ctx context.Context, app *fiber.App, ln net.Listener, cfg Config, hooks *Hooks) error {
+	timeout := cfg.ShutdownTimeout
+	served := make(chan error, 1)
+	go func() {
+		served <- app.Listener(ln)
+	}()
+
+	var errs []error
+	select {
+	case err := <-served:
+		if err == nil {
+			err = errors.New("server stopped unexpectedly")
+		}
+		errs = append(errs, err)
+
+	case <-ctx.Done():
+		hooks.notify()
+		if cfg.DrainDelay > 0 {
+			slog.Info("shutting down after drain delay, readiness is failing", "drain_delay", cfg.DrainDelay)
+			time.Sleep(cfg.DrainDelay)
+		}
+
+		slog.Info("shutting down, waiting for in-flight requests", "timeout", timeout)
+		if err := app.ShutdownWithTimeout(timeout); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = ErrDrainTimeout
+			}
+			errs = append(errs, err)
+		}
+		// A listener closed before the server picked it up is not a failure
+		if err := <-served; err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	hookCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := hooks.Run(hookCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		slog.Info("shutdown complete")
+	}
+	return errors.Join(errs...)
+}
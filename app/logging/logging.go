@@ -0,0 +1,84 @@
+// Package logging builds the app's slog logger and hands each request its
+// own, tagged with the request ID.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"fresh/config"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Locals keys set by middleware.RequestID
+const (
+	LoggerKey    = "logger"
+	RequestIDKey = "request_id"
+)
+
+// New returns a logger writing to w. Attributes named "email" are redacted
+// wherever they are logged.
+func New(cfg config.LogConfig, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch cfg.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", cfg.Format)
+	}
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == "email" && attr.Value.Kind() == slog.KindString {
+		attr.Value = slog.StringValue(RedactEmail(attr.Value.String()))
+	}
+	return attr
+}
+
+// RedactEmail keeps enough of an address to tell accounts apart in the logs
+// without recording it: jane@example.com becomes j***@example.com
+func RedactEmail(email string) string {
+	local, domain, found := strings.Cut(email, "@")
+	if !found || local == "" {
+		return "***"
+	}
+	return local[:1] + "***@" + domain
+}
+
+// FromCtx returns the request's logger, or the default logger outside a
+// request or before middleware.RequestID has run
+func FromCtx(c *fiber.Ctx) *slog.Logger {
+	if logger, ok := c.Locals(LoggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying logger, for code that is handed
+// c.UserContext() rather than the fiber.Ctx
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger NewContext stored in ctx, or the default
+// logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
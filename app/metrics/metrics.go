@@ -0,0 +1,152 @@
+// Package metrics exposes the app's Prometheus metrics: HTTP traffic by
+// route, the database connection pool, and authentication events.
+package metrics
+
+import (
+	"crypto/subtle"
+	"fresh/app/apperror"
+	"fresh/app/routeinfo"
+	"fresh/app/services"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// UnmatchedRoute labels requests no route matched, so probing for random
+// URLs can't create a series per path
+const UnmatchedRoute = "unmatched"
+
+// Metrics holds the collectors, registered on their own registry rather than
+// the global one
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	inFlight      prometheus.Gauge
+	logins        *prometheus.CounterVec
+	registrations prometheus.Counter
+}
+
+// New registers the HTTP and authentication metrics along with the Go
+// runtime and process collectors
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by method, route template and status code.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by method, route template and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "HTTP requests being served.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_login_attempts_total",
+			Help: "Password login attempts by result.",
+		}, []string{"result"}),
+		registrations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "auth_registrations_total",
+			Help: "Accounts registered.",
+		}),
+	}
+
+	// Start every result at zero, so rate() works from the first failure
+	for _, result := range []string{
+		services.LoginSuccess,
+		services.LoginInvalidCredentials,
+		services.LoginThrottled,
+		services.LoginLocked,
+		services.LoginError,
+	} {
+		m.logins.WithLabelValues(result)
+	}
+
+	m.Registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.logins, m.registrations,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// RegisterDB exports the connection pool statistics of db as the go_sql_*
+// metrics, labelled with the database name
+func (m *Metrics) RegisterDB(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return m.Registry.Register(collectors.NewDBStatsCollector(sqlDB, db.Migrator().CurrentDatabase()))
+}
+
+// LoginAttempt implements services.AuthMetrics
+func (m *Metrics) LoginAttempt(result string) {
+	m.logins.WithLabelValues(result).Inc()
+}
+
+// Registration implements services.AuthMetrics
+func (m *Metrics) Registration() {
+	m.registrations.Inc()
+}
+
+// Middleware counts and times requests by the template of the route that
+// handled them, such as /admin/users/:id. Errors are rendered here by the
+// app's error handler, like middleware.AccessLog does, so the status
+// recorded is the one sent.
+func (m *Metrics) Middleware() fiber.Handler {
+	routes := &routeinfo.Matcher{}
+
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		method := c.Method()
+		route, ok := routes.Template(c)
+		if !ok {
+			route = UnmatchedRoute
+		}
+
+		status := strconv.Itoa(c.Response().StatusCode())
+		m.requests.WithLabelValues(method, route, status).Inc()
+		m.duration.WithLabelValues(method, route, status).Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. A non-empty
+// token must be sent as "Authorization: Bearer <token>".
+func (m *Metrics) Handler(token string) fiber.Handler {
+	serve := adaptor.HTTPHandler(promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+
+	return func(c *fiber.Ctx) error {
+		if token != "" {
+			scheme, credentials, _ := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+			if !strings.EqualFold(scheme, "Bearer") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimSpace(credentials)), []byte(token)) != 1 {
+				c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="metrics"`)
+				return apperror.Unauthorized("a valid metrics token is required")
+			}
+		}
+		return serve(c)
+	}
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"fresh/app/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AccessConfig configures the role and permission middleware
+type AccessConfig struct {
+	AuthService *services.AuthService
+	// Renderer renders the 403 page for users without access
+	Renderer services.TemplateRenderer
+}
+
+// RequireRole lets a request through if the signed-in user has any of the
+// given roles. Anonymous users are sent to the login page.
+func RequireRole(config AccessConfig, roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := config.AuthService.GetCurrentUser(c)
+		if err != nil {
+			return c.Redirect("/login")
+		}
+
+		for _, role := range roles {
+			if config.AuthService.HasRole(c.UserContext(), user, role) {
+				return c.Next()
+			}
+		}
+
+		return forbidden(c, config.Renderer)
+	}
+}
+
+// RequirePermission lets a request through if the signed-in user has every
+// one of the given permissions. Anonymous users are sent to the login page.
+func RequirePermission(config AccessConfig, permissions ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := config.AuthService.GetCurrentUser(c)
+		if err != nil {
+			return c.Redirect("/login")
+		}
+
+		for _, permission := range permissions {
+			if !config.AuthService.Can(c.UserContext(), user, permission) {
+				return forbidden(c, config.Renderer)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+func forbidden(c *fiber.Ctx, renderer services.TemplateRenderer) error {
+	c.Status(fiber.StatusForbidden)
+	return renderer.Render(c, "errors/403", fiber.Map{
+		"Title": "Forbidden - Fresh",
+		"Error": "You don't have permission to view this page.",
+	})
+}
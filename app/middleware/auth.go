@@ -16,6 +16,21 @@ func RequireAuth(authService *services.AuthService) fiber.Handler {
 	}
 }
 
+// RequireVerifiedEmail sends signed-in users who haven't verified their email
+// address to the verification notice. Use it after RequireAuth.
+func RequireVerifiedEmail(authService *services.AuthService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := authService.GetCurrentUser(c)
+		if err != nil {
+			return c.Redirect("/login")
+		}
+		if !user.EmailVerified() {
+			return c.Redirect("/verify-email")
+		}
+		return c.Next()
+	}
+}
+
 func RedirectIfAuthenticated(authService *services.AuthService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		_, err := authService.GetCurrentUser(c)
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// API token scopes
+const (
+	// ScopeRead allows GET requests
+	ScopeRead = "read"
+	// ScopeWrite allows requests that change data
+	ScopeWrite = "write"
+)
+
+// APIScopes lists every scope a token can be given
+func APIScopes() []string {
+	return []string{ScopeRead, ScopeWrite}
+}
+
+// APIToken is a personal access token for the JSON API. Only a SHA-256 hash
+// of the token is stored; the user sees the token once, when it is created.
+type APIToken struct {
+	ID        uint   `gorm:"primarykey" json:"id"`
+	UserID    uint   `gorm:"index;not null" json:"-"`
+	Name      string `gorm:"size:100;not null" json:"name"`
+	TokenHash string `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	// Prefix is the start of the token, so users can tell their tokens apart
+	Prefix string `gorm:"size:16;not null" json:"prefix"`
+	// Scopes is a space-separated list, as in OAuth
+	Scopes     string     `gorm:"size:255;not null" json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// ExpiresAt is nil for tokens that don't expire
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ScopeList returns the token's scopes
+func (t *APIToken) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token is past its expiry time
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+type APITokenRepository struct {
+	db *gorm.DB
+}
+
+func NewAPITokenRepository(db *gorm.DB) *APITokenRepository {
+	return &APITokenRepository{db: db}
+}
+
+// WithContext is UserRepository.WithContext for API tokens
+func (r *APITokenRepository) WithContext(ctx context.Context) *APITokenRepository {
+	return &APITokenRepository{db: r.db.WithContext(ctx)}
+}
+
+func (r *APITokenRepository) Create(token *APIToken) error {
+	return r.db.Create(token).Error
+}
+
+// FindByHash returns the token with the given hash, expired or not
+func (r *APITokenRepository) FindByHash(tokenHash string) (*APIToken, error) {
+	var token APIToken
+	if err := r.db.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("api token not found")
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ListByUser returns the user's tokens, newest first
+func (r *APITokenRepository) ListByUser(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := r.db.Where("user_id = ?", userID).Order("created_at DESC, id DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+// Delete revokes one of the user's tokens. Other users' tokens are left
+// alone, so a guessed ID can't revoke someone else's token.
+func (r *APITokenRepository) Delete(userID, id uint) error {
+	result := r.db.Where("id = ? AND user_id = ?", id, userID).Delete(&APIToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("api token not found")
+	}
+	return nil
+}
+
+// Touch records that the token was just used
+func (r *APITokenRepository) Touch(token *APIToken) error {
+	now := time.Now()
+	token.LastUsedAt = &now
+	return r.db.Model(token).Update("last_used_at", now).Error
+}
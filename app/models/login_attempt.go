@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// LoginAttempt records one failed login against a throttling bucket such as
+// "ip:203.0.113.7" or "email:someone@example.com". Bucket holds the SHA-256
+// of the key, which keeps long keys in size and addresses out of the table.
+type LoginAttempt struct {
+	ID        uint      `gorm:"primarykey"`
+	Bucket    string    `gorm:"size:320;index;not null"`
+	CreatedAt time.Time `gorm:"index;not null"`
+}
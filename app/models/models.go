@@ -0,0 +1,18 @@
+package models
+
+// All returns every model that has a database table, in dependency order.
+// Tables are created by migrations (db/migrations); the list is used to
+// check that the migrated schema matches the models.
+func All() []interface{} {
+	return []interface{}{
+		&Permission{},
+		&Role{},
+		&User{},
+		&Session{},
+		&LoginAttempt{},
+		&PasswordResetToken{},
+		&RecoveryCode{},
+		&UserIdentity{},
+		&APIToken{},
+	}
+}
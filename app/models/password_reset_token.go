@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PasswordResetToken is a single-use, expiring password reset grant. Only a
+// SHA-256 hash of the token is stored; the token itself exists only in the
+// email sent to the user.
+type PasswordResetToken struct {
+	ID        uint      `gorm:"primarykey"`
+	UserID    uint      `gorm:"index;not null"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// ErrResetTokenNotUsable means a reset token is unknown, expired or was
+// already used
+var ErrResetTokenNotUsable = errors.New("reset token not found")
+
+type PasswordResetTokenRepository struct {
+	db *gorm.DB
+}
+
+func NewPasswordResetTokenRepository(db *gorm.DB) *PasswordResetTokenRepository {
+	return &PasswordResetTokenRepository{db: db}
+}
+
+// WithContext is UserRepository.WithContext for reset tokens
+func (r *PasswordResetTokenRepository) WithContext(ctx context.Context) *PasswordResetTokenRepository {
+	return &PasswordResetTokenRepository{db: r.db.WithContext(ctx)}
+}
+
+func (r *PasswordResetTokenRepository) Create(userID uint, tokenHash string, expiresAt time.Time) (*PasswordResetToken, error) {
+	token := &PasswordResetToken{
+		UserID:    userID,
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+	}
+
+	if err := r.db.Create(token).Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// FindUsable returns the unused, unexpired token with the given hash
+func (r *PasswordResetTokenRepository) FindUsable(tokenHash string) (*PasswordResetToken, error) {
+	var token PasswordResetToken
+	err := r.db.
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+		First(&token).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrResetTokenNotUsable
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Consume uses up the token with the given hash and runs fn with its user's
+// ID in the same transaction. Burning the token is a conditional update, so
+// when the same link is submitted twice at once only one request gets past
+// it; the other gets ErrResetTokenNotUsable. The user's other outstanding
+// tokens are burned too. If fn fails, the token stays usable.
+func (r *PasswordResetTokenRepository) Consume(tokenHash string, fn func(tx *gorm.DB, userID uint) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var token PasswordResetToken
+		if err := tx.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrResetTokenNotUsable
+			}
+			return err
+		}
+
+		now := time.Now()
+		result := tx.Model(&PasswordResetToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrResetTokenNotUsable
+		}
+
+		if err := tx.Model(&PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", token.UserID).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		return fn(tx, token.UserID)
+	})
+}
+
+// DeleteExpired removes tokens past their expiry; they can never be used
+func (r *PasswordResetTokenRepository) DeleteExpired() error {
+	return r.db.Where("expires_at <= ?", time.Now()).Delete(&PasswordResetToken{}).Error
+}
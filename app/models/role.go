@@ -0,0 +1,177 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Built-in roles
+const (
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	// DefaultRole is given to every new user
+	DefaultRole = RoleMember
+)
+
+// Built-in permissions
+const (
+	PermissionAccessAdmin   = "admin.access"
+	PermissionManageUsers   = "users.manage"
+	PermissionManageRoles   = "roles.manage"
+	PermissionManageAccount = "account.manage"
+)
+
+// Role is a named set of permissions granted to users
+type Role struct {
+	ID          uint         `gorm:"primarykey" json:"id"`
+	Name        string       `gorm:"size:64;uniqueIndex;not null" json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `gorm:"many2many:role_permissions" json:"permissions,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// Permission is a single capability checked by AuthService.Can
+type Permission struct {
+	ID          uint   `gorm:"primarykey" json:"id"`
+	Name        string `gorm:"size:128;uniqueIndex;not null" json:"name"`
+	Description string `json:"description"`
+}
+
+// RoleDefinition describes a role for seeding
+type RoleDefinition struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// DefaultRoles returns the roles every installation starts with
+func DefaultRoles() []RoleDefinition {
+	return []RoleDefinition{
+		{
+			Name:        RoleAdmin,
+			Description: "Full access, including the admin area",
+			Permissions: []string{
+				PermissionAccessAdmin,
+				PermissionManageUsers,
+				PermissionManageRoles,
+				PermissionManageAccount,
+			},
+		},
+		{
+			Name:        RoleMember,
+			Description: "A regular signed-up user",
+			Permissions: []string{PermissionManageAccount},
+		},
+	}
+}
+
+type RoleRepository struct {
+	db *gorm.DB
+}
+
+func NewRoleRepository(db *gorm.DB) *RoleRepository {
+	return &RoleRepository{db: db}
+}
+
+// WithContext is UserRepository.WithContext for roles
+func (r *RoleRepository) WithContext(ctx context.Context) *RoleRepository {
+	return &RoleRepository{db: r.db.WithContext(ctx)}
+}
+
+// Seed creates any missing roles and permissions from the definitions and
+// grants each role at least its listed permissions. It is safe to run on
+// every start; permissions granted by hand are left alone.
+func (r *RoleRepository) Seed(definitions []RoleDefinition) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		for _, definition := range definitions {
+			role := Role{Name: definition.Name}
+			if err := tx.Where(Role{Name: definition.Name}).
+				Attrs(Role{Description: definition.Description}).
+				FirstOrCreate(&role).Error; err != nil {
+				return err
+			}
+
+			permissions := make([]Permission, len(definition.Permissions))
+			for i, name := range definition.Permissions {
+				if err := tx.Where(Permission{Name: name}).FirstOrCreate(&permissions[i]).Error; err != nil {
+					return err
+				}
+			}
+
+			if len(permissions) > 0 {
+				if err := tx.Model(&role).Association("Permissions").Append(permissions); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (r *RoleRepository) FindByName(name string) (*Role, error) {
+	var role Role
+	if err := r.db.Preload("Permissions").Where("name = ?", name).First(&role).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("role not found")
+		}
+		return nil, err
+	}
+	return &role, nil
+}
+
+// All returns every role with its permissions, ordered by name
+func (r *RoleRepository) All() ([]Role, error) {
+	var roles []Role
+	err := r.db.Preload("Permissions").Order("name").Find(&roles).Error
+	return roles, err
+}
+
+// AssignRole grants the named role to the user
+func (r *RoleRepository) AssignRole(user *User, name string) error {
+	role, err := r.FindByName(name)
+	if err != nil {
+		return err
+	}
+
+	if err := r.db.Model(user).Association("Roles").Append(role); err != nil {
+		return err
+	}
+	return r.loadRoles(user)
+}
+
+// RemoveRole takes the named role away from the user
+func (r *RoleRepository) RemoveRole(user *User, name string) error {
+	role, err := r.FindByName(name)
+	if err != nil {
+		return err
+	}
+
+	if err := r.db.Model(user).Association("Roles").Delete(role); err != nil {
+		return err
+	}
+	return r.loadRoles(user)
+}
+
+// SetRoles replaces the user's roles with exactly the named ones
+func (r *RoleRepository) SetRoles(user *User, names []string) error {
+	roles := make([]Role, 0, len(names))
+	for _, name := range names {
+		role, err := r.FindByName(name)
+		if err != nil {
+			return err
+		}
+		roles = append(roles, *role)
+	}
+
+	if err := r.db.Model(user).Association("Roles").Replace(roles); err != nil {
+		return err
+	}
+	return r.loadRoles(user)
+}
+
+func (r *RoleRepository) loadRoles(user *User) error {
+	return r.db.Preload("Roles.Permissions").First(user, user.ID).Error
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Session is a server-side login session. The ID is an opaque random value
+// that is handed to the browser in the session cookie; nothing else about the
+// user ever leaves the server.
+type Session struct {
+	ID         string    `gorm:"primarykey;size:64" json:"-"`
+	UserID     uint      `gorm:"index;not null" json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `gorm:"index;not null" json:"expires_at"`
+}
+
+// Expired reports whether the session is past its expiry time
+func (s *Session) Expired() bool {
+	return !time.Now().Before(s.ExpiresAt)
+}
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
@@ -11,8 +14,79 @@ type User struct {
 	ID       uint   `gorm:"primarykey" json:"id"`
 	Email    string `gorm:"unique;not null" json:"email"`
 	Password string `gorm:"not null" json:"-"` // "-" excludes from JSON
+
+	// Consecutive failed logins; reset on success or when a lockout starts
+	FailedLoginAttempts int        `gorm:"not null;default:0" json:"-"`
+	LockedUntil         *time.Time `json:"-"`
+
+	// Set while an administrator has locked the account. Unlike LockedUntil
+	// it doesn't expire.
+	LockedAt *time.Time `json:"locked_at"`
+
+	// Sessions started before this are no longer valid
+	PasswordChangedAt *time.Time `json:"-"`
+
+	// Set once the user follows the link in the verification email
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// TOTP secret, encrypted with the application key. It is stored as soon
+	// as enrollment starts; 2FA is only enforced once TOTPEnabledAt is set.
+	TOTPSecret    string     `gorm:"size:255" json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	// Last accepted TOTP time step, so a code can't be replayed
+	TOTPLastStep int64 `gorm:"not null;default:0" json:"-"`
+
+	Roles []Role `gorm:"many2many:user_roles" json:"roles,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
 }
 
+// DefaultUsersPerPage is the page size List uses when none is given
+const DefaultUsersPerPage = 25
+
+// UserListOptions filters and pages UserRepository.List
+type UserListOptions struct {
+	// Query matches anywhere in the email address, ignoring case
+	Query   string
+	Page    int
+	PerPage int
+}
+
+// UserPage is one page of users with enough context to link to the others
+type UserPage struct {
+	Users   []User
+	Total   int64
+	Page    int
+	PerPage int
+}
+
+// TotalPages is the number of pages, at least one
+func (p *UserPage) TotalPages() int {
+	if p.Total == 0 {
+		return 1
+	}
+	return int((p.Total + int64(p.PerPage) - 1) / int64(p.PerPage))
+}
+
+// PrevPage is the previous page number, or 0 on the first page
+func (p *UserPage) PrevPage() int {
+	if p.Page <= 1 {
+		return 0
+	}
+	return p.Page - 1
+}
+
+// NextPage is the next page number, or 0 on the last page
+func (p *UserPage) NextPage() int {
+	if p.Page >= p.TotalPages() {
+		return 0
+	}
+	return p.Page + 1
+}
+
+// ErrUserNotFound means no user has the email or ID looked up
+var ErrUserNotFound = errors.New("user not found")
+
 type UserRepository struct {
 	db *gorm.DB
 }
@@ -21,6 +95,20 @@ func NewUserRepository(db *gorm.DB) *UserRepository {
 	return &UserRepository{db: db}
 }
 
+// WithContext returns a repository whose queries run with ctx, so they are
+// cancelled with the request and traced as part of it
+func (r *UserRepository) WithContext(ctx context.Context) *UserRepository {
+	return &UserRepository{db: r.db.WithContext(ctx)}
+}
+
+// Transaction runs fn with a repository whose changes are committed together,
+// or not at all if fn returns an error
+func (r *UserRepository) Transaction(fn func(users *UserRepository) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&UserRepository{db: tx})
+	})
+}
+
 func (r *UserRepository) Create(email, password string) (*User, error) {
 	// Validate input
 	if email == "" {
@@ -31,28 +119,39 @@ func (r *UserRepository) Create(email, password string) (*User, error) {
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
 
 	user := &User{
 		Email:    email,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
 	}
 
 	if err := r.db.Create(user).Error; err != nil {
 		return nil, err
 	}
 
+	// New users get the default role once roles have been seeded
+	var role Role
+	err = r.db.Preload("Permissions").Where("name = ?", DefaultRole).First(&role).Error
+	if err == nil {
+		if err := r.db.Model(user).Association("Roles").Append(&role); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
 	return user, nil
 }
 
 func (r *UserRepository) FindByEmail(email string) (*User, error) {
 	var user User
-	if err := r.db.Where("email = ?", email).First(&user).Error; err != nil {
+	if err := r.db.Preload("Roles.Permissions").Where("email = ?", email).First(&user).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -61,15 +160,225 @@ func (r *UserRepository) FindByEmail(email string) (*User, error) {
 
 func (r *UserRepository) FindByID(id uint) (*User, error) {
 	var user User
-	if err := r.db.First(&user, id).Error; err != nil {
+	if err := r.db.Preload("Roles.Permissions").First(&user, id).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
 	return &user, nil
 }
 
+// UpdatePassword hashes and stores a new password, clears any lockout and
+// records the change so older sessions can be rejected
+func (r *UserRepository) UpdatePassword(user *User, password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.Password = hashedPassword
+	user.PasswordChangedAt = &now
+	user.FailedLoginAttempts = 0
+	user.LockedUntil = nil
+
+	return r.db.Model(user).
+		Select("Password", "PasswordChangedAt", "FailedLoginAttempts", "LockedUntil").
+		Updates(user).Error
+}
+
+// UpdateLoginState persists the failed-login counter and lockout
+func (r *UserRepository) UpdateLoginState(user *User) error {
+	return r.db.Model(user).
+		Select("FailedLoginAttempts", "LockedUntil").
+		Updates(user).Error
+}
+
+// UpdateEmail changes the user's address. The new address is unverified.
+func (r *UserRepository) UpdateEmail(user *User, email string) error {
+	user.Email = email
+	user.EmailVerifiedAt = nil
+
+	return r.db.Model(user).
+		Select("Email", "EmailVerifiedAt").
+		Updates(user).Error
+}
+
+// MarkEmailVerified records that the user proved they own their address
+func (r *UserRepository) MarkEmailVerified(user *User) error {
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+
+	return r.db.Model(user).
+		Select("EmailVerifiedAt").
+		Updates(user).Error
+}
+
+// List returns a page of users ordered by ID, with their roles
+func (r *UserRepository) List(opts UserListOptions) (*UserPage, error) {
+	if opts.PerPage <= 0 {
+		opts.PerPage = DefaultUsersPerPage
+	}
+	if opts.Page <= 0 {
+		opts.Page = 1
+	}
+
+	filter := func(db *gorm.DB) *gorm.DB {
+		if q := strings.TrimSpace(opts.Query); q != "" {
+			return db.Where("LOWER(email) LIKE ? ESCAPE '\\'", "%"+escapeLike(strings.ToLower(q))+"%")
+		}
+		return db
+	}
+
+	page := &UserPage{Page: opts.Page, PerPage: opts.PerPage}
+	if err := r.db.Model(&User{}).Scopes(filter).Count(&page.Total).Error; err != nil {
+		return nil, err
+	}
+
+	err := r.db.Scopes(filter).Preload("Roles").
+		Order("id").
+		Limit(opts.PerPage).
+		Offset((opts.Page - 1) * opts.PerPage).
+		Find(&page.Users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// SetLocked locks or unlocks the account on an administrator's behalf.
+// Unlocking also clears any lockout from failed logins.
+func (r *UserRepository) SetLocked(user *User, locked bool) error {
+	if locked {
+		now := time.Now()
+		user.LockedAt = &now
+	} else {
+		user.LockedAt = nil
+		user.LockedUntil = nil
+		user.FailedLoginAttempts = 0
+	}
+
+	return r.db.Model(user).
+		Select("LockedAt", "LockedUntil", "FailedLoginAttempts").
+		Updates(user).Error
+}
+
+// Delete removes the user along with their roles, sessions, tokens,
+// recovery codes, linked identities and API tokens
+func (r *UserRepository) Delete(user *User) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Association("Roles").Clear(); err != nil {
+			return err
+		}
+
+		for _, dependent := range []interface{}{&Session{}, &PasswordResetToken{}, &RecoveryCode{}, &UserIdentity{}, &APIToken{}} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(dependent).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(user).Error
+	})
+}
+
+// LoadRoles (re)loads the user's roles and their permissions
+func (r *UserRepository) LoadRoles(user *User) error {
+	user.Roles = nil
+	return r.db.Model(user).Preload("Permissions").Association("Roles").Find(&user.Roles)
+}
+
+// UpdateTOTP persists the user's TOTP secret, enablement and last used step
+func (r *UserRepository) UpdateTOTP(user *User) error {
+	return r.db.Model(user).
+		Select("TOTPSecret", "TOTPEnabledAt", "TOTPLastStep").
+		Updates(user).Error
+}
+
+// AdvanceTOTPStep records step as the user's last used TOTP step if it is
+// later than the stored one. It reports false when another request already
+// used this step or a later one, so a code can't be replayed concurrently.
+func (r *UserRepository) AdvanceTOTPStep(user *User, step int64) (bool, error) {
+	result := r.db.Model(&User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	return true, nil
+}
+
+// HasRole reports whether the user has the named role. Roles must have been
+// loaded, as UserRepository's finders do.
+func (u *User) HasRole(name string) bool {
+	for _, role := range u.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether any of the user's roles grants permission
+func (u *User) HasPermission(permission string) bool {
+	for _, role := range u.Roles {
+		for _, p := range role.Permissions {
+			if p.Name == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TwoFactorEnabled reports whether logins need a second factor
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// EmailVerified reports whether the user has verified their email address
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// Locked reports whether an administrator has locked the account
+func (u *User) Locked() bool {
+	return u.LockedAt != nil
+}
+
+// LockedFor returns how much longer the account is locked out, or zero
+func (u *User) LockedFor() time.Duration {
+	if u.LockedUntil == nil {
+		return 0
+	}
+	if remaining := time.Until(*u.LockedUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func hashPassword(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashedPassword), nil
+}
+
 func (u *User) CheckPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 	return err == nil
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UserIdentity links an account at an external OpenID Connect provider to a
+// local user. The (provider, subject) pair is what identifies the person;
+// the email is only a copy of what the provider last reported.
+type UserIdentity struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	UserID      uint      `gorm:"index;not null" json:"user_id"`
+	Provider    string    `gorm:"size:64;not null;uniqueIndex:idx_identity_provider_subject" json:"provider"`
+	Subject     string    `gorm:"size:255;not null;uniqueIndex:idx_identity_provider_subject" json:"-"`
+	Email       string    `gorm:"size:320" json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+// ErrIdentityNotFound means no identity is linked for the provider and subject
+var ErrIdentityNotFound = errors.New("identity not found")
+
+type UserIdentityRepository struct {
+	db *gorm.DB
+}
+
+func NewUserIdentityRepository(db *gorm.DB) *UserIdentityRepository {
+	return &UserIdentityRepository{db: db}
+}
+
+// WithContext is UserRepository.WithContext for linked identities
+func (r *UserIdentityRepository) WithContext(ctx context.Context) *UserIdentityRepository {
+	return &UserIdentityRepository{db: r.db.WithContext(ctx)}
+}
+
+func (r *UserIdentityRepository) Create(userID uint, provider, subject, email string) (*UserIdentity, error) {
+	identity := &UserIdentity{
+		UserID:      userID,
+		Provider:    provider,
+		Subject:     subject,
+		Email:       email,
+		LastLoginAt: time.Now(),
+	}
+
+	if err := r.db.Create(identity).Error; err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+func (r *UserIdentityRepository) Find(provider, subject string) (*UserIdentity, error) {
+	var identity UserIdentity
+	err := r.db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrIdentityNotFound
+		}
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// ListByUser returns the identities linked to the user
+func (r *UserIdentityRepository) ListByUser(userID uint) ([]UserIdentity, error) {
+	var identities []UserIdentity
+	err := r.db.Where("user_id = ?", userID).Order("provider").Find(&identities).Error
+	return identities, err
+}
+
+// RecordLogin refreshes the reported email and last login time
+func (r *UserIdentityRepository) RecordLogin(identity *UserIdentity, email string) error {
+	identity.Email = email
+	identity.LastLoginAt = time.Now()
+
+	return r.db.Model(identity).
+		Select("Email", "LastLoginAt").
+		Updates(identity).Error
+}
@@ -0,0 +1,113 @@
+// Package routeinfo tells which route template handled a request, for
+// labelling metrics and naming spans without a series or name per URL, and
+// gives a path that is safe to log.
+package routeinfo
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// secretParams are route parameters holding credentials, such as the
+// tokens in reset and verification links
+var secretParams = []string{"token"}
+
+// Matcher recognizes the app's routes proper, leaving out middleware. Use
+// one per middleware instance; it learns the routes on the first request.
+type Matcher struct {
+	once sync.Once
+	// The routes' handler chains. Chains are compared rather than paths,
+	// because a middleware mounted on / would pass for the GET / route.
+	routes map[*fiber.Handler]bool
+	// secretRoutes are the templates with a secret parameter, split into
+	// segments
+	secretRoutes [][]string
+}
+
+func (m *Matcher) learn(app *fiber.App) {
+	// Registration is over by the first request
+	m.once.Do(func() {
+		m.routes = make(map[*fiber.Handler]bool)
+		seen := make(map[string]bool)
+		for _, route := range app.GetRoutes(true) {
+			if len(route.Handlers) > 0 {
+				m.routes[&route.Handlers[0]] = true
+			}
+			if hasSecretParam(route.Params) && !seen[route.Path] {
+				seen[route.Path] = true
+				m.secretRoutes = append(m.secretRoutes, strings.Split(route.Path, "/"))
+			}
+		}
+	})
+}
+
+// Template returns the path template of the route that handled the request,
+// such as /admin/users/:id. It reports false when no route matched, as
+// c.Route() is then the last middleware passed. Call it after c.Next().
+func (m *Matcher) Template(c *fiber.Ctx) (string, bool) {
+	m.learn(c.App())
+
+	matched := c.Route()
+	if len(matched.Handlers) == 0 || !m.routes[&matched.Handlers[0]] {
+		return "", false
+	}
+	return matched.Path, true
+}
+
+// Path returns the request path with the values of secret route parameters
+// replaced by their names, /password/reset/:token rather than the token,
+// for logs and traces. Paths are matched against the route templates
+// themselves, so requests a middleware turned away before routing are
+// masked too. The result is a copy that outlives the request.
+func (m *Matcher) Path(c *fiber.Ctx) string {
+	m.learn(c.App())
+
+	path := utils.CopyString(c.Path())
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for _, template := range m.secretRoutes {
+		if !matchSegments(template, segments) {
+			continue
+		}
+		for i, segment := range template {
+			if strings.HasPrefix(segment, ":") && hasSecretParam([]string{segment[1:]}) {
+				segments[i] = segment
+			}
+		}
+		return strings.Join(segments, "/")
+	}
+	return path
+}
+
+// matchSegments reports whether a path fits a template made of literal
+// segments and plain :params
+func matchSegments(template, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, segment := range template {
+		if strings.HasPrefix(segment, ":") {
+			if segments[i] == "" || strings.ContainsAny(segment, "?*+") {
+				return false
+			}
+			continue
+		}
+		if !strings.EqualFold(segment, segments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasSecretParam(params []string) bool {
+	for _, name := range params {
+		for _, secret := range secretParams {
+			if name == secret {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"strings"
+	"time"
+)
+
+// APITokenKey is the c.Locals key RequireAPIToken stores the request's token under
+const APITokenKey = "api_token"
+
+// apiTokenPrefix marks Fresh tokens so secret scanners can recognise them
+const apiTokenPrefix = "fresh_"
+
+// apiTokenTouchInterval limits how often a token's last-used time is written
+const apiTokenTouchInterval = time.Minute
+
+var (
+	ErrInvalidAPIToken  = errors.New("invalid or expired API token")
+	ErrAPITokenName     = errors.New("give the token a name")
+	ErrAPITokenScopes   = errors.New("choose at least one valid scope")
+	ErrAPITokenLifetime = errors.New("choose one of the offered expiry times")
+)
+
+// APITokenService issues and checks personal access tokens
+type APITokenService struct {
+	tokens   *models.APITokenRepository
+	userRepo *models.UserRepository
+}
+
+func NewAPITokenService(tokens *models.APITokenRepository, userRepo *models.UserRepository) *APITokenService {
+	return &APITokenService{tokens: tokens, userRepo: userRepo}
+}
+
+// Create issues a token for the user. The plaintext token is returned only
+// here; afterwards just its hash is known. A zero ttl never expires.
+func (s *APITokenService) Create(ctx context.Context, user *models.User, name string, scopes []string, ttl time.Duration) (string, *models.APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 100 {
+		return "", nil, ErrAPITokenName
+	}
+	if len(scopes) == 0 {
+		return "", nil, ErrAPITokenScopes
+	}
+	for _, scope := range scopes {
+		if !containsString(models.APIScopes(), scope) {
+			return "", nil, ErrAPITokenScopes
+		}
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext := apiTokenPrefix + secret
+
+	token := &models.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		TokenHash: hashToken(plaintext),
+		Prefix:    plaintext[:len(apiTokenPrefix)+4],
+		Scopes:    strings.Join(scopes, " "),
+	}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := s.tokens.WithContext(ctx).Create(token); err != nil {
+		return "", nil, err
+	}
+
+	return plaintext, token, nil
+}
+
+// List returns the user's tokens, newest first
+func (s *APITokenService) List(ctx context.Context, user *models.User) ([]models.APIToken, error) {
+	return s.tokens.WithContext(ctx).ListByUser(user.ID)
+}
+
+// Revoke deletes one of the user's tokens
+func (s *APITokenService) Revoke(ctx context.Context, user *models.User, id uint) error {
+	return s.tokens.WithContext(ctx).Delete(user.ID, id)
+}
+
+// Authenticate resolves a bearer token to its token record and owner.
+// Unknown, expired and locked-out tokens, and tokens created before the
+// owner's last password change, all fail with ErrInvalidAPIToken.
+func (s *APITokenService) Authenticate(ctx context.Context, plaintext string) (*models.User, *models.APIToken, error) {
+	if !strings.HasPrefix(plaintext, apiTokenPrefix) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+
+	token, err := s.tokens.WithContext(ctx).FindByHash(hashToken(plaintext))
+	if err != nil || token.Expired() {
+		return nil, nil, ErrInvalidAPIToken
+	}
+
+	user, err := s.userRepo.WithContext(ctx).FindByID(token.UserID)
+	if err != nil || user.Locked() {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	// A password reset, including an admin's forced one, revokes older tokens
+	if user.PasswordChangedAt != nil && token.CreatedAt.Before(*user.PasswordChangedAt) {
+		return nil, nil, ErrInvalidAPIToken
+	}
+
+	if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > apiTokenTouchInterval {
+		if err := s.tokens.WithContext(ctx).Touch(token); err != nil {
+			return nil, nil, fmt.Errorf("recording api token use: %w", err)
+		}
+	}
+
+	return user, token, nil
+}
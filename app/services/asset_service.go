@@ -2,7 +2,7 @@ package services
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"os"
 )
 
@@ -25,22 +25,22 @@ func (as *AssetService) loadManifest() {
 	manifestPath := "web/static/dist/manifest.json"
 
 	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
-		fmt.Printf("Warning: Asset manifest not found at %s\n", manifestPath)
+		slog.Warn("asset manifest not found", "path", manifestPath)
 		return
 	}
 
 	data, err := os.ReadFile(manifestPath)
 	if err != nil {
-		fmt.Printf("Error reading asset manifest: %v\n", err)
+		slog.Error("failed to read asset manifest", "path", manifestPath, "error", err)
 		return
 	}
 
 	if err := json.Unmarshal(data, &as.manifest); err != nil {
-		fmt.Printf("Error parsing asset manifest: %v\n", err)
+		slog.Error("failed to parse asset manifest", "path", manifestPath, "error", err)
 		return
 	}
 
-	fmt.Printf("Loaded asset manifest with %d entries\n", len(as.manifest))
+	slog.Debug("loaded asset manifest", "entries", len(as.manifest))
 }
 
 // GetAssetPath returns the fingerprinted path for an asset
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"errors"
+)
+
+// Outcomes of a password login attempt, as passed to AuthMetrics.LoginAttempt
+const (
+	LoginSuccess            = "success"
+	LoginInvalidCredentials = "invalid_credentials"
+	LoginThrottled          = "throttled"
+	LoginLocked             = "locked"
+	LoginError              = "error"
+)
+
+// AuthMetrics receives authentication events for monitoring. The metrics
+// package implements it for Prometheus.
+type AuthMetrics interface {
+	// LoginAttempt counts a password check, with one of the Login* outcomes.
+	// A user with 2FA still has the code step ahead after a success.
+	LoginAttempt(result string)
+	// Registration counts a new account
+	Registration()
+}
+
+type noAuthMetrics struct{}
+
+func (noAuthMetrics) LoginAttempt(string) {}
+func (noAuthMetrics) Registration()       {}
+
+// loginResult classifies the error Login returned
+func loginResult(err error) string {
+	var tooMany *TooManyAttemptsError
+	switch {
+	case err == nil:
+		return LoginSuccess
+	case errors.As(err, &tooMany):
+		return LoginThrottled
+	case errors.Is(err, ErrAccountLocked):
+		return LoginLocked
+	case errors.Is(err, ErrInvalidCredentials), errors.Is(err, errMissingCredentials):
+		return LoginInvalidCredentials
+	default:
+		return LoginError
+	}
+}
@@ -1,87 +1,969 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"fresh/app/logging"
 	"fresh/app/models"
-	"strconv"
+	"fresh/app/tracing"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
+// CurrentUserKey is the c.Locals key holding the authenticated *models.User
+const CurrentUserKey = "user"
+
+// secondFactorCookieName carries the pending login between the password
+// step and the code step
+const secondFactorCookieName = "fresh_2fa"
+
+var (
+	ErrNotAuthenticated      = errors.New("not authenticated")
+	ErrNoPendingSecondFactor = errors.New("your sign-in has expired, please enter your password again")
+	ErrAccountLocked         = errors.New("this account has been locked, please contact an administrator")
+	ErrEmailTaken            = errors.New("email already exists")
+	ErrInvalidCredentials    = errors.New("invalid credentials")
+
+	errMissingCredentials = errors.New("email and password are required")
+)
+
+// SessionConfig controls the session cookie handed to browsers
+type SessionConfig struct {
+	CookieName string
+	Lifetime   time.Duration
+	// TouchInterval limits how often LastSeenAt is written back to the store
+	TouchInterval time.Duration
+	Secure        bool
+}
+
+// DefaultSessionConfig returns the session settings for the current ENV
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		CookieName:    "fresh_session",
+		Lifetime:      14 * 24 * time.Hour,
+		TouchInterval: time.Minute,
+		Secure:        os.Getenv("ENV") == "production",
+	}
+}
+
 type AuthService struct {
-	userRepo *models.UserRepository
+	userRepo      *models.UserRepository
+	sessions      SessionStore
+	sessionConfig SessionConfig
+	attempts      AttemptStore
+	throttle      LoginThrottleConfig
+	resetTokens   *models.PasswordResetTokenRepository
+	verifier      *verificationSigner
+	verification  EmailVerificationConfig
+	twoFactor     *TwoFactorService
+	mailer        Mailer
+	mailViews     MailRenderer
+	baseURL       string
+	metrics       AuthMetrics
+	// background tracks emails sent off the request path
+	background sync.WaitGroup
+}
+
+// passwordResetTTL is how long an emailed reset link stays valid
+const passwordResetTTL = time.Hour
+
+// minPasswordLength matches the minlength enforced by the forms
+const minPasswordLength = 6
+
+// ValidatePassword checks a new password against the password rules
+func ValidatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	return nil
+}
+
+var ErrInvalidResetToken = errors.New("this password reset link is invalid or has expired")
+
+// AuthOption customizes an AuthService at construction time
+type AuthOption func(*AuthService)
+
+// WithSessionConfig overrides the default session cookie settings
+func WithSessionConfig(cfg SessionConfig) AuthOption {
+	return func(s *AuthService) {
+		s.sessionConfig = cfg
+	}
+}
+
+// WithLoginThrottle sets the brute-force limits and where attempts are kept
+func WithLoginThrottle(cfg LoginThrottleConfig, attempts AttemptStore) AuthOption {
+	return func(s *AuthService) {
+		s.throttle = cfg
+		s.attempts = attempts
+	}
+}
+
+// WithPasswordResetTokens enables the password reset flow
+func WithPasswordResetTokens(tokens *models.PasswordResetTokenRepository) AuthOption {
+	return func(s *AuthService) {
+		s.resetTokens = tokens
+	}
+}
+
+// WithEmailVerification enables signed email verification links. An empty
+// secretKeyBase leaves verification disabled.
+func WithEmailVerification(secretKeyBase string, cfg EmailVerificationConfig) AuthOption {
+	return func(s *AuthService) {
+		s.verification = cfg
+		if secretKeyBase != "" {
+			s.verifier = newVerificationSigner(secretKeyBase)
+		}
+	}
+}
+
+// WithTwoFactor enables the second login step for users with 2FA turned on
+func WithTwoFactor(twoFactor *TwoFactorService) AuthOption {
+	return func(s *AuthService) {
+		s.twoFactor = twoFactor
+	}
+}
+
+// WithMailer sets how email is rendered and delivered, and the public base
+// URL that links in those emails point to
+func WithMailer(mailer Mailer, views MailRenderer, baseURL string) AuthOption {
+	return func(s *AuthService) {
+		s.mailer = mailer
+		s.mailViews = views
+		s.baseURL = strings.TrimRight(baseURL, "/")
+	}
+}
+
+// WithMetrics counts logins and registrations
+func WithMetrics(metrics AuthMetrics) AuthOption {
+	return func(s *AuthService) {
+		s.metrics = metrics
+	}
 }
 
-func NewAuthService(userRepo *models.UserRepository) *AuthService {
-	return &AuthService{
-		userRepo: userRepo,
+func NewAuthService(userRepo *models.UserRepository, sessions SessionStore, opts ...AuthOption) *AuthService {
+	s := &AuthService{
+		userRepo:      userRepo,
+		sessions:      sessions,
+		sessionConfig: DefaultSessionConfig(),
+		attempts:      NewMemoryAttemptStore(),
+		throttle:      DefaultLoginThrottleConfig(),
+		verification:  DefaultEmailVerificationConfig(),
+		mailer:        &LogMailer{},
+		baseURL:       "http://localhost:3000",
+		metrics:       noAuthMetrics{},
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// SessionConfig returns the session cookie settings in effect
+func (s *AuthService) SessionConfig() SessionConfig {
+	return s.sessionConfig
 }
 
-func (s *AuthService) Login(email, password string) (*models.User, error) {
+// Login checks the credentials of a login attempt made from ip. Attempts are
+// throttled per IP and per email over a sliding window, and an account is
+// locked for a while after too many consecutive failures; both surface as a
+// *TooManyAttemptsError. Emails without an account lock out the same way.
+func (s *AuthService) Login(ctx context.Context, email, password, ip string) (*models.User, error) {
+	user, err := s.login(ctx, email, password, ip)
+	s.metrics.LoginAttempt(loginResult(err))
+	return user, err
+}
+
+func (s *AuthService) login(ctx context.Context, email, password, ip string) (*models.User, error) {
 	if email == "" || password == "" {
-		return nil, errors.New("email and password are required")
+		return nil, errMissingCredentials
 	}
 
-	user, err := s.userRepo.FindByEmail(email)
+	ipKey := "ip:" + ip
+	emailKey := "email:" + strings.ToLower(email)
+
+	if err := s.checkThrottle(ctx, ipKey, s.throttle.MaxPerIP); err != nil {
+		return nil, err
+	}
+	if err := s.checkThrottle(ctx, emailKey, s.throttle.MaxPerEmail); err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.WithContext(ctx).FindByEmail(email)
 	if err != nil {
-		return nil, errors.New("invalid credentials")
+		// Unknown emails lock out like accounts do, so a 429 doesn't give
+		// away which addresses are registered
+		if err := s.checkUnknownLockout(ctx, emailKey); err != nil {
+			return nil, err
+		}
+		s.recordFailure(ctx, ipKey, emailKey)
+		s.recordUnknownFailure(ctx, emailKey)
+		return nil, ErrInvalidCredentials
+	}
+
+	if lockedFor := user.LockedFor(); lockedFor > 0 {
+		return nil, &TooManyAttemptsError{RetryAfter: lockedFor}
 	}
 
 	if !user.CheckPassword(password) {
-		return nil, errors.New("invalid credentials")
+		s.recordFailure(ctx, ipKey, emailKey)
+		if err := s.recordAccountFailure(ctx, user); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	// Only revealed to someone who knows the password
+	if user.Locked() {
+		return nil, ErrAccountLocked
+	}
+
+	// The per-IP log is kept: one good password shouldn't clear a spraying IP
+	if err := s.attempts.Reset(ctx, emailKey); err != nil {
+		return nil, err
+	}
+	if user.FailedLoginAttempts > 0 || user.LockedUntil != nil {
+		user.FailedLoginAttempts = 0
+		user.LockedUntil = nil
+		if err := s.userRepo.WithContext(ctx).UpdateLoginState(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// Can reports whether the user holds permission through any of their roles.
+// A nil user can do nothing.
+func (s *AuthService) Can(ctx context.Context, user *models.User, permission string) bool {
+	if user == nil || !s.ensureRoles(ctx, user) {
+		return false
+	}
+	return user.HasPermission(permission)
+}
+
+// HasRole reports whether the user has the named role
+func (s *AuthService) HasRole(ctx context.Context, user *models.User, role string) bool {
+	if user == nil || !s.ensureRoles(ctx, user) {
+		return false
+	}
+	return user.HasRole(role)
+}
+
+// ensureRoles loads the user's roles if the caller's copy doesn't have them
+func (s *AuthService) ensureRoles(ctx context.Context, user *models.User) bool {
+	if user.Roles != nil {
+		return true
+	}
+	if err := s.userRepo.WithContext(ctx).LoadRoles(user); err != nil {
+		logging.FromContext(ctx).Error("failed to load roles", "user_id", user.ID, "error", err)
+		return false
+	}
+	return true
+}
+
+// RequiresSecondFactor reports whether the user must enter a 2FA code after
+// their password
+func (s *AuthService) RequiresSecondFactor(user *models.User) bool {
+	return s.twoFactor != nil && user.TwoFactorEnabled()
+}
+
+// BeginSecondFactor remembers a user who passed the password step in a
+// short-lived encrypted cookie. No session exists until
+// CompleteSecondFactor succeeds.
+func (s *AuthService) BeginSecondFactor(c *fiber.Ctx, user *models.User) error {
+	if s.twoFactor == nil {
+		return errors.New("two-factor authentication is not configured")
+	}
+
+	value, expiresAt, err := s.twoFactor.sealPending(user.ID)
+	if err != nil {
+		return err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     secondFactorCookieName,
+		Value:    value,
+		Path:     "/login",
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   s.sessionConfig.Secure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return nil
+}
+
+// PendingSecondFactorUser returns the user waiting on the code step
+func (s *AuthService) PendingSecondFactorUser(c *fiber.Ctx) (*models.User, error) {
+	ctx := c.UserContext()
+	if s.twoFactor == nil {
+		return nil, ErrNoPendingSecondFactor
+	}
+
+	userID, err := s.twoFactor.openPending(c.Cookies(secondFactorCookieName))
+	if err != nil {
+		return nil, ErrNoPendingSecondFactor
+	}
+
+	user, err := s.userRepo.WithContext(ctx).FindByID(userID)
+	if err != nil || !user.TwoFactorEnabled() {
+		return nil, ErrNoPendingSecondFactor
+	}
+
+	return user, nil
+}
+
+// CompleteSecondFactor checks the TOTP or recovery code for the pending
+// login and, if it is valid, starts the session. Code guesses are throttled
+// per user like password guesses are per email.
+func (s *AuthService) CompleteSecondFactor(c *fiber.Ctx, code string) (*models.User, error) {
+	user, err := s.PendingSecondFactorUser(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.VerifySecondFactor(c.UserContext(), user, code); err != nil {
+		return nil, err
+	}
+
+	s.clearSecondFactorCookie(c)
+	if err := s.SetUserSession(c, user); err != nil {
+		return nil, err
 	}
 
 	return user, nil
 }
 
-func (s *AuthService) Register(email, password string) (*models.User, error) {
+// VerifySecondFactor checks a TOTP or recovery code for a user who has
+// already given their password. Code guesses are throttled per user like
+// password guesses are per email.
+func (s *AuthService) VerifySecondFactor(ctx context.Context, user *models.User, code string) error {
+	if s.twoFactor == nil {
+		return ErrNoPendingSecondFactor
+	}
+
+	key := fmt.Sprintf("2fa:%d", user.ID)
+	if err := s.checkThrottle(ctx, key, s.throttle.MaxPerEmail); err != nil {
+		return err
+	}
+
+	if err := s.twoFactor.Verify(ctx, user, code); err != nil {
+		if errors.Is(err, ErrInvalidTwoFactorCode) {
+			s.recordFailure(ctx, key)
+		}
+		return err
+	}
+
+	return s.attempts.Reset(ctx, key)
+}
+
+// ConfirmPassword re-checks the password of a signed-in user before a
+// sensitive change. Wrong guesses count against the same per-email limit as
+// logins, so a session alone can't be used to guess the password.
+func (s *AuthService) ConfirmPassword(ctx context.Context, user *models.User, password string) error {
+	key := "email:" + strings.ToLower(user.Email)
+	if err := s.checkThrottle(ctx, key, s.throttle.MaxPerEmail); err != nil {
+		return err
+	}
+
+	if !user.CheckPassword(password) {
+		s.recordFailure(ctx, key)
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// PruneLoginAttempts drops attempts that have left every throttling window
+func (s *AuthService) PruneLoginAttempts(ctx context.Context) error {
+	window := s.throttle.Window
+	if s.verification.ResendWindow > window {
+		window = s.verification.ResendWindow
+	}
+	if s.throttle.LockoutDuration > window {
+		window = s.throttle.LockoutDuration
+	}
+	return s.attempts.DeleteBefore(ctx, time.Now().Add(-window))
+}
+
+func (s *AuthService) checkThrottle(ctx context.Context, key string, limit int) error {
+	now := time.Now()
+	attempts, err := s.attempts.Since(ctx, key, now.Add(-s.throttle.Window))
+	if err != nil {
+		return err
+	}
+
+	if wait := slidingWindowWait(attempts, limit, s.throttle.Window, now); wait > 0 {
+		return &TooManyAttemptsError{RetryAfter: wait}
+	}
+	return nil
+}
+
+func (s *AuthService) recordFailure(ctx context.Context, keys ...string) {
+	now := time.Now()
+	for _, key := range keys {
+		if err := s.attempts.Record(ctx, key, now); err != nil {
+			logging.FromContext(ctx).Error("failed to record attempt", "bucket", attemptKind(key), "error", err)
+		}
+	}
+}
+
+// checkUnknownLockout refuses an email without an account while its
+// mirrored lockout lasts
+func (s *AuthService) checkUnknownLockout(ctx context.Context, emailKey string) error {
+	if s.throttle.LockoutThreshold <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	locks, err := s.attempts.Since(ctx, "lockout:"+emailKey, now.Add(-s.throttle.LockoutDuration))
+	if err != nil {
+		return err
+	}
+	if len(locks) > 0 {
+		return &TooManyAttemptsError{RetryAfter: locks[len(locks)-1].Add(s.throttle.LockoutDuration).Sub(now)}
+	}
+	return nil
+}
+
+// recordUnknownFailure counts a failed login for an email without an account
+// the way recordAccountFailure does for users, locking it at the threshold
+func (s *AuthService) recordUnknownFailure(ctx context.Context, emailKey string) {
+	if s.throttle.LockoutThreshold <= 0 {
+		return
+	}
+
+	key := "failures:" + emailKey
+	s.recordFailure(ctx, key)
+	failures, err := s.attempts.Since(ctx, key, time.Time{})
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to count attempts", "bucket", attemptKind(key), "error", err)
+		return
+	}
+	if len(failures) >= s.throttle.LockoutThreshold {
+		s.recordFailure(ctx, "lockout:"+emailKey)
+		if err := s.attempts.Reset(ctx, key); err != nil {
+			logging.FromContext(ctx).Error("failed to reset attempts", "bucket", attemptKind(key), "error", err)
+		}
+	}
+}
+
+// attemptKind is the kind of throttling bucket a key counts in, e.g.
+// "reset:email" for "reset:email:jane@example.com", so the address or IP in
+// the key stays out of the logs
+func attemptKind(key string) string {
+	kind, rest, _ := strings.Cut(key, ":")
+	switch kind {
+	case "reset", "failures", "lockout":
+		next, _, _ := strings.Cut(rest, ":")
+		return kind + ":" + next
+	}
+	return kind
+}
+
+func (s *AuthService) recordAccountFailure(ctx context.Context, user *models.User) error {
+	user.FailedLoginAttempts++
+	if s.throttle.LockoutThreshold > 0 && user.FailedLoginAttempts >= s.throttle.LockoutThreshold {
+		lockedUntil := time.Now().Add(s.throttle.LockoutDuration)
+		user.LockedUntil = &lockedUntil
+		user.FailedLoginAttempts = 0
+	}
+	return s.userRepo.WithContext(ctx).UpdateLoginState(user)
+}
+
+func (s *AuthService) Register(ctx context.Context, email, password string) (*models.User, error) {
 	if email == "" || password == "" {
-		return nil, errors.New("email and password are required")
+		return nil, errMissingCredentials
 	}
 
 	// Check if user already exists
-	if _, err := s.userRepo.FindByEmail(email); err == nil {
-		return nil, errors.New("email already exists")
+	if _, err := s.userRepo.WithContext(ctx).FindByEmail(email); err == nil {
+		return nil, ErrEmailTaken
+	}
+
+	user, err := s.userRepo.WithContext(ctx).Create(email, password)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.Registration()
+	return user, nil
+}
+
+// ChangePassword sets a new password for a signed-in user who knows the
+// current one. Every session, including the caller's, is invalidated;
+// browser callers should start a new one with SetUserSession.
+func (s *AuthService) ChangePassword(ctx context.Context, user *models.User, currentPassword, newPassword string) error {
+	return s.UpdateAccount(ctx, user, currentPassword, AccountChanges{Password: &newPassword})
+}
+
+// ChangeEmail moves the account to a new address for a user who knows their
+// password. The new address starts out unverified and is sent a link.
+func (s *AuthService) ChangeEmail(ctx context.Context, user *models.User, currentPassword, email string) error {
+	return s.UpdateAccount(ctx, user, currentPassword, AccountChanges{Email: &email})
+}
+
+// AccountChanges are what UpdateAccount changes; nil fields are left alone
+type AccountChanges struct {
+	Email    *string
+	Password *string
+}
+
+// UpdateAccount changes the email address and/or password of a user who
+// knows their current password, which is checked as by ConfirmPassword.
+// Every change is validated before any is saved, and they are saved in one
+// transaction, so a rejected password can't leave the address changed. A
+// new address is unverified and sent a link, as with ChangeEmail; a new
+// password ends every session, as with ChangePassword.
+func (s *AuthService) UpdateAccount(ctx context.Context, user *models.User, currentPassword string, changes AccountChanges) error {
+	if err := s.ConfirmPassword(ctx, user, currentPassword); err != nil {
+		return err
+	}
+
+	var email string
+	if changes.Email != nil {
+		email = strings.TrimSpace(*changes.Email)
+		if err := validateEmail(email); err != nil {
+			return err
+		}
+		if strings.EqualFold(email, user.Email) {
+			email = ""
+		} else if _, err := s.userRepo.WithContext(ctx).FindByEmail(email); err == nil {
+			return ErrEmailTaken
+		}
+	}
+	if changes.Password != nil {
+		if err := ValidatePassword(*changes.Password); err != nil {
+			return err
+		}
+	}
+
+	// Changed on a copy so a rollback doesn't leave the caller's user half
+	// updated
+	updated := *user
+	err := s.userRepo.WithContext(ctx).Transaction(func(users *models.UserRepository) error {
+		if email != "" {
+			if err := users.UpdateEmail(&updated, email); err != nil {
+				return err
+			}
+		}
+		if changes.Password != nil {
+			return users.UpdatePassword(&updated, *changes.Password)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*user = updated
+
+	if changes.Password != nil {
+		if err := s.sessions.DeleteByUser(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+	if email != "" && s.verifier != nil {
+		if err := s.SendEmailVerification(ctx, user); err != nil {
+			logging.FromContext(ctx).Error("verification email failed", "user_id", user.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// validateEmail accepts a bare address such as jane@example.com
+func validateEmail(email string) error {
+	if email == "" {
+		return errors.New("email is required")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("email must be a valid address, such as jane@example.com")
+	}
+	return nil
+}
+
+// RequestPasswordReset emails a single-use reset link if an account exists
+// for the email. It returns nil either way so callers can't reveal which
+// addresses are registered, and the link is created and sent in the
+// background so the response takes as long for both. Requests made from ip
+// are throttled per IP and per email like logins, whether or not the
+// address is registered; a *TooManyAttemptsError says when to try again.
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	if s.resetTokens == nil {
+		return errors.New("password resets are not configured")
+	}
+	if email == "" {
+		return errors.New("email is required")
+	}
+
+	ipKey := "reset:ip:" + ip
+	emailKey := "reset:email:" + strings.ToLower(email)
+	if err := s.checkThrottle(ctx, ipKey, s.throttle.MaxPerIP); err != nil {
+		return err
+	}
+	if err := s.checkThrottle(ctx, emailKey, s.throttle.MaxPerEmail); err != nil {
+		return err
+	}
+	s.recordFailure(ctx, ipKey, emailKey)
+
+	user, err := s.userRepo.WithContext(ctx).FindByEmail(email)
+	if err != nil {
+		return nil
+	}
+
+	// Still traced and logged as part of the request, but not cut short by it
+	ctx = context.WithoutCancel(ctx)
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if err := s.sendPasswordReset(ctx, user); err != nil {
+			logging.FromContext(ctx).Error("password reset email failed", "user_id", user.ID, "error", err)
+		}
+	}()
+	return nil
+}
+
+// Wait blocks until emails being sent in the background have gone out. Call
+// it on shutdown before the database closes.
+func (s *AuthService) Wait() {
+	s.background.Wait()
+}
+
+// ForcePasswordReset is the administrator's version of a reset: the current
+// password stops working, every session ends, and the user is emailed a
+// reset link to choose a new one
+func (s *AuthService) ForcePasswordReset(ctx context.Context, user *models.User) error {
+	if s.resetTokens == nil {
+		return errors.New("password resets are not configured")
+	}
+
+	// Nobody knows the replacement, so only the emailed link gets back in
+	password, err := generateToken()
+	if err != nil {
+		return err
+	}
+	if err := s.userRepo.WithContext(ctx).UpdatePassword(user, password); err != nil {
+		return err
+	}
+	if err := s.sessions.DeleteByUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	return s.sendPasswordReset(ctx, user)
+}
+
+func (s *AuthService) sendPasswordReset(ctx context.Context, user *models.User) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.resetTokens.WithContext(ctx).Create(user.ID, hashToken(token), time.Now().Add(passwordResetTTL)); err != nil {
+		return err
+	}
+
+	return s.sendMail(user.Email, "password_reset", map[string]interface{}{
+		"Link":      s.baseURL + "/password/reset/" + token,
+		"ExpiresIn": humanizeDuration(passwordResetTTL),
+	})
+}
+
+// SendEmailVerification emails the user a signed link that proves they own
+// their address. Sends are throttled per user; a *TooManyAttemptsError says
+// when the next one is allowed. Already verified users get nothing.
+func (s *AuthService) SendEmailVerification(ctx context.Context, user *models.User) error {
+	if s.verifier == nil {
+		return errors.New("email verification is not configured")
+	}
+	if user.EmailVerified() {
+		return nil
+	}
+
+	key := fmt.Sprintf("verify:%d", user.ID)
+	now := time.Now()
+	sent, err := s.attempts.Since(ctx, key, now.Add(-s.verification.ResendWindow))
+	if err != nil {
+		return err
+	}
+	if wait := slidingWindowWait(sent, s.verification.MaxResends, s.verification.ResendWindow, now); wait > 0 {
+		return &TooManyAttemptsError{RetryAfter: wait}
+	}
+	if err := s.attempts.Record(ctx, key, now); err != nil {
+		return err
+	}
+
+	token := s.verifier.Sign(user.ID, user.Email, now.Add(s.verification.TTL))
+	return s.sendMail(user.Email, "verify_email", map[string]interface{}{
+		"Link":      s.baseURL + "/verify-email/" + token,
+		"ExpiresIn": humanizeDuration(s.verification.TTL),
+	})
+}
+
+// VerifyEmail checks a verification link and marks the user's address as
+// verified. Following a link twice is harmless.
+func (s *AuthService) VerifyEmail(ctx context.Context, token string) (*models.User, error) {
+	if s.verifier == nil {
+		return nil, errors.New("email verification is not configured")
+	}
+
+	userID, _, err := s.verifier.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.WithContext(ctx).FindByID(userID)
+	if err != nil {
+		return nil, ErrInvalidVerificationToken
+	}
+
+	if err := s.verifier.Verify(token, user.Email); err != nil {
+		return nil, err
+	}
+
+	if user.EmailVerified() {
+		return user, nil
+	}
+	if err := s.userRepo.WithContext(ctx).MarkEmailVerified(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ValidatePasswordResetToken reports whether a reset link can still be used
+func (s *AuthService) ValidatePasswordResetToken(ctx context.Context, token string) error {
+	if s.resetTokens == nil {
+		return errors.New("password resets are not configured")
+	}
+	if _, err := s.resetTokens.WithContext(ctx).FindUsable(hashToken(token)); err != nil {
+		return ErrInvalidResetToken
+	}
+	return nil
+}
+
+// ResetPassword consumes a reset token and sets the new password. Every
+// outstanding reset token and every existing session for the user is
+// invalidated.
+func (s *AuthService) ResetPassword(ctx context.Context, token, password string) (*models.User, error) {
+	if s.resetTokens == nil {
+		return nil, errors.New("password resets are not configured")
+	}
+	if err := ValidatePassword(password); err != nil {
+		return nil, err
 	}
 
-	return s.userRepo.Create(email, password)
+	var user *models.User
+	err := s.resetTokens.WithContext(ctx).Consume(hashToken(token), func(tx *gorm.DB, userID uint) error {
+		users := models.NewUserRepository(tx)
+		found, err := users.FindByID(userID)
+		if err != nil {
+			return models.ErrResetTokenNotUsable
+		}
+		if err := users.UpdatePassword(found, password); err != nil {
+			return err
+		}
+		user = found
+		return nil
+	})
+	if errors.Is(err, models.ErrResetTokenNotUsable) {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.sessions.DeleteByUser(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	return user, nil
 }
 
+// GetCurrentUser resolves the user behind the request's session cookie.
+// The result is cached in c.Locals so repeated calls within a request are free.
 func (s *AuthService) GetCurrentUser(c *fiber.Ctx) (*models.User, error) {
-	userIDStr := c.Cookies("user_id")
-	if userIDStr == "" {
-		return nil, errors.New("not authenticated")
+	if user, ok := c.Locals(CurrentUserKey).(*models.User); ok {
+		return user, nil
 	}
 
-	userID, err := strconv.ParseUint(userIDStr, 10, 32)
+	sessionID := c.Cookies(s.sessionConfig.CookieName)
+	if sessionID == "" {
+		return nil, ErrNotAuthenticated
+	}
+
+	ctx, span := tracing.Tracer().Start(c.UserContext(), "AuthService.GetCurrentUser")
+	defer span.End()
+
+	session, err := s.sessions.Find(ctx, sessionID)
 	if err != nil {
-		// Clear invalid cookie
-		c.ClearCookie("user_id")
-		return nil, errors.New("invalid user ID")
+		// Clear cookie for unknown session
+		s.clearSessionCookie(c)
+		return nil, ErrNotAuthenticated
+	}
+
+	if session.Expired() {
+		s.sessions.Delete(ctx, session.ID)
+		s.clearSessionCookie(c)
+		return nil, ErrNotAuthenticated
 	}
 
-	user, err := s.userRepo.FindByID(uint(userID))
+	user, err := s.userRepo.WithContext(ctx).FindByID(session.UserID)
 	if err != nil {
-		// Clear cookie for non-existent user
-		c.ClearCookie("user_id")
+		// The account is gone, so is the session
+		s.sessions.Delete(ctx, session.ID)
+		s.clearSessionCookie(c)
 		return nil, err
 	}
 
+	// Stateless stores can't delete sessions, so a password change or an
+	// admin lock is enforced here. Cookie sessions only carry whole seconds.
+	if user.Locked() ||
+		user.PasswordChangedAt != nil && session.CreatedAt.Before(user.PasswordChangedAt.Truncate(time.Second)) {
+		s.sessions.Delete(ctx, session.ID)
+		s.clearSessionCookie(c)
+		return nil, ErrNotAuthenticated
+	}
+
+	if time.Since(session.LastSeenAt) > s.sessionConfig.TouchInterval {
+		if err := s.sessions.Touch(ctx, session); err != nil {
+			return nil, err
+		}
+		// Stateless stores re-encode the session on every touch
+		if session.ID != sessionID {
+			s.setSessionCookie(c, session)
+		}
+	}
+
+	c.Locals(CurrentUserKey, user)
 	return user, nil
 }
 
-func (s *AuthService) SetUserSession(c *fiber.Ctx, user *models.User) {
+// SetUserSession starts a fresh session for the user and sets the cookie.
+// Any session the browser already carried is discarded to prevent fixation.
+func (s *AuthService) SetUserSession(c *fiber.Ctx, user *models.User) error {
+	ctx := c.UserContext()
+	if oldID := c.Cookies(s.sessionConfig.CookieName); oldID != "" {
+		s.sessions.Delete(ctx, oldID)
+	}
+
+	session, err := s.sessions.Create(ctx, user.ID, s.sessionConfig.Lifetime)
+	if err != nil {
+		return err
+	}
+
+	s.setSessionCookie(c, session)
+	c.Locals(CurrentUserKey, user)
+
+	return s.rotateCSRFToken(c)
+}
+
+func (s *AuthService) ClearUserSession(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	c.Locals(CurrentUserKey, nil)
+
+	sessionID := c.Cookies(s.sessionConfig.CookieName)
+	s.clearSessionCookie(c)
+	if err := s.rotateCSRFToken(c); err != nil {
+		return err
+	}
+	if sessionID == "" {
+		return nil
+	}
+
+	return s.sessions.Delete(ctx, sessionID)
+}
+
+// rotateCSRFToken replaces the browser's CSRF token when a session starts or
+// ends
+func (s *AuthService) rotateCSRFToken(c *fiber.Ctx) error {
+	_, err := IssueCSRFToken(c, s.sessionConfig.Secure)
+	return err
+}
+
+// IssueCSRFToken gives the browser a new CSRF token in the CSRFCookieName
+// cookie and hands it to anything rendered in this response, including the
+// CSRFHeaderName header
+func IssueCSRFToken(c *fiber.Ctx, secure bool) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
 	c.Cookie(&fiber.Cookie{
-		Name:  "user_id",
-		Value: strconv.Itoa(int(user.ID)),
-		// Add security options for production:
-		// HTTPOnly: true,
-		// Secure: true,
-		// SameSite: "Strict",
+		Name:        CSRFCookieName,
+		Value:       token,
+		Path:        "/",
+		HTTPOnly:    true,
+		Secure:      secure,
+		SameSite:    fiber.CookieSameSiteLaxMode,
+		SessionOnly: true,
 	})
+	c.Locals(CSRFTokenKey, token)
+	c.Set(CSRFHeaderName, token)
+	return token, nil
 }
 
-func (s *AuthService) ClearUserSession(c *fiber.Ctx) {
-	c.ClearCookie("user_id")
+// sendMail renders a mail template and delivers it to one recipient
+func (s *AuthService) sendMail(to, template string, data map[string]interface{}) error {
+	if s.mailViews == nil {
+		return errors.New("mail templates are not configured")
+	}
+
+	msg, err := s.mailViews.RenderMail(template, data)
+	if err != nil {
+		return err
+	}
+
+	msg.To = to
+	return s.mailer.Send(msg)
+}
+
+// hashToken returns the hex SHA-256 of a bearer token for storage
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *AuthService) setSessionCookie(c *fiber.Ctx, session *models.Session) {
+	c.Cookie(&fiber.Cookie{
+		Name:     s.sessionConfig.CookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HTTPOnly: true,
+		Secure:   s.sessionConfig.Secure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func (s *AuthService) clearSecondFactorCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     secondFactorCookieName,
+		Value:    "",
+		Path:     "/login",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Secure:   s.sessionConfig.Secure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func (s *AuthService) clearSessionCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     s.sessionConfig.CookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now().Add(-time.Hour),
+		HTTPOnly: true,
+		Secure:   s.sessionConfig.Secure,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
 }
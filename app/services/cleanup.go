@@ -0,0 +1,40 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// StartCleanup runs the garbage-collection tasks (expired sessions, stale
+// login attempts, ...) every interval until the returned stop function is
+// called. A failing task is logged and retried on the next tick. stop waits
+// for a run in progress to finish, so it can be called during shutdown before
+// the database is closed.
+func StartCleanup(interval time.Duration, tasks ...func(ctx context.Context) error) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				for _, task := range tasks {
+					if err := task(context.Background()); err != nil {
+						slog.Error("cleanup task failed", "error", err)
+					}
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// deriveKey derives an independent 32-byte key for one purpose from the
+// application's secret_key_base, so a leak in one place doesn't expose others
+func deriveKey(secretKeyBase, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secretKeyBase))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// sealer encrypts and authenticates small payloads with AES-256-GCM
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(secretKeyBase, purpose string) (*sealer, error) {
+	if secretKeyBase == "" {
+		return nil, errors.New("secret_key_base is not configured")
+	}
+
+	block, err := aes.NewCipher(deriveKey(secretKeyBase, purpose))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealer{aead: aead}, nil
+}
+
+// Seal returns nonce||ciphertext encoded as URL-safe base64
+func (s *sealer) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Open reverses Seal, failing if the value was tampered with
+func (s *sealer) Open(encoded string) ([]byte, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, ErrInvalidCiphertext
+	}
+
+	plaintext, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+
+	return plaintext, nil
+}
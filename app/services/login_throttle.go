@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"fresh/app/models"
+	"fresh/config"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AttemptStore keeps the sliding-window log of failed login attempts per
+// throttling key. The in-memory store suits a single node; the database
+// store shares the log between several.
+type AttemptStore interface {
+	// Record logs a failed attempt for key
+	Record(ctx context.Context, key string, at time.Time) error
+	// Since returns the attempts for key at or after since, oldest first
+	Since(ctx context.Context, key string, since time.Time) ([]time.Time, error)
+	// Reset forgets every attempt for key
+	Reset(ctx context.Context, key string) error
+	// DeleteBefore garbage-collects attempts older than cutoff
+	DeleteBefore(ctx context.Context, cutoff time.Time) error
+}
+
+// LoginThrottleConfig tunes brute-force protection for AuthService.Login
+type LoginThrottleConfig struct {
+	// Window is the sliding window the per-IP and per-email limits apply to
+	Window      time.Duration
+	MaxPerIP    int
+	MaxPerEmail int
+	// LockoutThreshold consecutive failures lock the account for LockoutDuration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+}
+
+// DefaultLoginThrottleConfig returns conservative limits
+func DefaultLoginThrottleConfig() LoginThrottleConfig {
+	return LoginThrottleConfig{
+		Window:           15 * time.Minute,
+		MaxPerIP:         20,
+		MaxPerEmail:      5,
+		LockoutThreshold: 10,
+		LockoutDuration:  30 * time.Minute,
+	}
+}
+
+// NewLoginThrottleConfig converts the YAML auth settings into a LoginThrottleConfig
+func NewLoginThrottleConfig(cfg config.AuthConfig) (LoginThrottleConfig, error) {
+	throttle := DefaultLoginThrottleConfig()
+
+	if cfg.RateLimit.Window != "" {
+		window, err := time.ParseDuration(cfg.RateLimit.Window)
+		if err != nil {
+			return throttle, fmt.Errorf("invalid rate_limit window %q: %w", cfg.RateLimit.Window, err)
+		}
+		throttle.Window = window
+	}
+	if cfg.RateLimit.MaxPerIP > 0 {
+		throttle.MaxPerIP = cfg.RateLimit.MaxPerIP
+	}
+	if cfg.RateLimit.MaxPerEmail > 0 {
+		throttle.MaxPerEmail = cfg.RateLimit.MaxPerEmail
+	}
+	if cfg.Lockout.Threshold > 0 {
+		throttle.LockoutThreshold = cfg.Lockout.Threshold
+	}
+	if cfg.Lockout.Duration != "" {
+		duration, err := time.ParseDuration(cfg.Lockout.Duration)
+		if err != nil {
+			return throttle, fmt.Errorf("invalid lockout duration %q: %w", cfg.Lockout.Duration, err)
+		}
+		throttle.LockoutDuration = duration
+	}
+
+	return throttle, nil
+}
+
+// NewAttemptStore builds the attempt store backend selected in the config
+func NewAttemptStore(cfg config.RateLimitConfig, db *gorm.DB) (AttemptStore, error) {
+	switch cfg.Store {
+	case "memory", "":
+		return NewMemoryAttemptStore(), nil
+	case "database":
+		return NewDatabaseAttemptStore(db), nil
+	default:
+		return nil, fmt.Errorf("unsupported rate limit store: %s", cfg.Store)
+	}
+}
+
+// TooManyAttemptsError is returned when a login is throttled or the account
+// is locked out
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many attempts, try again in %s", humanizeDuration(e.RetryAfter))
+}
+
+// slidingWindowWait returns how long until another attempt fits within limit
+// attempts per window, given the attempts already made (oldest first)
+func slidingWindowWait(attempts []time.Time, limit int, window time.Duration, now time.Time) time.Duration {
+	if limit <= 0 || len(attempts) < limit {
+		return 0
+	}
+
+	// A slot frees up once enough of the oldest attempts leave the window
+	wait := attempts[len(attempts)-limit].Add(window).Sub(now)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// humanizeDuration rounds up to whole minutes, or seconds under a minute
+func humanizeDuration(d time.Duration) string {
+	if d < time.Minute {
+		seconds := int((d + time.Second - 1) / time.Second)
+		if seconds == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+func (s *MemoryAttemptStore) Record(ctx context.Context, key string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := append(s.attempts[key], at)
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].Before(attempts[j]) })
+	s.attempts[key] = attempts
+	return nil
+}
+
+func (s *MemoryAttemptStore) Since(ctx context.Context, key string, since time.Time) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var recent []time.Time
+	for _, at := range s.attempts[key] {
+		if !at.Before(since) {
+			recent = append(recent, at)
+		}
+	}
+	return recent, nil
+}
+
+func (s *MemoryAttemptStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.attempts, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryAttemptStore) DeleteBefore(ctx context.Context, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, attempts := range s.attempts {
+		kept := attempts[:0]
+		for _, at := range attempts {
+			if !at.Before(cutoff) {
+				kept = append(kept, at)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.attempts, key)
+		} else {
+			s.attempts[key] = kept
+		}
+	}
+	return nil
+}
+
+type DatabaseAttemptStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseAttemptStore(db *gorm.DB) *DatabaseAttemptStore {
+	return &DatabaseAttemptStore{db: db}
+}
+
+func (s *DatabaseAttemptStore) Record(ctx context.Context, key string, at time.Time) error {
+	return s.db.WithContext(ctx).Create(&models.LoginAttempt{Bucket: hashToken(key), CreatedAt: at}).Error
+}
+
+func (s *DatabaseAttemptStore) Since(ctx context.Context, key string, since time.Time) ([]time.Time, error) {
+	var attempts []time.Time
+	err := s.db.WithContext(ctx).Model(&models.LoginAttempt{}).
+		Where("bucket = ? AND created_at >= ?", hashToken(key), since).
+		Order("created_at").
+		Pluck("created_at", &attempts).Error
+	return attempts, err
+}
+
+func (s *DatabaseAttemptStore) Reset(ctx context.Context, key string) error {
+	return s.db.WithContext(ctx).Where("bucket = ?", hashToken(key)).Delete(&models.LoginAttempt{}).Error
+}
+
+func (s *DatabaseAttemptStore) DeleteBefore(ctx context.Context, cutoff time.Time) error {
+	return s.db.WithContext(ctx).Where("created_at < ?", cutoff).Delete(&models.LoginAttempt{}).Error
+}
@@ -0,0 +1,375 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"fresh/config"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email ready to be delivered
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers email messages. Implementations are transports: SMTP,
+// .eml files on disk, process memory or stdout.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// NewMailer builds the transport selected in the mail config
+func NewMailer(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Transport {
+	case "smtp":
+		if cfg.SMTP.Host == "" {
+			return nil, fmt.Errorf("mail.smtp.host is required for the smtp transport")
+		}
+		if !validSMTPTLS(cfg.SMTP.TLS) {
+			return nil, fmt.Errorf("unsupported mail.smtp.tls %q, expected starttls, tls or none", cfg.SMTP.TLS)
+		}
+		return &SMTPMailer{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			TLS:      cfg.SMTP.TLS,
+			From:     cfg.From,
+		}, nil
+	case "file":
+		return &FileMailer{Dir: cfg.Dir, From: cfg.From}, nil
+	case "memory":
+		return NewMemoryMailer(), nil
+	case "log", "":
+		return &LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported mail transport: %s", cfg.Transport)
+	}
+}
+
+// Bytes renders the message as RFC 5322 text: multipart/alternative when it
+// has both a plain text and an HTML body. From and To must each be a single
+// address; anything else, line breaks included, is an error rather than a
+// way to add headers.
+func (m *Message) Bytes() ([]byte, error) {
+	from, err := formatAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+	to, err := formatAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid to address: %w", err)
+	}
+
+	var buf bytes.Buffer
+
+	writeHeader := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+
+	writeHeader("From", from)
+	writeHeader("To", to)
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("Message-ID", messageID(m.From))
+	writeHeader("MIME-Version", "1.0")
+
+	if m.HTML == "" {
+		writeHeader("Content-Type", `text/plain; charset="utf-8"`)
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, m.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	writeHeader("Content-Type", `multipart/alternative; boundary="`+mw.Boundary()+`"`)
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct{ contentType, body string }{
+		{`text/plain; charset="utf-8"`, m.Text},
+		{`text/html; charset="utf-8"`, m.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// formatAddress parses a single address and formats it for a header, the
+// display name encoded if needed
+func formatAddress(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("%q contains a line break", value)
+	}
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return "", fmt.Errorf("%q: %w", value, err)
+	}
+	if addr.Name == "" {
+		return addr.Address, nil
+	}
+	return addr.String(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func messageID(from string) string {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domain = addr.Address[at+1:]
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// withFrom fills in the transport's default sender when the message has none
+func withFrom(msg *Message, from string) *Message {
+	if msg.From != "" || from == "" {
+		return msg
+	}
+	copied := *msg
+	copied.From = from
+	return &copied
+}
+
+// SMTPMailer delivers mail through an SMTP relay
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// TLS is "starttls" (the default; the server must offer it), "tls"
+	// (implicit TLS) or "none", the only setting that sends in cleartext
+	TLS  string
+	From string
+	// Timeout bounds the whole exchange; zero means 30 seconds
+	Timeout time.Duration
+}
+
+// validSMTPTLS reports whether tls is a supported SMTPMailer.TLS setting
+func validSMTPTLS(tls string) bool {
+	switch tls {
+	case "", "starttls", "tls", "none":
+		return true
+	}
+	return false
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	if !validSMTPTLS(m.TLS) {
+		return fmt.Errorf("unsupported SMTP TLS setting %q", m.TLS)
+	}
+	msg = withFrom(msg, m.From)
+
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address %q: %w", msg.From, err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid to address %q: %w", msg.To, err)
+	}
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	port := m.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	if m.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting to SMTP server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	// Never fall back to cleartext; that takes an explicit "none"
+	if m.TLS == "starttls" || m.TLS == "" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s doesn't offer STARTTLS; set tls to \"tls\" or, to send in cleartext, \"none\"", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// FileMailer writes each message as an .eml file for development; open them
+// with any mail client
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg *Message) error {
+	msg = withFrom(msg, m.From)
+
+	body, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000"), hex.EncodeToString(suffix))
+	path := filepath.Join(m.Dir, name)
+
+	if err := os.WriteFile(path, body, 0o644); err != nil {
+		return err
+	}
+
+	slog.Info("mail written", "email", msg.To, "path", path)
+	return nil
+}
+
+// MemoryMailer keeps sent messages in memory so tests can inspect them
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	m.messages = append(m.messages, *msg)
+	m.mu.Unlock()
+	return nil
+}
+
+// Messages returns a copy of everything sent so far, oldest first
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// LastMessage returns the most recently sent message, or nil
+func (m *MemoryMailer) LastMessage() *Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.messages) == 0 {
+		return nil
+	}
+	msg := m.messages[len(m.messages)-1]
+	return &msg
+}
+
+// Reset forgets every message sent so far
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	m.messages = nil
+	m.mu.Unlock()
+}
+
+// LogMailer logs messages, text included, instead of sending them; it is
+// the fallback when no real transport is configured
+type LogMailer struct{}
+
+func (m *LogMailer) Send(msg *Message) error {
+	slog.Info("mail not sent, no transport configured",
+		"email", msg.To, "subject", msg.Subject, "text", msg.Text)
+	return nil
+}
@@ -0,0 +1,367 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"fresh/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcFlowTTL is how long a user has to finish signing in at the provider
+const oidcFlowTTL = 10 * time.Minute
+
+var (
+	ErrUnknownProvider = errors.New("unknown sign-in provider")
+	ErrInvalidOIDCFlow = errors.New("this sign-in attempt is invalid or has expired, please try again")
+	// ErrIdentityLinkRequired means the provider's email belongs to a local
+	// account that can't be linked automatically
+	ErrIdentityLinkRequired    = errors.New("an account with this email already exists; sign in with your password first to connect it")
+	ErrUnverifiedProviderEmail = errors.New("the provider did not confirm your email address")
+)
+
+// OIDCProviderInfo is what the login page needs to show a provider's button
+type OIDCProviderInfo struct {
+	Name        string
+	DisplayName string
+}
+
+// OIDCClaims are the ID token claims social login relies on
+type OIDCClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// oidcProvider is one configured provider. Discovery happens on first use,
+// so the app still starts when a provider is briefly unreachable.
+type oidcProvider struct {
+	config config.OIDCProviderConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider != nil {
+		return p.provider, nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", p.config.Name, err)
+	}
+
+	p.provider = provider
+	return provider, nil
+}
+
+// oidcFlow is sealed into a cookie while the user is away at the provider
+type oidcFlow struct {
+	Provider  string `json:"p"`
+	State     string `json:"s"`
+	Nonce     string `json:"n"`
+	Verifier  string `json:"v"`
+	ExpiresAt int64  `json:"e"`
+}
+
+// OIDCService signs users in with external OpenID Connect providers using
+// the authorization code flow with PKCE
+type OIDCService struct {
+	providers  map[string]*oidcProvider
+	order      []string
+	userRepo   *models.UserRepository
+	identities *models.UserIdentityRepository
+	flows      *sealer
+	baseURL    string
+}
+
+func NewOIDCService(cfg config.OIDCConfig, userRepo *models.UserRepository, identities *models.UserIdentityRepository, secretKeyBase, baseURL string) (*OIDCService, error) {
+	flows, err := newSealer(secretKeyBase, "oidc flow")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &OIDCService{
+		providers:  make(map[string]*oidcProvider),
+		userRepo:   userRepo,
+		identities: identities,
+		flows:      flows,
+		baseURL:    strings.TrimRight(baseURL, "/"),
+	}
+
+	for _, providerConfig := range cfg.Providers {
+		if providerConfig.Name == "" || providerConfig.Issuer == "" || providerConfig.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %q needs a name, issuer and client_id", providerConfig.Name)
+		}
+		if _, exists := s.providers[providerConfig.Name]; exists {
+			return nil, fmt.Errorf("oidc provider %q is configured twice", providerConfig.Name)
+		}
+		if providerConfig.DisplayName == "" {
+			providerConfig.DisplayName = providerConfig.Name
+		}
+
+		s.providers[providerConfig.Name] = &oidcProvider{config: providerConfig}
+		s.order = append(s.order, providerConfig.Name)
+	}
+
+	return s, nil
+}
+
+// Providers lists the configured providers in config order. It is safe to
+// call on a nil service.
+func (s *OIDCService) Providers() []OIDCProviderInfo {
+	if s == nil {
+		return nil
+	}
+
+	infos := make([]OIDCProviderInfo, 0, len(s.order))
+	for _, name := range s.order {
+		infos = append(infos, OIDCProviderInfo{
+			Name:        name,
+			DisplayName: s.providers[name].config.DisplayName,
+		})
+	}
+	return infos
+}
+
+// AuthCodeURL starts a sign-in: it returns the provider URL to redirect to
+// and the sealed flow state to keep in a cookie until the callback
+func (s *OIDCService) AuthCodeURL(ctx context.Context, name string) (string, string, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, err := generateToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	flow := oidcFlow{
+		Provider:  name,
+		State:     state,
+		Nonce:     nonce,
+		Verifier:  oauth2.GenerateVerifier(),
+		ExpiresAt: time.Now().Add(oidcFlowTTL).Unix(),
+	}
+
+	payload, err := json.Marshal(flow)
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := s.flows.Seal(payload)
+	if err != nil {
+		return "", "", err
+	}
+
+	authURL := s.oauth2Config(p, provider).AuthCodeURL(state,
+		oidc.Nonce(nonce),
+		oauth2.S256ChallengeOption(flow.Verifier),
+	)
+
+	return authURL, sealed, nil
+}
+
+// Exchange completes a sign-in: it checks the callback's state against the
+// sealed flow, redeems the code and verifies the ID token's signature,
+// issuer, audience, expiry and nonce
+func (s *OIDCService) Exchange(ctx context.Context, name, sealedFlow, state, code string) (*OIDCClaims, error) {
+	p, ok := s.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	flow, err := s.openFlow(sealedFlow)
+	if err != nil || flow.Provider != name ||
+		subtle.ConstantTimeCompare([]byte(flow.State), []byte(state)) != 1 {
+		return nil, ErrInvalidOIDCFlow
+	}
+
+	provider, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.oauth2Config(p, provider).Exchange(ctx, code, oauth2.VerifierOption(flow.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging authorization code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("provider returned no id_token")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: p.config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verifying id_token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(flow.Nonce)) != 1 {
+		return nil, errors.New("id_token nonce does not match")
+	}
+
+	var claims struct {
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+
+	return &OIDCClaims{
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified == true || claims.EmailVerified == "true",
+	}, nil
+}
+
+// ResolveUser finds or creates the local user for an external identity:
+//
+//  1. A known (provider, subject) signs in as the user it is linked to.
+//  2. A signed-in user following the flow links the identity to themselves.
+//  3. A provider-verified email matching a verified local account links to it.
+//     An unverified local account is refused: whoever registered it may not
+//     own the address.
+//  4. Otherwise a new, already verified account is created.
+func (s *OIDCService) ResolveUser(ctx context.Context, name string, claims *OIDCClaims, current *models.User) (*models.User, error) {
+	if _, ok := s.providers[name]; !ok {
+		return nil, ErrUnknownProvider
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+
+	identity, err := s.identities.WithContext(ctx).Find(name, claims.Subject)
+	if err != nil && !errors.Is(err, models.ErrIdentityNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		if current != nil && current.ID != identity.UserID {
+			return nil, errors.New("this account is already connected to a different user")
+		}
+		if err := s.identities.WithContext(ctx).RecordLogin(identity, claims.Email); err != nil {
+			return nil, err
+		}
+		user, err := s.userRepo.WithContext(ctx).FindByID(identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if user.Locked() {
+			return nil, ErrAccountLocked
+		}
+		return user, nil
+	}
+
+	if current != nil {
+		if _, err := s.identities.WithContext(ctx).Create(current.ID, name, claims.Subject, claims.Email); err != nil {
+			return nil, err
+		}
+		return current, nil
+	}
+
+	if claims.Email == "" {
+		return nil, errors.New("the provider did not share an email address")
+	}
+	if !claims.EmailVerified {
+		return nil, ErrUnverifiedProviderEmail
+	}
+
+	user, err := s.userRepo.WithContext(ctx).FindByEmail(claims.Email)
+	switch {
+	case err == nil:
+		if !user.EmailVerified() {
+			return nil, ErrIdentityLinkRequired
+		}
+		if user.Locked() {
+			return nil, ErrAccountLocked
+		}
+	case errors.Is(err, models.ErrUserNotFound):
+		user, err = s.createUser(ctx, claims.Email)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		// Creating an account here could duplicate one the lookup missed
+		return nil, err
+	}
+
+	if _, err := s.identities.WithContext(ctx).Create(user.ID, name, claims.Subject, claims.Email); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// createUser registers an account for someone who only signs in through a
+// provider. It gets an unguessable random password, which a password reset
+// can replace.
+func (s *OIDCService) createUser(ctx context.Context, email string) (*models.User, error) {
+	password, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.WithContext(ctx).Create(email, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.userRepo.WithContext(ctx).MarkEmailVerified(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *OIDCService) openFlow(sealed string) (*oidcFlow, error) {
+	payload, err := s.flows.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var flow oidcFlow
+	if err := json.Unmarshal(payload, &flow); err != nil {
+		return nil, ErrInvalidCiphertext
+	}
+	if time.Now().Unix() >= flow.ExpiresAt {
+		return nil, ErrInvalidOIDCFlow
+	}
+
+	return &flow, nil
+}
+
+func (s *OIDCService) oauth2Config(p *oidcProvider, provider *oidc.Provider) *oauth2.Config {
+	scopes := p.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  s.baseURL + "/auth/" + p.config.Name + "/callback",
+		Scopes:       scopes,
+	}
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"fresh/config"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore persists login sessions keyed by their opaque ID
+type SessionStore interface {
+	// Create starts a new session for the user that expires after ttl
+	Create(ctx context.Context, userID uint, ttl time.Duration) (*models.Session, error)
+	// Find returns the session with the given ID or ErrSessionNotFound
+	Find(ctx context.Context, id string) (*models.Session, error)
+	// Touch records activity on the session. Stores that keep their state
+	// in the ID itself may change session.ID, which must then be re-issued.
+	Touch(ctx context.Context, session *models.Session) error
+	// Delete removes the session; deleting an unknown ID is not an error
+	Delete(ctx context.Context, id string) error
+	// DeleteByUser removes every session belonging to the user
+	DeleteByUser(ctx context.Context, userID uint) error
+	// DeleteExpired garbage-collects sessions past their expiry time
+	DeleteExpired(ctx context.Context) error
+}
+
+// NewSessionStore builds the store backend selected in the session config
+func NewSessionStore(cfg config.SessionConfig, secretKeyBase string, db *gorm.DB) (SessionStore, error) {
+	switch cfg.Store {
+	case "database", "":
+		return NewDatabaseSessionStore(db), nil
+	case "memory":
+		return NewMemorySessionStore(), nil
+	case "cookie":
+		return NewCookieSessionStore(secretKeyBase)
+	default:
+		return nil, fmt.Errorf("unsupported session store: %s", cfg.Store)
+	}
+}
+
+// NewSessionConfig converts the YAML session settings into a SessionConfig
+func NewSessionConfig(cfg config.SessionConfig) (SessionConfig, error) {
+	sessionConfig := DefaultSessionConfig()
+	sessionConfig.Secure = cfg.Secure
+
+	if cfg.CookieName != "" {
+		sessionConfig.CookieName = cfg.CookieName
+	}
+
+	if cfg.Lifetime != "" {
+		lifetime, err := time.ParseDuration(cfg.Lifetime)
+		if err != nil {
+			return sessionConfig, fmt.Errorf("invalid session lifetime %q: %w", cfg.Lifetime, err)
+		}
+		sessionConfig.Lifetime = lifetime
+	}
+
+	return sessionConfig, nil
+}
+
+type DatabaseSessionStore struct {
+	db *gorm.DB
+}
+
+func NewDatabaseSessionStore(db *gorm.DB) *DatabaseSessionStore {
+	return &DatabaseSessionStore{db: db}
+}
+
+func (s *DatabaseSessionStore) Create(ctx context.Context, userID uint, ttl time.Duration) (*models.Session, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:         id,
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	if err := s.db.WithContext(ctx).Create(session).Error; err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (s *DatabaseSessionStore) Find(ctx context.Context, id string) (*models.Session, error) {
+	var session models.Session
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *DatabaseSessionStore) Touch(ctx context.Context, session *models.Session) error {
+	session.LastSeenAt = time.Now()
+	return s.db.WithContext(ctx).Model(&models.Session{}).
+		Where("id = ?", session.ID).
+		Update("last_seen_at", session.LastSeenAt).Error
+}
+
+func (s *DatabaseSessionStore) Delete(ctx context.Context, id string) error {
+	return s.db.WithContext(ctx).Where("id = ?", id).Delete(&models.Session{}).Error
+}
+
+func (s *DatabaseSessionStore) DeleteByUser(ctx context.Context, userID uint) error {
+	return s.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&models.Session{}).Error
+}
+
+func (s *DatabaseSessionStore) DeleteExpired(ctx context.Context) error {
+	return s.db.WithContext(ctx).Where("expires_at <= ?", time.Now()).Delete(&models.Session{}).Error
+}
+
+// generateToken returns 32 bytes of crypto/rand output, URL-safe encoded.
+// It is used for session IDs and other bearer secrets.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
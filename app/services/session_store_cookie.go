@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fresh/app/models"
+	"time"
+)
+
+// CookieSessionStore keeps no server-side state: the session itself is
+// encrypted and authenticated into the ID that travels in the cookie. There
+// are no database writes per request, at the cost that Delete can't revoke a
+// copy of the cookie taken before logout; it stays valid until it expires.
+type CookieSessionStore struct {
+	sealer *sealer
+}
+
+// cookieSessionPayload is the compact form of a session sealed into the cookie
+type cookieSessionPayload struct {
+	UserID     uint  `json:"u"`
+	CreatedAt  int64 `json:"c"`
+	LastSeenAt int64 `json:"l"`
+	ExpiresAt  int64 `json:"e"`
+}
+
+func NewCookieSessionStore(secretKeyBase string) (*CookieSessionStore, error) {
+	sealer, err := newSealer(secretKeyBase, "session cookie")
+	if err != nil {
+		return nil, err
+	}
+	return &CookieSessionStore{sealer: sealer}, nil
+}
+
+func (s *CookieSessionStore) Create(ctx context.Context, userID uint, ttl time.Duration) (*models.Session, error) {
+	now := time.Now()
+	session := &models.Session{
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	if err := s.seal(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *CookieSessionStore) Find(ctx context.Context, id string) (*models.Session, error) {
+	plaintext, err := s.sealer.Open(id)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	var payload cookieSessionPayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	return &models.Session{
+		ID:         id,
+		UserID:     payload.UserID,
+		CreatedAt:  time.Unix(payload.CreatedAt, 0),
+		LastSeenAt: time.Unix(payload.LastSeenAt, 0),
+		ExpiresAt:  time.Unix(payload.ExpiresAt, 0),
+	}, nil
+}
+
+// Touch re-seals the session with a new LastSeenAt, which changes its ID
+func (s *CookieSessionStore) Touch(ctx context.Context, session *models.Session) error {
+	session.LastSeenAt = time.Now()
+	return s.seal(session)
+}
+
+// Delete is a no-op; clearing the cookie is all that can be done
+func (s *CookieSessionStore) Delete(ctx context.Context, id string) error {
+	return nil
+}
+
+// DeleteByUser is a no-op; AuthService instead rejects sessions created
+// before the user's password last changed
+func (s *CookieSessionStore) DeleteByUser(ctx context.Context, userID uint) error {
+	return nil
+}
+
+// DeleteExpired is a no-op; expired cookies are rejected when read
+func (s *CookieSessionStore) DeleteExpired(ctx context.Context) error {
+	return nil
+}
+
+func (s *CookieSessionStore) seal(session *models.Session) error {
+	plaintext, err := json.Marshal(cookieSessionPayload{
+		UserID:     session.UserID,
+		CreatedAt:  session.CreatedAt.Unix(),
+		LastSeenAt: session.LastSeenAt.Unix(),
+		ExpiresAt:  session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	id, err := s.sealer.Seal(plaintext)
+	if err != nil {
+		return err
+	}
+
+	session.ID = id
+	return nil
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"fresh/app/models"
+	"sync"
+	"time"
+)
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost on
+// restart and aren't shared between nodes, which makes it a fit for tests
+// and single-process development.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]models.Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]models.Session),
+	}
+}
+
+func (s *MemorySessionStore) Create(ctx context.Context, userID uint, ttl time.Duration) (*models.Session, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		ID:         id,
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+
+	s.mu.Lock()
+	s.sessions[id] = session
+	s.mu.Unlock()
+
+	return &session, nil
+}
+
+func (s *MemorySessionStore) Find(ctx context.Context, id string) (*models.Session, error) {
+	s.mu.RLock()
+	session, exists := s.sessions[id]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (s *MemorySessionStore) Touch(ctx context.Context, session *models.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.sessions[session.ID]
+	if !exists {
+		return ErrSessionNotFound
+	}
+
+	session.LastSeenAt = time.Now()
+	stored.LastSeenAt = session.LastSeenAt
+	s.sessions[session.ID] = stored
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteByUser(ctx context.Context, userID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.Expired() {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
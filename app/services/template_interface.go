@@ -6,3 +6,8 @@ import "github.com/gofiber/fiber/v2"
 type TemplateRenderer interface {
 	Render(c *fiber.Ctx, templateName string, data interface{}) error
 }
+
+// MailRenderer renders email templates into messages ready to send
+type MailRenderer interface {
+	RenderMail(name string, data interface{}) (*Message, error)
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Reload parses the templates again and swaps them in at once. If they don't
+// parse, the current templates are kept and every page shows the error
+// instead until a reload succeeds; mail keeps using the current templates.
+func (ts *TemplateService) Reload() error {
+	ts.reloading.Lock()
+	defer ts.reloading.Unlock()
+
+	set, err := parseTemplates(ts.root)
+	if err != nil {
+		failed := *ts.set.Load()
+		failed.err = err
+		ts.set.Store(&failed)
+		return err
+	}
+
+	ts.set.Store(set)
+	return nil
+}
+
+// Watch reloads the templates whenever a file under the root is added,
+// changed or removed, checking every interval, until the returned stop
+// function is called. It polls rather than relying on file system events,
+// which editors' atomic saves and mounted volumes make unreliable. Meant for
+// development; production parses the templates once at startup.
+func (ts *TemplateService) Watch(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	last := ts.fingerprint()
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				current := ts.fingerprint()
+				if current == last {
+					continue
+				}
+				last = current
+
+				if err := ts.Reload(); err != nil {
+					slog.Error("templates failed to reload, keeping the previous ones", "error", err)
+				} else {
+					slog.Info("templates reloaded", "dir", ts.root)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// fingerprint hashes the path, size and modification time of every file
+// under the root, so any edit changes it
+func (ts *TemplateService) fingerprint() uint64 {
+	hash := fnv.New64a()
+	_ = filepath.WalkDir(ts.root, func(path string, d fs.DirEntry, err error) error {
+		// A file removed mid-walk shows up as changed on the next check
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return hash.Sum64()
+}
+
+// reloadErrorPage stands in for every page while the templates don't parse.
+// It uses none of them, since they are what's broken.
+var reloadErrorPage = template.Must(template.New("reload_error").Parse(`<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="UTF-8">
+    <title>Template error</title>
+  </head>
+  <body style="font-family: system-ui, sans-serif; margin: 2rem; color: #111827">
+    <h1 style="color: #b91c1c">Templates failed to reload</h1>
+    <p>Fix the template and refresh. Until then pages show this error.</p>
+    <pre style="background: #fef2f2; border: 1px solid #fecaca; padding: 1rem; white-space: pre-wrap">{{.}}</pre>
+  </body>
+</html>
+`))
+
+func renderReloadError(c *fiber.Ctx, err error) error {
+	c.Status(fiber.StatusInternalServerError)
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return reloadErrorPage.Execute(c.Response().BodyWriter(), err.Error())
+}
@@ -1,63 +1,433 @@
 package services
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"fresh/app/models"
+	"fresh/app/tracing"
 	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	texttemplate "text/template"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+const (
+	// CSRFTokenKey is the c.Locals key the CSRF middleware stores the token under
+	CSRFTokenKey = "csrf_token"
+	// CSRFCookieName holds the CSRF token. AuthService replaces it whenever a
+	// session starts or ends.
+	CSRFCookieName = "fresh_csrf"
+	// CSRFHeaderName carries the CSRF token: responses send it to API
+	// clients, which echo it back on state-changing requests
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// mailTemplate is one email: an HTML body wrapped in the mail layout and a
+// plain text body that also defines the subject
+type mailTemplate struct {
+	html *template.Template
+	text *texttemplate.Template
+}
+
+// templateSet is one parse of the template root. Reload swaps in a whole
+// new set, so a request renders entirely from the old templates or the new.
+type templateSet struct {
+	root  string
+	pages map[string]*pageTemplate
+	mail  map[string]*mailTemplate
+	// err is why the last reload failed, the templates being the last ones
+	// that parsed
+	err error
+}
+
 type TemplateService struct {
-	templates map[string]*template.Template
+	root string
+	set  atomic.Pointer[templateSet]
+	// reloading serializes Reload
+	reloading sync.Mutex
 }
 
 func NewTemplateService() (*TemplateService, error) {
-	ts := &TemplateService{
-		templates: make(map[string]*template.Template),
-	}
+	return NewTemplateServiceAt("web/templates")
+}
 
-	err := ts.parsePageTemplates()
+// NewTemplateServiceAt parses the templates under root instead of the
+// default web/templates
+func NewTemplateServiceAt(root string) (*TemplateService, error) {
+	set, err := parseTemplates(root)
 	if err != nil {
 		return nil, err
 	}
 
+	ts := &TemplateService{root: root}
+	ts.set.Store(set)
 	return ts, nil
 }
 
-func (ts *TemplateService) parsePageTemplates() error {
-	// Create separate template instances for each page to avoid conflicts
-	pages := []string{"login", "register", "dashboard"}
+// parseTemplates parses the page and mail templates under root
+func parseTemplates(root string) (*templateSet, error) {
+	set := &templateSet{
+		root:  root,
+		pages: make(map[string]*pageTemplate),
+		mail:  make(map[string]*mailTemplate),
+	}
+
+	if err := set.parsePageTemplates(); err != nil {
+		return nil, err
+	}
+	if err := set.parseMailTemplates(); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
 
-	for _, page := range pages {
-		// Create a new template instance for this page
-		t := template.New(page)
+// Directories under the template root that hold no pages
+var nonPageDirs = []string{"layouts", "partials", "mail"}
 
-		// Parse layout first
-		if _, err := t.ParseFiles("web/templates/layout.html"); err != nil {
-			return fmt.Errorf("parsing layout: %v", err)
+// layoutDirective is the comment a page starts with to pick a layout from
+// layouts/ instead of the nearest layout.html: {{/* layout: print */}}
+var layoutDirective = regexp.MustCompile(`^\s*\{\{-?\s*/\*\s*layout:\s*([\w/-]+)\s*\*/\s*-?\}\}`)
+
+// parsePageTemplates parses every .html file under the root as a page named
+// by its path without the extension, e.g. admin/users/index. Each page gets
+// its own template set holding its layout, the partials and the page, so
+// pages can all define "content" without conflicting.
+func (set *templateSet) parsePageTemplates() error {
+	partials, err := set.partialFiles()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	err = filepath.WalkDir(set.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
+		rel, err := filepath.Rel(set.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
 
-		// Parse the specific page template
-		pageFile := fmt.Sprintf("web/templates/%s.html", page)
-		if _, err := t.ParseFiles(pageFile); err != nil {
-			return fmt.Errorf("parsing %s: %v", pageFile, err)
+		if d.IsDir() {
+			if slices.Contains(nonPageDirs, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".html" || d.Name() == "layout.html" {
+			return nil
 		}
 
-		// Store this template instance
-		ts.templates[page] = t
+		// Keep going so every broken page is reported at once
+		t, err := set.parsePage(path, partials)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		set.pages[strings.TrimSuffix(rel, ".html")] = &pageTemplate{parsed: t}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
 	}
 
+	if len(set.pages) == 0 {
+		return fmt.Errorf("no page templates found in %s", set.root)
+	}
 	return nil
 }
 
-func (ts *TemplateService) Render(c *fiber.Ctx, templateName string, data interface{}) error {
-	t, exists := ts.templates[templateName]
+// parsePage parses the page at path with its layout and the partials
+func (set *templateSet) parsePage(path string, partials []string) (*template.Template, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := set.layoutFor(path, src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Request helpers are declared here and bound to a request by each
+	// boundPage. The page is parsed last so its definitions win.
+	t := template.New(path).Funcs(requestFuncs(func() *fiber.Ctx { return nil }))
+	for _, file := range partials {
+		if err := parseFile(t, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := parseFile(t, layout); err != nil {
+		return nil, err
+	}
+	if _, err := t.Parse(string(src)); err != nil {
+		return nil, templateError(err)
+	}
+
+	if t.Lookup("layout") == nil {
+		return nil, fmt.Errorf("%s: layout %s doesn't define \"layout\"", path, layout)
+	}
+	return t, nil
+}
+
+// pageTemplate is a parsed page and a pool of copies of it ready to render.
+// html/template escapes a template on its first execution, so the copies are
+// reused rather than cloned for each request.
+type pageTemplate struct {
+	parsed *template.Template
+	pool   sync.Pool
+}
+
+// boundPage is one copy of a page whose request helpers read c, the request
+// it is rendering
+type boundPage struct {
+	t *template.Template
+	c *fiber.Ctx
+}
+
+// get takes a copy of the page from the pool, or makes one
+func (p *pageTemplate) get() (*boundPage, error) {
+	if page, ok := p.pool.Get().(*boundPage); ok {
+		return page, nil
+	}
+
+	t, err := p.parsed.Clone()
+	if err != nil {
+		return nil, err
+	}
+	page := &boundPage{t: t}
+	t.Funcs(requestFuncs(func() *fiber.Ctx { return page.c }))
+	return page, nil
+}
+
+// put returns a copy to the pool once its request is done with it
+func (p *pageTemplate) put(page *boundPage) {
+	page.c = nil
+	p.pool.Put(page)
+}
+
+// layoutFor returns the layout the page at path names with a layout
+// directive, or else the layout.html nearest to it: admin pages use
+// admin/layout.html, everything else the root layout.html.
+func (set *templateSet) layoutFor(path string, src []byte) (string, error) {
+	if match := layoutDirective.FindSubmatch(src); match != nil {
+		layout := filepath.Join(set.root, "layouts", string(match[1])+".html")
+		if _, err := os.Stat(layout); err != nil {
+			line := 1 + bytes.Count(src[:len(match[0])], []byte("\n"))
+			return "", fmt.Errorf("%s:%d: layout %q not found: %v", path, line, match[1], err)
+		}
+		return layout, nil
+	}
+
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		layout := filepath.Join(dir, "layout.html")
+		if _, err := os.Stat(layout); err == nil {
+			return layout, nil
+		}
+		if rel, err := filepath.Rel(set.root, dir); err != nil || rel == "." {
+			return "", fmt.Errorf("%s: no layout.html in its directory or above", path)
+		}
+	}
+}
+
+// partialFiles lists the templates under partials/, which are parsed into
+// every page. Each one defines the named templates pages call.
+func (set *templateSet) partialFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(filepath.Join(set.root, "partials"), func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(path) == ".html" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// parseMailTemplates parses every mail/<name>.html other than the layout,
+// with the mail/<name>.txt next to it, as the mail named name
+func (set *templateSet) parseMailTemplates() error {
+	htmlFiles, err := filepath.Glob(filepath.Join(set.root, "mail", "*.html"))
+	if err != nil {
+		return err
+	}
+
+	for _, htmlFile := range htmlFiles {
+		name := strings.TrimSuffix(filepath.Base(htmlFile), ".html")
+		if name == "layout" {
+			continue
+		}
+
+		html := template.New(htmlFile)
+		for _, file := range []string{filepath.Join(set.root, "mail", "layout.html"), htmlFile} {
+			if err := parseFile(html, file); err != nil {
+				return err
+			}
+		}
+
+		textFile := filepath.Join(set.root, "mail", name+".txt")
+		src, err := os.ReadFile(textFile)
+		if err != nil {
+			return err
+		}
+		text, err := texttemplate.New(textFile).Parse(string(src))
+		if err != nil {
+			return templateError(err)
+		}
+		if text.Lookup("subject") == nil {
+			return fmt.Errorf("%s must define a \"subject\" template", textFile)
+		}
+
+		set.mail[name] = &mailTemplate{html: html, text: text}
+	}
+
+	return nil
+}
+
+// parseFile parses the file at path into t's set, naming the template after
+// the path so parse errors point at the file
+func parseFile(t *template.Template, path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if t.Name() != path {
+		t = t.New(path)
+	}
+	_, err = t.Parse(string(src))
+	return templateError(err)
+}
+
+// templateError turns "template: web/templates/login.html:12: ..." into
+// "web/templates/login.html:12: ...", templates being named after their file
+func templateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(strings.TrimPrefix(err.Error(), "template: "))
+}
+
+// Loaded reports whether the page and mail templates are parsed and ready,
+// for the readiness check. It fails while a reload is failing.
+func (ts *TemplateService) Loaded() error {
+	set := ts.set.Load()
+	if set.err != nil {
+		return set.err
+	}
+	if len(set.pages) == 0 || len(set.mail) == 0 {
+		return fmt.Errorf("no templates loaded from %s", ts.root)
+	}
+	return nil
+}
+
+func (ts *TemplateService) Render(c *fiber.Ctx, templateName string, data interface{}) (err error) {
+	_, span := tracing.Tracer().Start(c.UserContext(), "render "+templateName)
+	defer func() { tracing.End(span, err) }()
+
+	set := ts.set.Load()
+	if set.err != nil {
+		return renderReloadError(c, set.err)
+	}
+	p, exists := set.pages[templateName]
 	if !exists {
 		return fmt.Errorf("template %s not found", templateName)
 	}
 
+	// Each concurrent request renders its own copy, bound to that request
+	page, err := p.get()
+	if err != nil {
+		return err
+	}
+	page.c = c
+	defer p.put(page)
+
 	c.Set("Content-Type", "text/html")
 
 	// Execute the layout template (which will include the page content)
-	return t.ExecuteTemplate(c.Response().BodyWriter(), "layout", data)
+	return page.t.ExecuteTemplate(c.Response().BodyWriter(), "layout", data)
+}
+
+// RenderMail renders web/templates/mail/<name>.html and .txt into a message.
+// The text template's "subject" block becomes the subject line.
+func (ts *TemplateService) RenderMail(name string, data interface{}) (*Message, error) {
+	mt, exists := ts.set.Load().mail[name]
+	if !exists {
+		return nil, fmt.Errorf("mail template %s not found", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := mt.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := mt.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := mt.html.ExecuteTemplate(&html, "mail_layout", data); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// requestFuncs returns the template helpers that depend on the request
+// returned by request. At parse time it returns nil and they are placeholders.
+func requestFuncs(request func() *fiber.Ctx) template.FuncMap {
+	csrfToken := func() string {
+		c := request()
+		if c == nil {
+			return ""
+		}
+		token, _ := c.Locals(CSRFTokenKey).(string)
+		return token
+	}
+
+	// The signed-in user, if something earlier in the request looked it up.
+	// Roles come preloaded from UserRepository.
+	currentUser := func() *models.User {
+		c := request()
+		if c == nil {
+			return nil
+		}
+		user, _ := c.Locals(CurrentUserKey).(*models.User)
+		return user
+	}
+
+	return template.FuncMap{
+		// {{if can "users.manage"}} hides UI the user can't use
+		"can": func(permission string) bool {
+			user := currentUser()
+			return user != nil && user.HasPermission(permission)
+		},
+		"hasRole": func(role string) bool {
+			user := currentUser()
+			return user != nil && user.HasRole(role)
+		},
+		"csrfToken": csrfToken,
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="_csrf" value="%s">`,
+				template.HTMLEscapeString(csrfToken())))
+		},
+	}
 }
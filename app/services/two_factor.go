@@ -0,0 +1,333 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"html/template"
+	"math/big"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets per set
+const recoveryCodeCount = 10
+
+// secondFactorTTL is how long a user has to enter their code after the
+// password step
+const secondFactorTTL = 5 * time.Minute
+
+var (
+	ErrInvalidTwoFactorCode = errors.New("invalid authentication code")
+	ErrTwoFactorNotPending  = errors.New("two-factor setup has not been started")
+	ErrInvalidPassword      = errors.New("incorrect password")
+)
+
+// TOTPEnrollment is what a user needs to add the account to their
+// authenticator app
+type TOTPEnrollment struct {
+	// Secret is the base32 key for manual entry
+	Secret string
+	// URI is the otpauth:// URI encoded in the QR code
+	URI string
+	// QRCode is the URI rendered as an inline SVG
+	QRCode template.HTML
+}
+
+// TwoFactorService manages TOTP enrollment, recovery codes and second-factor
+// checks. TOTP secrets are encrypted at rest with a key derived from
+// secret_key_base.
+type TwoFactorService struct {
+	userRepo *models.UserRepository
+	codes    *models.RecoveryCodeRepository
+	secrets  *sealer
+	pending  *sealer
+	issuer   string
+}
+
+func NewTwoFactorService(userRepo *models.UserRepository, codes *models.RecoveryCodeRepository, secretKeyBase, issuer string) (*TwoFactorService, error) {
+	secrets, err := newSealer(secretKeyBase, "totp secret")
+	if err != nil {
+		return nil, err
+	}
+	pending, err := newSealer(secretKeyBase, "pending second factor")
+	if err != nil {
+		return nil, err
+	}
+	if issuer == "" {
+		issuer = "Fresh"
+	}
+
+	return &TwoFactorService{
+		userRepo: userRepo,
+		codes:    codes,
+		secrets:  secrets,
+		pending:  pending,
+		issuer:   issuer,
+	}, nil
+}
+
+// BeginEnrollment generates a new secret for the user and stores it
+// encrypted. 2FA isn't enforced until ConfirmEnrollment succeeds.
+func (s *TwoFactorService) BeginEnrollment(ctx context.Context, user *models.User) (*TOTPEnrollment, error) {
+	if user.TwoFactorEnabled() {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := s.secrets.Seal(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	user.TOTPSecret = sealed
+	user.TOTPLastStep = 0
+	if err := s.userRepo.WithContext(ctx).UpdateTOTP(user); err != nil {
+		return nil, err
+	}
+
+	return s.enrollment(user, secret)
+}
+
+// PendingEnrollment returns the enrollment started by BeginEnrollment, so
+// the setup page can be shown again
+func (s *TwoFactorService) PendingEnrollment(user *models.User) (*TOTPEnrollment, error) {
+	if user.TwoFactorEnabled() || user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotPending
+	}
+
+	secret, err := s.secrets.Open(user.TOTPSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.enrollment(user, secret)
+}
+
+// ConfirmEnrollment turns 2FA on once the user proves their app produces
+// valid codes, and returns their first set of recovery codes
+func (s *TwoFactorService) ConfirmEnrollment(ctx context.Context, user *models.User, code string) ([]string, error) {
+	if user.TwoFactorEnabled() || user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotPending
+	}
+
+	if err := s.checkTOTP(ctx, user, code); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+	if err := s.userRepo.WithContext(ctx).UpdateTOTP(user); err != nil {
+		return nil, err
+	}
+
+	return s.replaceRecoveryCodes(ctx, user)
+}
+
+// Verify checks a second-factor code, which is either a current TOTP code
+// or an unused recovery code
+func (s *TwoFactorService) Verify(ctx context.Context, user *models.User, code string) error {
+	if !user.TwoFactorEnabled() {
+		return errors.New("two-factor authentication is not enabled")
+	}
+
+	code = strings.TrimSpace(code)
+	if len(strings.ReplaceAll(code, " ", "")) == totpDigits {
+		return s.checkTOTP(ctx, user, code)
+	}
+
+	used, err := s.codes.WithContext(ctx).Consume(user.ID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// Disable turns 2FA off. Callers re-check the user's password first with
+// AuthService.ConfirmPassword.
+func (s *TwoFactorService) Disable(ctx context.Context, user *models.User) error {
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	if err := s.userRepo.WithContext(ctx).UpdateTOTP(user); err != nil {
+		return err
+	}
+
+	return s.codes.WithContext(ctx).DeleteByUser(user.ID)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes. Callers
+// re-check the user's password first with AuthService.ConfirmPassword.
+func (s *TwoFactorService) RegenerateRecoveryCodes(ctx context.Context, user *models.User) ([]string, error) {
+	if !user.TwoFactorEnabled() {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+
+	return s.replaceRecoveryCodes(ctx, user)
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes the user has
+func (s *TwoFactorService) RemainingRecoveryCodes(ctx context.Context, user *models.User) (int64, error) {
+	return s.codes.WithContext(ctx).CountUnused(user.ID)
+}
+
+func (s *TwoFactorService) checkTOTP(ctx context.Context, user *models.User, code string) error {
+	secret, err := s.secrets.Open(user.TOTPSecret)
+	if err != nil {
+		return err
+	}
+
+	step, ok := validateTOTP(secret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+
+	advanced, err := s.userRepo.WithContext(ctx).AdvanceTOTPStep(user, step)
+	if err != nil {
+		return err
+	}
+	if !advanced {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+func (s *TwoFactorService) enrollment(user *models.User, secret []byte) (*TOTPEnrollment, error) {
+	uri := totpURI(s.issuer, user.Email, secret)
+
+	svg, err := qrCodeSVG(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret: totpEncoding.EncodeToString(secret),
+		URI:    uri,
+		QRCode: svg,
+	}, nil
+}
+
+func (s *TwoFactorService) replaceRecoveryCodes(ctx context.Context, user *models.User) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+
+	if err := s.codes.WithContext(ctx).Replace(user.ID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// pendingSecondFactor is sealed into a short-lived cookie between the
+// password step and the code step of a login. It is not a session: it
+// grants nothing but the right to submit a code.
+type pendingSecondFactor struct {
+	UserID    uint  `json:"u"`
+	ExpiresAt int64 `json:"e"`
+}
+
+func (s *TwoFactorService) sealPending(userID uint) (string, time.Time, error) {
+	expiresAt := time.Now().Add(secondFactorTTL)
+
+	payload, err := json.Marshal(pendingSecondFactor{UserID: userID, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	sealed, err := s.pending.Seal(payload)
+	return sealed, expiresAt, err
+}
+
+func (s *TwoFactorService) openPending(value string) (uint, error) {
+	payload, err := s.pending.Open(value)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending pendingSecondFactor
+	if err := json.Unmarshal(payload, &pending); err != nil {
+		return 0, ErrInvalidCiphertext
+	}
+	if time.Now().Unix() >= pending.ExpiresAt {
+		return 0, errors.New("second factor step expired")
+	}
+
+	return pending.UserID, nil
+}
+
+// recoveryCodeAlphabet avoids characters that are easy to misread
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// generateRecoveryCode returns a code like "k3m9x-4tq7p"
+func generateRecoveryCode() (string, error) {
+	// rand.Int draws uniformly; a byte modulo the 31 letters would favour some
+	alphabetSize := big.NewInt(int64(len(recoveryCodeAlphabet)))
+
+	code := make([]byte, 0, 11)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", err
+		}
+		code = append(code, recoveryCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// normalizeRecoveryCode makes code entry forgiving about case, spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// qrCodeSVG renders content as a QR code in an inline SVG, so the secret is
+// never sent to a third-party QR service
+func qrCodeSVG(content string) (template.HTML, error) {
+	qr, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return "", err
+	}
+
+	bitmap := qr.Bitmap()
+	size := len(bitmap)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" width="200" height="200" shape-rendering="crispEdges" role="img" aria-label="QR code">`, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#ffffff"/>`, size, size)
+	buf.WriteString(`<path fill="#000000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+
+	return template.HTML(buf.String()), nil
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"slices"
+)
+
+// ErrCannotModifySelf stops administrators from locking, deleting or
+// demoting their own account
+var ErrCannotModifySelf = errors.New("you can't do that to your own account")
+
+// UnknownRoleError is returned when asked to assign a role that doesn't exist
+type UnknownRoleError struct {
+	Name string
+}
+
+func (e *UnknownRoleError) Error() string {
+	return fmt.Sprintf("there is no role named %q", e.Name)
+}
+
+// UserAdminService backs the admin area's user management. Methods that
+// change an account take the acting administrator so they can refuse
+// actions that would lock them out.
+type UserAdminService struct {
+	userRepo    *models.UserRepository
+	roleRepo    *models.RoleRepository
+	sessions    SessionStore
+	authService *AuthService
+}
+
+func NewUserAdminService(userRepo *models.UserRepository, roleRepo *models.RoleRepository, sessions SessionStore, authService *AuthService) *UserAdminService {
+	return &UserAdminService{
+		userRepo:    userRepo,
+		roleRepo:    roleRepo,
+		sessions:    sessions,
+		authService: authService,
+	}
+}
+
+// List returns a page of users matching the options
+func (s *UserAdminService) List(ctx context.Context, opts models.UserListOptions) (*models.UserPage, error) {
+	return s.userRepo.WithContext(ctx).List(opts)
+}
+
+// Find returns the user with their roles
+func (s *UserAdminService) Find(ctx context.Context, id uint) (*models.User, error) {
+	return s.userRepo.WithContext(ctx).FindByID(id)
+}
+
+// Roles returns every role that can be assigned
+func (s *UserAdminService) Roles(ctx context.Context) ([]models.Role, error) {
+	return s.roleRepo.WithContext(ctx).All()
+}
+
+// Lock stops the user from signing in and ends their sessions
+func (s *UserAdminService) Lock(ctx context.Context, actor, user *models.User) error {
+	if actor.ID == user.ID {
+		return ErrCannotModifySelf
+	}
+	if err := s.userRepo.WithContext(ctx).SetLocked(user, true); err != nil {
+		return err
+	}
+	return s.sessions.DeleteByUser(ctx, user.ID)
+}
+
+// Unlock lifts an admin lock and any lockout from failed logins
+func (s *UserAdminService) Unlock(ctx context.Context, user *models.User) error {
+	return s.userRepo.WithContext(ctx).SetLocked(user, false)
+}
+
+// ForcePasswordReset makes the user choose a new password from an emailed link
+func (s *UserAdminService) ForcePasswordReset(ctx context.Context, user *models.User) error {
+	return s.authService.ForcePasswordReset(ctx, user)
+}
+
+// SetRoles replaces the user's roles. Administrators can't take their own
+// admin role away, and nobody can give themselves a role they don't hold. A
+// name that isn't a role is an *UnknownRoleError.
+func (s *UserAdminService) SetRoles(ctx context.Context, actor, user *models.User, names []string) error {
+	roles, err := s.roleRepo.WithContext(ctx).All()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(roles, func(role models.Role) bool { return role.Name == name }) {
+			return &UnknownRoleError{Name: name}
+		}
+	}
+
+	if actor.ID == user.ID {
+		if user.HasRole(models.RoleAdmin) && !containsString(names, models.RoleAdmin) {
+			return ErrCannotModifySelf
+		}
+		for _, name := range names {
+			if !user.HasRole(name) {
+				return ErrCannotModifySelf
+			}
+		}
+	}
+	return s.roleRepo.WithContext(ctx).SetRoles(user, names)
+}
+
+// Delete removes the account and everything that belongs to it
+func (s *UserAdminService) Delete(ctx context.Context, actor, user *models.User) error {
+	if actor.ID == user.ID {
+		return ErrCannotModifySelf
+	}
+	// Stores outside the database keep their own sessions
+	if err := s.sessions.DeleteByUser(ctx, user.ID); err != nil {
+		return err
+	}
+	return s.userRepo.WithContext(ctx).Delete(user)
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// gormSpanKey holds a statement's span between the before and after
+// callbacks
+const gormSpanKey = "tracing:span"
+
+// InstrumentGORM adds a client span around every statement db runs. Only
+// statements run with a traced context, db.WithContext(c.UserContext()), are
+// recorded, so startup migrations and background jobs don't each start a
+// trace of their own. The span carries the SQL with its placeholders, never
+// the bound values.
+func InstrumentGORM(db *gorm.DB) error {
+	system := db.Dialector.Name()
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", startStatement(system, "INSERT")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", endStatement),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", startStatement(system, "SELECT")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", endStatement),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", startStatement(system, "UPDATE")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", endStatement),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", startStatement(system, "DELETE")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", endStatement),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", startStatement(system, "SELECT")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", endStatement),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", startStatement(system, "")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", endStatement),
+	)
+}
+
+func startStatement(system, operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		parent := trace.SpanFromContext(db.Statement.Context)
+		if !parent.SpanContext().IsValid() {
+			return
+		}
+
+		name := operation
+		if name == "" {
+			name = "SQL"
+		}
+		if db.Statement.Table != "" {
+			name += " " + db.Statement.Table
+		}
+
+		ctx, span := Tracer().Start(db.Statement.Context, name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemKey.String(system)),
+		)
+		if db.Statement.Table != "" {
+			span.SetAttributes(semconv.DBCollectionName(db.Statement.Table))
+		}
+		db.Statement.Context = ctx
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func endStatement(db *gorm.DB) {
+	value, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	defer span.End()
+
+	span.SetAttributes(
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if err := db.Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
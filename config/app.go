@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SessionConfig selects and tunes the session store backend
+type SessionConfig struct {
+	Store      string `yaml:"store"` // database, memory or cookie
+	CookieName string `yaml:"cookie_name"`
+	Lifetime   string `yaml:"lifetime"`
+	Secure     bool   `yaml:"secure"`
+	GCInterval string `yaml:"gc_interval"`
+}
+
+// RateLimitConfig sets the sliding-window login limits
+type RateLimitConfig struct {
+	Store       string `yaml:"store"` // memory or database
+	Window      string `yaml:"window"`
+	MaxPerIP    int    `yaml:"max_per_ip"`
+	MaxPerEmail int    `yaml:"max_per_email"`
+}
+
+// LockoutConfig sets when repeated failures lock an account
+type LockoutConfig struct {
+	Threshold int    `yaml:"threshold"`
+	Duration  string `yaml:"duration"`
+}
+
+// VerificationConfig sets how long verification links last and how often
+// they can be resent
+type VerificationConfig struct {
+	TTL          string `yaml:"ttl"`
+	ResendWindow string `yaml:"resend_window"`
+	MaxResends   int    `yaml:"max_resends"`
+}
+
+// TwoFactorConfig sets how the app appears in authenticator apps
+type TwoFactorConfig struct {
+	Issuer string `yaml:"issuer"`
+}
+
+// AuthConfig groups the login protection and account verification settings
+type AuthConfig struct {
+	RateLimit    RateLimitConfig    `yaml:"rate_limit"`
+	Lockout      LockoutConfig      `yaml:"lockout"`
+	Verification VerificationConfig `yaml:"verification"`
+	TwoFactor    TwoFactorConfig    `yaml:"two_factor"`
+}
+
+// SMTPConfig holds the relay settings for the smtp mail transport
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	TLS      string `yaml:"tls"` // starttls, tls or none
+}
+
+// MailConfig selects how outgoing email is delivered
+type MailConfig struct {
+	Transport string     `yaml:"transport"` // smtp, file, memory or log
+	From      string     `yaml:"from"`
+	Dir       string     `yaml:"dir"` // where the file transport writes .eml files
+	SMTP      SMTPConfig `yaml:"smtp"`
+}
+
+// OIDCProviderConfig registers one OpenID Connect provider for social login.
+// Endpoints and signing keys are discovered from the issuer.
+type OIDCProviderConfig struct {
+	Name         string   `yaml:"name"` // used in /auth/<name> URLs
+	DisplayName  string   `yaml:"display_name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// OIDCConfig lists the social login providers
+type OIDCConfig struct {
+	Providers []OIDCProviderConfig `yaml:"providers"`
+}
+
+// ServerConfig tunes the HTTP server
+type ServerConfig struct {
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGTERM or SIGINT
+	ShutdownTimeout string `yaml:"shutdown_timeout"`
+	// DrainDelay is how long the server keeps accepting requests after the
+	// signal, with /readyz failing, before it stops listening
+	DrainDelay string `yaml:"drain_delay"`
+}
+
+// LogConfig selects the log format and the lowest level written
+type LogConfig struct {
+	Format string `yaml:"format"` // text or json
+	Level  string `yaml:"level"`  // debug, info, warn or error
+}
+
+// MetricsConfig controls the Prometheus /metrics endpoint. In production it
+// needs a token, a separate listen address or both.
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Token, when set, must be sent as "Authorization: Bearer <token>"
+	Token string `yaml:"token"`
+	// Listen serves /metrics on its own address, such as 127.0.0.1:9090,
+	// instead of the app's port
+	Listen string `yaml:"listen"`
+}
+
+// TracingConfig selects where OpenTelemetry spans are exported
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"` // none, otlp, stdout or file
+	// Endpoint is the OTLP/HTTP collector URL, such as http://localhost:4318
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers"`
+	// File is where the file exporter writes spans, one JSON object a line
+	File        string `yaml:"file"`
+	ServiceName string `yaml:"service_name"`
+	// SampleRatio is the share of new traces recorded, above 0 and up to 1;
+	// requests arriving with a sampled traceparent are always recorded
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// TemplatesConfig controls reloading web/templates while the server runs, a
+// development aid
+type TemplatesConfig struct {
+	// Reload re-parses the templates when a file changes instead of only at
+	// startup. It isn't allowed in production.
+	Reload bool `yaml:"reload"`
+	// PollInterval is how often the templates are checked for changes
+	PollInterval string `yaml:"poll_interval"`
+}
+
+// AppConfig holds application settings for a single environment
+type AppConfig struct {
+	// BaseURL is the public URL links in emails point to
+	BaseURL       string          `yaml:"base_url"`
+	SecretKeyBase string          `yaml:"secret_key_base"`
+	Server        ServerConfig    `yaml:"server"`
+	Log           LogConfig       `yaml:"log"`
+	Session       SessionConfig   `yaml:"session"`
+	Auth          AuthConfig      `yaml:"auth"`
+	Mail          MailConfig      `yaml:"mail"`
+	OIDC          OIDCConfig      `yaml:"oidc"`
+	Metrics       MetricsConfig   `yaml:"metrics"`
+	Tracing       TracingConfig   `yaml:"tracing"`
+	Templates     TemplatesConfig `yaml:"templates"`
+}
+
+// LoadAppConfig loads the application settings for env from a YAML file
+// keyed by environment, the same layout as database.yml
+func LoadAppConfig(configPath, env string) (*AppConfig, error) {
+	content, err := readConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	environments := make(map[string]AppConfig)
+	if err := yaml.Unmarshal(content, &environments); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if env == "" {
+		env = GetEnvironment()
+	}
+
+	appConfig, exists := environments[env]
+	if !exists {
+		return nil, fmt.Errorf("app configuration for environment '%s' not found", env)
+	}
+
+	appConfig.applyDefaults()
+	return &appConfig, nil
+}
+
+func (c *AppConfig) applyDefaults() {
+	if c.BaseURL == "" {
+		c.BaseURL = "http://localhost:3000"
+	}
+	if c.Server.ShutdownTimeout == "" {
+		c.Server.ShutdownTimeout = "25s"
+	}
+	if c.Server.DrainDelay == "" {
+		c.Server.DrainDelay = "0s"
+	}
+	if c.Log.Format == "" {
+		c.Log.Format = "text"
+	}
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	if c.Tracing.Exporter == "" {
+		c.Tracing.Exporter = "none"
+	}
+	if c.Tracing.Endpoint == "" {
+		c.Tracing.Endpoint = "http://localhost:4318"
+	}
+	if c.Tracing.File == "" {
+		c.Tracing.File = "tmp/traces.jsonl"
+	}
+	if c.Tracing.ServiceName == "" {
+		c.Tracing.ServiceName = "fresh"
+	}
+	if c.Tracing.SampleRatio == 0 {
+		c.Tracing.SampleRatio = 1
+	}
+	if c.Templates.PollInterval == "" {
+		c.Templates.PollInterval = "500ms"
+	}
+	if c.Session.Store == "" {
+		c.Session.Store = "database"
+	}
+	if c.Session.CookieName == "" {
+		c.Session.CookieName = "fresh_session"
+	}
+	if c.Session.Lifetime == "" {
+		c.Session.Lifetime = "336h"
+	}
+	if c.Session.GCInterval == "" {
+		c.Session.GCInterval = "10m"
+	}
+	if c.Auth.RateLimit.Store == "" {
+		c.Auth.RateLimit.Store = "memory"
+	}
+	if c.Auth.TwoFactor.Issuer == "" {
+		c.Auth.TwoFactor.Issuer = "Fresh"
+	}
+	if c.Mail.Transport == "" {
+		c.Mail.Transport = "log"
+	}
+	if c.Mail.From == "" {
+		c.Mail.From = "Fresh <no-reply@localhost>"
+	}
+	if c.Mail.Dir == "" {
+		c.Mail.Dir = "tmp/mail"
+	}
+}
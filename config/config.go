@@ -2,18 +2,25 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
+// DatabaseConfig is one environment's entry in database.yml. When URL is set
+// it is parsed into the adapter, host, port, credentials, database and
+// options, which take precedence over the discrete fields.
 type DatabaseConfig struct {
+	URL             string `yaml:"url"`
 	Adapter         string `yaml:"adapter"`
 	Host            string `yaml:"host"`
 	Port            int    `yaml:"port"`
@@ -24,6 +31,12 @@ type DatabaseConfig struct {
 	MaxOpenConns    int    `yaml:"max_open_conns"`
 	MaxIdleConns    int    `yaml:"max_idle_conns"`
 	ConnMaxLifetime string `yaml:"conn_max_lifetime"`
+	// Options are extra driver parameters, such as tls for MySQL or
+	// application_name for PostgreSQL
+	Options map[string]string `yaml:"options"`
+	// Pragmas override the default SQLite pragmas (journal_mode, busy_timeout,
+	// foreign_keys); other adapters ignore them
+	Pragmas map[string]string `yaml:"pragmas"`
 }
 
 type Config struct {
@@ -36,6 +49,25 @@ var (
 
 // LoadConfig loads configuration from YAML file with environment variable substitution
 func LoadConfig(configPath string) (*Config, error) {
+	content, err := readConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	config.Database = make(map[string]DatabaseConfig)
+
+	// Unmarshal directly into the Database map
+	if err := yaml.Unmarshal(content, &config.Database); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return &config, nil
+}
+
+// readConfigFile reads a YAML file and substitutes ${VAR} and ${VAR:default}
+// references with values from the environment
+func readConfigFile(configPath string) ([]byte, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
@@ -60,15 +92,7 @@ func LoadConfig(configPath string) (*Config, error) {
 		return defaultValue
 	})
 
-	var config Config
-	config.Database = make(map[string]DatabaseConfig)
-
-	// Unmarshal directly into the Database map
-	if err := yaml.Unmarshal([]byte(content), &config.Database); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
-	}
-
-	return &config, nil
+	return []byte(content), nil
 }
 
 // GetEnvironment returns the current environment (development, test, production)
@@ -83,7 +107,8 @@ func GetEnvironment() string {
 	return env
 }
 
-// GetDatabaseConfig returns the database configuration for the current environment
+// GetDatabaseConfig returns the database configuration for the current
+// environment, with its url applied and its fields checked
 func (c *Config) GetDatabaseConfig(env string) (*DatabaseConfig, error) {
 	if env == "" {
 		env = GetEnvironment()
@@ -93,6 +118,9 @@ func (c *Config) GetDatabaseConfig(env string) (*DatabaseConfig, error) {
 	if !exists {
 		return nil, fmt.Errorf("database configuration for environment '%s' not found", env)
 	}
+	if err := dbConfig.prepare(); err != nil {
+		return nil, fmt.Errorf("database configuration for environment '%s': %w", env, err)
+	}
 
 	return &dbConfig, nil
 }
@@ -103,27 +131,30 @@ func (c *Config) ConnectDatabase(env string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return dbConfig.Connect(env)
+}
 
-	var dialector gorm.Dialector
-
-	switch dbConfig.Adapter {
-	case "postgres", "postgresql":
-		dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
-			dbConfig.Host, dbConfig.Username, dbConfig.Password, dbConfig.Database, dbConfig.Port, dbConfig.SSLMode)
-		dialector = postgres.Open(dsn)
-
-	default:
-		return nil, fmt.Errorf("unsupported database adapter: %s", dbConfig.Adapter)
+// Connect opens the configured database and sets up the connection pool
+func (d *DatabaseConfig) Connect(env string) (*gorm.DB, error) {
+	if env == "" {
+		env = GetEnvironment()
+	}
+	if err := d.prepare(); err != nil {
+		return nil, err
+	}
+	dialector, err := d.dialector(d.Database)
+	if err != nil {
+		return nil, err
 	}
 
-	// Configure GORM logger based on environment
+	// Statements are logged in development, through slog
 	logLevel := logger.Silent
 	if env == "development" {
 		logLevel = logger.Info
 	}
 
 	db, err := gorm.Open(dialector, &gorm.Config{
-		Logger: logger.Default.LogMode(logLevel),
+		Logger: newGormLogger(logLevel),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
@@ -135,23 +166,68 @@ func (c *Config) ConnectDatabase(env string) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to get underlying sql.DB: %w", err)
 	}
 
-	if dbConfig.MaxOpenConns > 0 {
-		sqlDB.SetMaxOpenConns(dbConfig.MaxOpenConns)
+	if d.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(d.MaxOpenConns)
+	}
+	if d.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(d.MaxIdleConns)
 	}
-	if dbConfig.MaxIdleConns > 0 {
-		sqlDB.SetMaxIdleConns(dbConfig.MaxIdleConns)
+	if d.ConnMaxLifetime != "" {
+		// Checked by prepare
+		duration, _ := time.ParseDuration(d.ConnMaxLifetime)
+		sqlDB.SetConnMaxLifetime(duration)
 	}
 
-	// Parse duration string
-	if dbConfig.ConnMaxLifetime != "" {
-		duration, err := time.ParseDuration(dbConfig.ConnMaxLifetime)
-		if err == nil {
-			sqlDB.SetConnMaxLifetime(duration)
-		}
+	// An in-memory database only exists on the connection that created it
+	if d.Adapter == AdapterSQLite && d.sqliteInMemory() {
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.SetMaxIdleConns(1)
+		sqlDB.SetConnMaxLifetime(0)
 	}
 
-	fmt.Printf("Connected to %s database '%s' in %s environment\n",
-		dbConfig.Adapter, dbConfig.Database, env)
+	slog.Info("connected to database", "adapter", d.Adapter, "database", d.Database, "environment", env)
 
 	return db, nil
 }
+
+// DSN returns the driver's connection string for the configured database.
+// It contains the password.
+func (d *DatabaseConfig) DSN() (string, error) {
+	if err := d.prepare(); err != nil {
+		return "", err
+	}
+	return d.dsn(d.Database)
+}
+
+// dsn builds the connection string for the named database on the
+// configured server
+func (d *DatabaseConfig) dsn(database string) (string, error) {
+	switch d.Adapter {
+	case AdapterPostgres:
+		return d.postgresDSN(database), nil
+	case AdapterMySQL:
+		return d.mysqlDSN(database)
+	case AdapterSQLite:
+		return d.sqliteDSN(), nil
+	default:
+		return "", unsupportedAdapter(d.Adapter)
+	}
+}
+
+// dialector returns the GORM dialector for the named database on the
+// configured server
+func (d *DatabaseConfig) dialector(database string) (gorm.Dialector, error) {
+	dsn, err := d.dsn(database)
+	if err != nil {
+		return nil, err
+	}
+
+	switch d.Adapter {
+	case AdapterPostgres:
+		return postgres.Open(dsn), nil
+	case AdapterMySQL:
+		return mysql.Open(dsn), nil
+	default:
+		return sqlite.Open(dsn), nil
+	}
+}
@@ -1,34 +1,28 @@
 package config
 
 import (
-	"fresh/app/models"
-	"log"
+	"fresh/db/migrations"
+	"log/slog"
 
 	"gorm.io/gorm"
 )
 
-// InitDatabase initializes the database using the configuration system
-func InitDatabase() *gorm.DB {
-	// Load configuration
-	config, err := LoadConfig("config/database.yml")
+// MigrateDatabase applies every pending migration. Processes booting at the
+// same time wait for each other, so only one of them does the work.
+func MigrateDatabase(db *gorm.DB) error {
+	migrator, err := migrations.NewMigrator(db)
 	if err != nil {
-		log.Fatalf("Failed to load database config: %v", err)
+		return err
 	}
 
-	// Connect to database
-	db, err := config.ConnectDatabase("")
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	applied, err := migrator.Up()
+	for _, migration := range applied {
+		slog.Info("applied migration", "migration", migration)
 	}
-
-	// Auto migrate the schema (this will add new columns but not drop existing data)
-	err = db.AutoMigrate(&models.User{})
 	if err != nil {
-		log.Printf("Database migration failed: %v", err)
-		log.Println("If you're getting constraint errors, you may need to manually fix the schema or reset the database with 'make db-reset'")
-		log.Fatalf("Migration error: %v", err)
+		return err
 	}
 
-	log.Println("Database migration completed")
-	return db
+	slog.Info("database schema is up to date", "applied", len(applied))
+	return nil
 }
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+)
+
+// The database adapters. Aliases in database.yml and URL schemes are
+// normalized to these.
+const (
+	AdapterPostgres = "postgres"
+	AdapterMySQL    = "mysql"
+	AdapterSQLite   = "sqlite3"
+)
+
+var adapterAliases = map[string]string{
+	"postgres":   AdapterPostgres,
+	"postgresql": AdapterPostgres,
+	"mysql":      AdapterMySQL,
+	"mariadb":    AdapterMySQL,
+	"sqlite3":    AdapterSQLite,
+	"sqlite":     AdapterSQLite,
+}
+
+// defaultPorts are used when database.yml or the URL leaves the port out
+var defaultPorts = map[string]int{
+	AdapterPostgres: 5432,
+	AdapterMySQL:    3306,
+}
+
+var postgresSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// FieldError is a database setting that is missing or invalid. Field is its
+// key in database.yml.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+func unsupportedAdapter(adapter string) error {
+	return &FieldError{Field: "adapter", Message: fmt.Sprintf("unsupported database adapter %q", adapter)}
+}
+
+// prepare applies the url over the discrete fields, normalizes the adapter
+// and checks the result. Running it again changes nothing.
+func (d *DatabaseConfig) prepare() error {
+	if d.URL != "" {
+		if err := d.applyURL(); err != nil {
+			return err
+		}
+	}
+
+	if d.Adapter == "" {
+		return &FieldError{Field: "adapter", Message: "is required"}
+	}
+	adapter, ok := adapterAliases[d.Adapter]
+	if !ok {
+		return unsupportedAdapter(d.Adapter)
+	}
+	d.Adapter = adapter
+
+	switch adapter {
+	case AdapterPostgres, AdapterMySQL:
+		if d.Host == "" {
+			return &FieldError{Field: "host", Message: "is required"}
+		}
+		if d.Port == 0 {
+			d.Port = defaultPorts[adapter]
+		}
+		if d.Port < 1 || d.Port > 65535 {
+			return &FieldError{Field: "port", Message: fmt.Sprintf("%d is not between 1 and 65535", d.Port)}
+		}
+		if d.Database == "" {
+			return &FieldError{Field: "database", Message: "is required"}
+		}
+		if adapter == AdapterPostgres && d.SSLMode != "" && !contains(postgresSSLModes, d.SSLMode) {
+			return &FieldError{Field: "sslmode", Message: fmt.Sprintf("%q is not one of %s", d.SSLMode, strings.Join(postgresSSLModes, ", "))}
+		}
+
+	case AdapterSQLite:
+		if d.Database == "" {
+			return &FieldError{Field: "database", Message: "is required; for sqlite3 it is the path of the database file"}
+		}
+		for name := range d.Pragmas {
+			if !sqlitePragmas[name] {
+				return &FieldError{Field: "pragmas", Message: fmt.Sprintf("unsupported sqlite pragma %q", name)}
+			}
+		}
+	}
+
+	if d.MaxOpenConns < 0 {
+		return &FieldError{Field: "max_open_conns", Message: "can't be negative"}
+	}
+	if d.MaxIdleConns < 0 {
+		return &FieldError{Field: "max_idle_conns", Message: "can't be negative"}
+	}
+	if d.ConnMaxLifetime != "" {
+		if _, err := time.ParseDuration(d.ConnMaxLifetime); err != nil {
+			return &FieldError{Field: "conn_max_lifetime", Message: fmt.Sprintf("%q is not a duration such as 300s", d.ConnMaxLifetime)}
+		}
+	}
+	return nil
+}
+
+// postgresDSN builds a libpq keyword/value connection string
+func (d *DatabaseConfig) postgresDSN(database string) string {
+	params := []string{
+		"host=" + postgresValue(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"user=" + postgresValue(d.Username),
+		"password=" + postgresValue(d.Password),
+		"dbname=" + postgresValue(database),
+	}
+	if d.SSLMode != "" {
+		params = append(params, "sslmode="+postgresValue(d.SSLMode))
+	}
+	for _, name := range sortedKeys(d.Options) {
+		params = append(params, name+"="+postgresValue(d.Options[name]))
+	}
+	return strings.Join(params, " ")
+}
+
+// postgresValue quotes a keyword/value parameter when it is empty or holds
+// spaces, quotes or backslashes
+func postgresValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// mysqlDSN builds a go-sql-driver connection string. Times are scanned into
+// time.Time, and SQL migration files may hold several statements.
+func (d *DatabaseConfig) mysqlDSN(database string) (string, error) {
+	cfg := mysqldriver.NewConfig()
+	cfg.User = d.Username
+	cfg.Passwd = d.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+	cfg.DBName = database
+
+	params := url.Values{
+		"charset":         {"utf8mb4"},
+		"parseTime":       {"true"},
+		"multiStatements": {"true"},
+	}
+	for name, value := range d.Options {
+		params.Set(name, value)
+	}
+	dsn := cfg.FormatDSN() + "?" + params.Encode()
+
+	// The driver rejects options it knows with values it doesn't
+	if _, err := mysqldriver.ParseDSN(dsn); err != nil {
+		return "", &FieldError{Field: "options", Message: err.Error()}
+	}
+	return dsn, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// maintenanceDatabases are connected to while the configured database is
+// created or dropped. MySQL connections don't need a database.
+var maintenanceDatabases = map[string]string{
+	AdapterPostgres: "postgres",
+	AdapterMySQL:    "",
+}
+
+// CreateDatabase creates the configured database. It reports false when the
+// database already exists.
+func (d *DatabaseConfig) CreateDatabase() (bool, error) {
+	if err := d.prepare(); err != nil {
+		return false, err
+	}
+
+	var created bool
+	var err error
+	switch d.Adapter {
+	case AdapterSQLite:
+		created, err = d.createSQLiteFile()
+
+	default:
+		err = d.withMaintenanceDB(func(db *gorm.DB) error {
+			var count int64
+			if err := db.Raw(databaseExistsQuery[d.Adapter], d.Database).Scan(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return nil
+			}
+			created = true
+			return db.Exec("CREATE DATABASE " + d.quoteIdentifier(d.Database) + createDatabaseOptions[d.Adapter]).Error
+		})
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to create database '%s': %w", d.Database, err)
+	}
+	return created, nil
+}
+
+// DropDatabase drops the configured database if it exists
+func (d *DatabaseConfig) DropDatabase() error {
+	if err := d.prepare(); err != nil {
+		return err
+	}
+
+	var err error
+	switch d.Adapter {
+	case AdapterSQLite:
+		err = d.removeSQLiteFile()
+
+	default:
+		err = d.withMaintenanceDB(func(db *gorm.DB) error {
+			return db.Exec("DROP DATABASE IF EXISTS " + d.quoteIdentifier(d.Database)).Error
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drop database '%s': %w", d.Database, err)
+	}
+	return nil
+}
+
+// databaseExistsQuery counts the databases with a given name
+var databaseExistsQuery = map[string]string{
+	AdapterPostgres: "SELECT count(*) FROM pg_database WHERE datname = ?",
+	AdapterMySQL:    "SELECT count(*) FROM information_schema.schemata WHERE schema_name = ?",
+}
+
+// createDatabaseOptions follow CREATE DATABASE. MySQL would otherwise pick
+// the server's default character set, which may not be utf8mb4.
+var createDatabaseOptions = map[string]string{
+	AdapterMySQL: " CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci",
+}
+
+// withMaintenanceDB runs fn on a short-lived connection that isn't to the
+// configured database, since a database can't drop itself
+func (d *DatabaseConfig) withMaintenanceDB(fn func(db *gorm.DB) error) error {
+	dialector, err := d.dialector(maintenanceDatabases[d.Adapter])
+	if err != nil {
+		return err
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	return fn(db)
+}
+
+// quoteIdentifier quotes a database name for use in DDL, which doesn't take
+// bind parameters
+func (d *DatabaseConfig) quoteIdentifier(name string) string {
+	if d.Adapter == AdapterMySQL {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sqliteMemory is the database path of a private in-memory SQLite database
+const sqliteMemory = ":memory:"
+
+// defaultSQLitePragmas suit a web app sharing one file between many
+// connections: readers don't block the writer, a busy database is waited on
+// rather than failing, and foreign keys are enforced as on PostgreSQL.
+// Pragmas in database.yml override them.
+var defaultSQLitePragmas = map[string]string{
+	"journal_mode": "WAL",
+	"busy_timeout": "5000",
+	"foreign_keys": "on",
+}
+
+// sqlitePragmas are the pragmas the driver can apply to every connection it
+// opens. Pragmas set with a statement would only reach one connection.
+var sqlitePragmas = map[string]bool{
+	"auto_vacuum":              true,
+	"busy_timeout":             true,
+	"cache_size":               true,
+	"case_sensitive_like":      true,
+	"defer_foreign_keys":       true,
+	"foreign_keys":             true,
+	"ignore_check_constraints": true,
+	"journal_mode":             true,
+	"locking_mode":             true,
+	"query_only":               true,
+	"recursive_triggers":       true,
+	"secure_delete":            true,
+	"synchronous":              true,
+}
+
+// sqliteDSN builds the go-sqlite3 connection string for the database file,
+// carrying the pragmas as _name=value parameters
+func (d *DatabaseConfig) sqliteDSN() string {
+	pragmas := make(map[string]string, len(defaultSQLitePragmas)+len(d.Pragmas))
+	for name, value := range defaultSQLitePragmas {
+		pragmas[name] = value
+	}
+	for name, value := range d.Pragmas {
+		pragmas[name] = value
+	}
+
+	params := make([]string, 0, len(pragmas))
+	for _, name := range sortedKeys(pragmas) {
+		params = append(params, "_"+name+"="+url.QueryEscape(pragmas[name]))
+	}
+	return d.Database + "?" + strings.Join(params, "&")
+}
+
+// sqliteInMemory reports whether the database lives only in memory. Every
+// connection to such a database gets its own, empty one.
+func (d *DatabaseConfig) sqliteInMemory() bool {
+	return d.Database == sqliteMemory || strings.Contains(d.Database, "mode=memory")
+}
+
+// createSQLiteFile creates an empty database file, which SQLite treats as an
+// empty database, and the directories above it
+func (d *DatabaseConfig) createSQLiteFile() (bool, error) {
+	if d.sqliteInMemory() {
+		return false, errors.New("an in-memory database can't be created")
+	}
+	if _, err := os.Stat(d.Database); err == nil {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.Database), 0o755); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(d.Database, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// removeSQLiteFile deletes the database file with its WAL and shared memory
+// files
+func (d *DatabaseConfig) removeSQLiteFile() error {
+	if d.sqliteInMemory() {
+		return errors.New("an in-memory database can't be dropped")
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(d.Database + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
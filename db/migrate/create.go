@@ -0,0 +1,92 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of migration Create can generate
+const (
+	KindSQL = "sql"
+	KindGo  = "go"
+)
+
+var nonIdentifier = regexp.MustCompile(`[^a-z0-9]+`)
+
+const sqlUpSkeleton = `-- %s: describe the change.
+-- This runs in a transaction; see the README for statements that can't.
+
+`
+
+const sqlDownSkeleton = `-- Revert %s.
+
+`
+
+const goSkeleton = `package %s
+
+import (
+	"fresh/db/migrate"
+
+	"gorm.io/gorm"
+)
+
+func init() {
+	register(migrate.Migration{
+		Version: %d,
+		Name:    %q,
+		Up: func(tx *gorm.DB) error {
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	})
+}
+`
+
+// Create writes the skeleton of a new migration to dir and returns the paths
+// of the files it wrote. kind is KindSQL for an up/down pair of SQL files or
+// KindGo for a Go file registering the migration; the version is now in UTC.
+func Create(dir, name, kind string, now time.Time) ([]string, error) {
+	name = strings.Trim(nonIdentifier.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return nil, errors.New("migration name must contain letters or digits")
+	}
+	version := now.UTC().Format(VersionFormat)
+	base := filepath.Join(dir, version+"_"+name)
+
+	files := map[string]string{}
+	switch kind {
+	case KindSQL:
+		files[base+".up.sql"] = fmt.Sprintf(sqlUpSkeleton, version+"_"+name)
+		files[base+".down.sql"] = fmt.Sprintf(sqlDownSkeleton, version+"_"+name)
+	case KindGo:
+		var numeric int64
+		fmt.Sscan(version, &numeric)
+		files[base+".go"] = fmt.Sprintf(goSkeleton, filepath.Base(dir), numeric, name)
+	default:
+		return nil, fmt.Errorf("unknown migration kind %q (use %s or %s)", kind, KindSQL, KindGo)
+	}
+
+	var paths []string
+	for path := range files {
+		if _, err := os.Stat(path); err == nil {
+			return nil, fmt.Errorf("%s already exists", path)
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if err := os.WriteFile(path, []byte(files[path]), 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
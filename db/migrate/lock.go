@@ -0,0 +1,77 @@
+package migrate
+
+import (
+	"database/sql"
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// lockKey identifies the migration lock among the application's advisory
+// locks. It is arbitrary but must never change.
+const lockKey int64 = 7_261_837_100_215
+
+// lockName is the migration lock's name on MySQL, whose named locks are
+// strings rather than numbers
+const lockName = "fresh.schema_migrations"
+
+// locker serializes migrations across processes. The lock is held by the
+// connection it was taken on.
+type locker interface {
+	acquire(conn *gorm.DB) error
+	release(conn *gorm.DB) error
+}
+
+func lockFor(conn *gorm.DB) locker {
+	switch conn.Dialector.Name() {
+	case "postgres":
+		return postgresLock{}
+	case "mysql":
+		return mysqlLock{}
+	default:
+		// SQLite has a single writer and locks the whole file for each
+		// write transaction
+		return noLock{}
+	}
+}
+
+// postgresLock is a session-level advisory lock; it is released when the
+// connection closes even if the process dies mid-migration
+type postgresLock struct{}
+
+func (postgresLock) acquire(conn *gorm.DB) error {
+	return conn.Exec("SELECT pg_advisory_lock(?)", lockKey).Error
+}
+
+func (postgresLock) release(conn *gorm.DB) error {
+	return conn.Exec("SELECT pg_advisory_unlock(?)", lockKey).Error
+}
+
+// mysqlLockTimeout is how long, in seconds, a process waits for another one
+// to finish migrating. MariaDB doesn't take the negative "wait forever".
+const mysqlLockTimeout = 3600
+
+// mysqlLock is a named lock, which like the PostgreSQL one belongs to the
+// connection and is released when it closes
+type mysqlLock struct{}
+
+func (mysqlLock) acquire(conn *gorm.DB) error {
+	// GET_LOCK returns 1 once the lock is held and 0 on timeout
+	var held sql.NullInt64
+	if err := conn.Raw("SELECT GET_LOCK(?, ?)", lockName, mysqlLockTimeout).Row().Scan(&held); err != nil {
+		return err
+	}
+	if held.Int64 != 1 {
+		return errors.New("timed out waiting for another process to finish migrating")
+	}
+	return nil
+}
+
+func (mysqlLock) release(conn *gorm.DB) error {
+	return conn.Exec("SELECT RELEASE_LOCK(?)", lockName).Error
+}
+
+type noLock struct{}
+
+func (noLock) acquire(*gorm.DB) error { return nil }
+func (noLock) release(*gorm.DB) error { return nil }
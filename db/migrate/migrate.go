@@ -0,0 +1,300 @@
+// Package migrate applies versioned schema migrations and records them in
+// the schema_migrations table.
+//
+// A migration has a version (a UTC timestamp, 20060102150405), a name and an
+// up and a down step. Migrations are written either as SQL files, loaded with
+// LoadSQL, or as Go functions. Each one runs in its own transaction together
+// with its schema_migrations row, and a database-wide lock keeps two
+// processes from migrating at the same time.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// VersionFormat is the time layout migration versions are written in
+const VersionFormat = "20060102150405"
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	// Down reverts Up; nil means the migration can't be rolled back
+	Down func(tx *gorm.DB) error
+	// NoTransaction runs the migration outside a transaction, for statements
+	// such as CREATE INDEX CONCURRENTLY. A failure can leave it half applied.
+	NoTransaction bool
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%d_%s", m.Version, m.Name)
+}
+
+// schemaMigration is a row of the schema_migrations table
+type schemaMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Status is a migration and whether it has been applied
+type Status struct {
+	Migration Migration
+	AppliedAt *time.Time
+	// Missing is set for versions recorded in the database that no longer
+	// have a migration
+	Missing bool
+}
+
+// Applied reports whether the migration has run
+func (s Status) Applied() bool {
+	return s.AppliedAt != nil
+}
+
+// Migrator applies a fixed set of migrations to a database
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New returns a Migrator for the given migrations. Versions must be unique.
+func New(db *gorm.DB, migrations []Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for i, m := range sorted {
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %s has no up step", m)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migrations %s and %s share a version", sorted[i-1], m)
+		}
+	}
+
+	return &Migrator{db: db, migrations: sorted}, nil
+}
+
+// Up applies every pending migration in version order and returns the ones
+// it applied. Migrations older than the newest applied one still run, so
+// branches merged out of order don't lose theirs.
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+
+	err := m.locked(func(conn *gorm.DB) error {
+		done, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			if err := run(conn, migration, migration.Up, func(tx *gorm.DB) error {
+				return tx.Create(&schemaMigration{
+					Version:   migration.Version,
+					Name:      migration.Name,
+					AppliedAt: time.Now().UTC(),
+				}).Error
+			}); err != nil {
+				return fmt.Errorf("migration %s failed: %w", migration, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// Rollback reverts the most recently applied migrations, newest first, and
+// returns the ones it reverted
+func (m *Migrator) Rollback(steps int) ([]Migration, error) {
+	if steps < 1 {
+		return nil, errors.New("rollback needs at least one step")
+	}
+
+	var reverted []Migration
+
+	err := m.locked(func(conn *gorm.DB) error {
+		var rows []schemaMigration
+		if err := conn.Order("version DESC").Limit(steps).Find(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			migration, ok := m.find(row.Version)
+			if !ok {
+				return fmt.Errorf("migration %d_%s is applied but no longer exists", row.Version, row.Name)
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("migration %s can't be rolled back", migration)
+			}
+			if err := run(conn, migration, migration.Down, func(tx *gorm.DB) error {
+				return tx.Delete(&schemaMigration{}, "version = ?", migration.Version).Error
+			}); err != nil {
+				return fmt.Errorf("rolling back %s failed: %w", migration, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+
+	return reverted, err
+}
+
+// Status lists every migration in version order with when it was applied,
+// followed by applied versions that no longer have a migration
+func (m *Migrator) Status() ([]Status, error) {
+	if err := ensureTable(m.db); err != nil {
+		return nil, err
+	}
+	done, err := appliedVersions(m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Migration: migration}
+		if row, ok := done[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+			delete(done, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+
+	var missing []Status
+	for _, row := range done {
+		appliedAt := row.AppliedAt
+		missing = append(missing, Status{
+			Migration: Migration{Version: row.Version, Name: row.Name},
+			AppliedAt: &appliedAt,
+			Missing:   true,
+		})
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Migration.Version < missing[j].Migration.Version })
+
+	return append(statuses, missing...), nil
+}
+
+// Pending returns the migrations that haven't been applied yet
+func (m *Migrator) Pending() ([]Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, status := range statuses {
+		if !status.Applied() {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// PendingReadOnly is Pending for callers that mustn't change the database,
+// such as health probes: it only reads, and a missing schema_migrations
+// table means every migration is pending rather than being created
+func (m *Migrator) PendingReadOnly(ctx context.Context) ([]Migration, error) {
+	db := m.db.WithContext(ctx)
+	if !db.Migrator().HasTable(&schemaMigration{}) {
+		return append([]Migration(nil), m.migrations...), nil
+	}
+	done, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if _, ok := done[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, migration := range m.migrations {
+		if migration.Version == version {
+			return migration, true
+		}
+	}
+	return Migration{}, false
+}
+
+// locked runs fn on a single connection while holding the migration lock
+func (m *Migrator) locked(fn func(conn *gorm.DB) error) error {
+	return m.db.Connection(func(conn *gorm.DB) error {
+		// A fresh session on the pinned connection, so the statements below
+		// don't share state
+		conn = conn.Session(&gorm.Session{NewDB: true})
+
+		lock := lockFor(conn)
+		if err := lock.acquire(conn); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		defer func() {
+			if err := lock.release(conn); err != nil {
+				conn.Logger.Error(conn.Statement.Context, "failed to release migration lock: %v", err)
+			}
+		}()
+
+		if err := ensureTable(conn); err != nil {
+			return err
+		}
+		return fn(conn)
+	})
+}
+
+// run applies step and record, in one transaction unless the migration
+// opts out
+func run(conn *gorm.DB, migration Migration, step, record func(tx *gorm.DB) error) error {
+	if migration.NoTransaction {
+		if err := step(conn); err != nil {
+			return err
+		}
+		return record(conn)
+	}
+
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := step(tx); err != nil {
+			return err
+		}
+		return record(tx)
+	})
+}
+
+func ensureTable(db *gorm.DB) error {
+	if err := db.AutoMigrate(&schemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func appliedVersions(db *gorm.DB) (map[int64]schemaMigration, error) {
+	var rows []schemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	done := make(map[int64]schemaMigration, len(rows))
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+	return done, nil
+}
@@ -0,0 +1,144 @@
+package migrate
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// NoTransactionDirective as the first line of an SQL file makes its
+// migration run outside a transaction
+const NoTransactionDirective = "-- migrate:no-transaction"
+
+// sqlFileName matches 20060102150405_name.up.sql, with an optional dialect
+// before the extension (20060102150405_name.up.postgres.sql)
+var sqlFileName = regexp.MustCompile(`^(\d{14})_([a-z0-9_]+)\.(up|down)(?:\.(postgres|sqlite|mysql))?\.sql$`)
+
+// sqlMigration holds the statements of one SQL migration by dialect; ""
+// is the fallback for dialects without their own file
+type sqlMigration struct {
+	version int64
+	name    string
+	up      map[string]string
+	down    map[string]string
+	noTx    bool
+}
+
+// LoadSQL reads the *.sql migrations in the root of fsys. Each migration is
+// a 20060102150405_name.up.sql file and, if it can be rolled back, a
+// matching .down.sql. A dialect-specific file such as
+// 20060102150405_name.up.postgres.sql replaces the generic one on that
+// database. Statements run in a single Exec, so a file may hold several.
+func LoadSQL(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int64]*sqlMigration)
+	var order []int64
+
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		match := sqlFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s should be named <version>_<name>.up.sql or .down.sql", entry.Name())
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		name, direction, dialect := match[2], match[3], match[4]
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &sqlMigration{version: version, name: name, up: map[string]string{}, down: map[string]string{}}
+			byVersion[version] = m
+			order = append(order, version)
+		} else if m.name != name {
+			return nil, fmt.Errorf("migrations %d_%s and %d_%s share a version", version, m.name, version, name)
+		}
+
+		statements := string(content)
+		if hasNoTransactionDirective(statements) {
+			m.noTx = true
+		}
+		if direction == "up" {
+			m.up[dialect] = statements
+		} else {
+			m.down[dialect] = statements
+		}
+	}
+
+	migrations := make([]Migration, 0, len(order))
+	for _, version := range order {
+		m := byVersion[version]
+		if len(m.up) == 0 {
+			return nil, fmt.Errorf("migration %d_%s has no .up.sql file", m.version, m.name)
+		}
+
+		migration := Migration{
+			Version:       m.version,
+			Name:          m.name,
+			Up:            execFor(m, m.up),
+			NoTransaction: m.noTx,
+		}
+		if len(m.down) > 0 {
+			migration.Down = execFor(m, m.down)
+		}
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, nil
+}
+
+// execFor runs the statements for the connection's dialect
+func execFor(m *sqlMigration, files map[string]string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		statements, ok := files[tx.Dialector.Name()]
+		if !ok {
+			statements, ok = files[""]
+		}
+		if !ok {
+			return fmt.Errorf("%d_%s has no SQL for %s", m.version, m.name, tx.Dialector.Name())
+		}
+		if onlyComments(statements) {
+			return nil
+		}
+		return tx.Exec(statements).Error
+	}
+}
+
+// onlyComments reports whether the SQL has nothing to execute, as in a
+// freshly generated skeleton
+func onlyComments(statements string) bool {
+	for _, line := range strings.Split(statements, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+// hasNoTransactionDirective reports whether the first non-blank line of the
+// SQL is NoTransactionDirective; mentions of it further down don't count
+func hasNoTransactionDirective(statements string) bool {
+	for _, line := range strings.Split(statements, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			return line == NoTransactionDirective
+		}
+	}
+	return false
+}
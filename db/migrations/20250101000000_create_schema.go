@@ -0,0 +1,132 @@
+package migrations
+
+import (
+	"fresh/db/migrate"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// baselineTables is the schema as the models described it when migrations
+// were introduced. The structs are copies rather than the models themselves
+// so that later model changes don't rewrite history; make those in new
+// migrations. They share the models' names, which GORM derives table and
+// constraint names from.
+func baselineTables() []interface{} {
+	type Permission struct {
+		ID          uint   `gorm:"primarykey"`
+		Name        string `gorm:"size:128;uniqueIndex;not null"`
+		Description string
+	}
+
+	type Role struct {
+		ID          uint   `gorm:"primarykey"`
+		Name        string `gorm:"size:64;uniqueIndex;not null"`
+		Description string
+		Permissions []Permission `gorm:"many2many:role_permissions"`
+		CreatedAt   time.Time
+	}
+
+	type User struct {
+		ID                  uint   `gorm:"primarykey"`
+		Email               string `gorm:"unique;not null"`
+		Password            string `gorm:"not null"`
+		FailedLoginAttempts int    `gorm:"not null;default:0"`
+		LockedUntil         *time.Time
+		LockedAt            *time.Time
+		PasswordChangedAt   *time.Time
+		EmailVerifiedAt     *time.Time
+		TOTPSecret          string `gorm:"size:255"`
+		TOTPEnabledAt       *time.Time
+		TOTPLastStep        int64  `gorm:"not null;default:0"`
+		Roles               []Role `gorm:"many2many:user_roles"`
+		CreatedAt           time.Time
+	}
+
+	type Session struct {
+		ID         string `gorm:"primarykey;size:64"`
+		UserID     uint   `gorm:"index;not null"`
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		ExpiresAt  time.Time `gorm:"index;not null"`
+	}
+
+	type LoginAttempt struct {
+		ID        uint      `gorm:"primarykey"`
+		Bucket    string    `gorm:"size:320;index;not null"`
+		CreatedAt time.Time `gorm:"index;not null"`
+	}
+
+	type PasswordResetToken struct {
+		ID        uint      `gorm:"primarykey"`
+		UserID    uint      `gorm:"index;not null"`
+		TokenHash string    `gorm:"size:64;uniqueIndex;not null"`
+		ExpiresAt time.Time `gorm:"not null"`
+		UsedAt    *time.Time
+		CreatedAt time.Time
+	}
+
+	type RecoveryCode struct {
+		ID        uint   `gorm:"primarykey"`
+		UserID    uint   `gorm:"index;not null"`
+		CodeHash  string `gorm:"size:64;not null"`
+		UsedAt    *time.Time
+		CreatedAt time.Time
+	}
+
+	type UserIdentity struct {
+		ID          uint   `gorm:"primarykey"`
+		UserID      uint   `gorm:"index;not null"`
+		Provider    string `gorm:"size:64;not null;uniqueIndex:idx_identity_provider_subject"`
+		Subject     string `gorm:"size:255;not null;uniqueIndex:idx_identity_provider_subject"`
+		Email       string `gorm:"size:320"`
+		CreatedAt   time.Time
+		LastLoginAt time.Time
+	}
+
+	type APIToken struct {
+		ID         uint   `gorm:"primarykey"`
+		UserID     uint   `gorm:"index;not null"`
+		Name       string `gorm:"size:100;not null"`
+		TokenHash  string `gorm:"size:64;uniqueIndex;not null"`
+		Prefix     string `gorm:"size:16;not null"`
+		Scopes     string `gorm:"size:255;not null"`
+		LastUsedAt *time.Time
+		ExpiresAt  *time.Time
+		CreatedAt  time.Time
+	}
+
+	return []interface{}{
+		&Permission{},
+		&Role{},
+		&User{},
+		&Session{},
+		&LoginAttempt{},
+		&PasswordResetToken{},
+		&RecoveryCode{},
+		&UserIdentity{},
+		&APIToken{},
+	}
+}
+
+// Databases created by AutoMigrate before migrations existed already have
+// these tables, and migrating them only fills in what is missing, so the
+// baseline is safe to run everywhere.
+func init() {
+	register(migrate.Migration{
+		Version: 20250101000000,
+		Name:    "create_schema",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(baselineTables()...)
+		},
+		Down: func(tx *gorm.DB) error {
+			// Join tables first, then the rest in reverse dependency order
+			tables := baselineTables()
+			dropped := []interface{}{"user_roles", "role_permissions"}
+			for i := len(tables) - 1; i >= 0; i-- {
+				dropped = append(dropped, tables[i])
+			}
+			return tx.Migrator().DropTable(dropped...)
+		},
+	})
+}
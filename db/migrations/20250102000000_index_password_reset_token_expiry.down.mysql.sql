@@ -0,0 +1 @@
+DROP INDEX idx_password_reset_tokens_expires_at ON password_reset_tokens;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_password_reset_tokens_expires_at;
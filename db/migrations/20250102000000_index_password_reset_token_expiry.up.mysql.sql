@@ -0,0 +1,3 @@
+-- MySQL has no CREATE INDEX IF NOT EXISTS. Databases on MySQL were never
+-- built by AutoMigrate, so the index can't exist yet.
+CREATE INDEX idx_password_reset_tokens_expires_at ON password_reset_tokens (expires_at);
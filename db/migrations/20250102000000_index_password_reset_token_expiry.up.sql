@@ -0,0 +1,3 @@
+-- Expired reset tokens are pruned by expires_at. IF NOT EXISTS covers
+-- databases that got the index from AutoMigrate.
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_expires_at ON password_reset_tokens (expires_at);
@@ -0,0 +1,39 @@
+// Package migrations holds the application's schema migrations: SQL files
+// embedded from this directory and Go migrations that register themselves
+// in init. Create new ones with "make db-new-migration NAME=...".
+package migrations
+
+import (
+	"embed"
+	"fresh/db/migrate"
+
+	"gorm.io/gorm"
+)
+
+//go:embed *.sql
+var sqlFiles embed.FS
+
+// goMigrations is filled by the init functions of the Go migrations
+var goMigrations []migrate.Migration
+
+func register(migration migrate.Migration) {
+	goMigrations = append(goMigrations, migration)
+}
+
+// All returns every migration, SQL and Go
+func All() ([]migrate.Migration, error) {
+	sqlMigrations, err := migrate.LoadSQL(sqlFiles)
+	if err != nil {
+		return nil, err
+	}
+	return append(sqlMigrations, goMigrations...), nil
+}
+
+// NewMigrator returns a migrate.Migrator for every migration
+func NewMigrator(db *gorm.DB) (*migrate.Migrator, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, migrations)
+}
@@ -2,28 +2,139 @@ package routes
 
 import (
 	"fresh/app/controllers"
+	"fresh/app/metrics"
 	"fresh/app/middleware"
+	"fresh/app/models"
 	"fresh/app/services"
+	"fresh/app/tracing"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func SetupRoutes(app *fiber.App, authController *controllers.AuthController, dashboardController *controllers.DashboardController, authService *services.AuthService) {
+// Dependencies holds the controllers and services the routes are wired to
+type Dependencies struct {
+	AuthController         *controllers.AuthController
+	DashboardController    *controllers.DashboardController
+	PasswordController     *controllers.PasswordController
+	VerificationController *controllers.VerificationController
+	TwoFactorController    *controllers.TwoFactorController
+	OIDCController         *controllers.OIDCController
+	AdminUsersController   *controllers.AdminUsersController
+	APITokenController     *controllers.APITokenController
+	APIAuthController      *controllers.APIAuthController
+	APIMeController        *controllers.APIMeController
+	HealthController       *controllers.HealthController
+	AuthService            *services.AuthService
+	APITokenService        *services.APITokenService
+	TemplateService        services.TemplateRenderer
+	// Metrics times the requests after the probes; nil turns it off
+	Metrics *metrics.Metrics
+	// MetricsHandler serves /metrics on the app's port; nil when metrics are
+	// off or served on their own address
+	MetricsHandler fiber.Handler
+}
+
+func SetupRoutes(app *fiber.App, deps Dependencies) {
+	// Probes and build info, ahead of the middleware: no session, no CSRF
+	// cookie, nothing that could make a probe fail but the checks themselves
+	app.Get("/healthz", deps.HealthController.Healthz)
+	app.Get("/readyz", deps.HealthController.Readyz)
+	app.Get("/version", deps.HealthController.Version)
+	if deps.MetricsHandler != nil {
+		app.Get("/metrics", deps.MetricsHandler)
+	}
+
+	// Request metrics, left out for the probes and scrapes above
+	if deps.Metrics != nil {
+		app.Use(deps.Metrics.Middleware())
+	}
+	// Server spans, recorded when tracing is configured; the trace context
+	// of incoming requests is passed on either way
+	app.Use(tracing.Middleware())
+
+	// Every state-changing request must carry the CSRF token, unless it is
+	// authenticated with a bearer token instead of the session cookie
+	app.Use(middleware.CSRF(middleware.CSRFConfig{
+		Renderer: deps.TemplateService,
+		Secure:   deps.AuthService.SessionConfig().Secure,
+	}))
+
 	// Root redirect
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.Redirect("/login")
 	})
 
 	// Public routes (no middleware for now to debug)
-	app.Get("/login", authController.ShowLogin)
-	app.Post("/login", authController.HandleLogin)
-	app.Get("/register", authController.ShowRegister)
-	app.Post("/register", authController.HandleRegister)
+	app.Get("/login", deps.AuthController.ShowLogin)
+	app.Post("/login", deps.AuthController.HandleLogin)
+	app.Get("/register", deps.AuthController.ShowRegister)
+	app.Post("/register", deps.AuthController.HandleRegister)
+
+	// Social login. The callback is a GET, so CSRF is covered by the OIDC state.
+	app.Get("/auth/:provider", deps.OIDCController.Redirect)
+	app.Get("/auth/:provider/callback", deps.OIDCController.Callback)
+
+	// Second login step for users with 2FA; guarded by the pending-login cookie
+	app.Get("/login/2fa", deps.TwoFactorController.ShowChallenge)
+	app.Post("/login/2fa", deps.TwoFactorController.HandleChallenge)
+
+	// Password reset
+	app.Get("/password/forgot", deps.PasswordController.ShowForgot)
+	app.Post("/password/forgot", deps.PasswordController.HandleForgot)
+	app.Get("/password/reset/:token", deps.PasswordController.ShowReset)
+	app.Post("/password/reset/:token", deps.PasswordController.HandleReset)
+
+	// Protected routes (require authentication). The middleware is attached
+	// per route: a Group on "/" would run it in front of every later route.
+	requireAuth := middleware.RequireAuth(deps.AuthService)
+	requireVerified := middleware.RequireVerifiedEmail(deps.AuthService)
+
+	// Email verification. The link itself works without a session.
+	app.Get("/verify-email", requireAuth, deps.VerificationController.ShowNotice)
+	app.Post("/verify-email/resend", requireAuth, deps.VerificationController.HandleResend)
+	app.Get("/verify-email/:token", deps.VerificationController.Verify)
+
+	app.Get("/dashboard", requireAuth, requireVerified, deps.DashboardController.Show)
+
+	// Two-factor settings
+	app.Get("/account/2fa", requireAuth, requireVerified, deps.TwoFactorController.Show)
+	app.Get("/account/2fa/setup", requireAuth, requireVerified, deps.TwoFactorController.ShowSetup)
+	app.Post("/account/2fa/setup", requireAuth, requireVerified, deps.TwoFactorController.BeginSetup)
+	app.Post("/account/2fa/confirm", requireAuth, requireVerified, deps.TwoFactorController.ConfirmSetup)
+	app.Post("/account/2fa/disable", requireAuth, requireVerified, deps.TwoFactorController.Disable)
+	app.Post("/account/2fa/recovery-codes", requireAuth, requireVerified, deps.TwoFactorController.RegenerateRecoveryCodes)
+
+	// Personal access tokens for the API
+	app.Get("/account/tokens", requireAuth, requireVerified, deps.APITokenController.Index)
+	app.Post("/account/tokens", requireAuth, requireVerified, deps.APITokenController.Create)
+	app.Post("/account/tokens/:id/revoke", requireAuth, requireVerified, deps.APITokenController.Revoke)
+
+	// Admin area. A Group is fine here: it only covers the /admin prefix.
+	access := middleware.AccessConfig{AuthService: deps.AuthService, Renderer: deps.TemplateService}
+	admin := app.Group("/admin", requireAuth, requireVerified,
+		middleware.RequirePermission(access, models.PermissionAccessAdmin))
+	admin.Get("/", func(c *fiber.Ctx) error {
+		return c.Redirect("/admin/users")
+	})
+
+	users := admin.Group("/users", middleware.RequirePermission(access, models.PermissionManageUsers))
+	users.Get("/", deps.AdminUsersController.Index)
+	users.Get("/:id", deps.AdminUsersController.Show)
+	users.Post("/:id/lock", deps.AdminUsersController.Lock)
+	users.Post("/:id/unlock", deps.AdminUsersController.Unlock)
+	users.Post("/:id/password-reset", deps.AdminUsersController.ForcePasswordReset)
+	users.Post("/:id/roles", middleware.RequirePermission(access, models.PermissionManageRoles), deps.AdminUsersController.UpdateRoles)
+	users.Post("/:id/delete", deps.AdminUsersController.Delete)
 
-	// Protected routes (require authentication)
-	protected := app.Group("/", middleware.RequireAuth(authService))
-	protected.Get("/dashboard", dashboardController.Show)
+	// JSON API. Clients authenticate with a session cookie from
+	// POST /api/v1/sessions or a personal access token.
+	api := app.Group("/api/v1", middleware.RequireJSON())
+	api.Post("/sessions", deps.APIAuthController.CreateSession)
+	api.Delete("/sessions", deps.APIAuthController.DestroySession)
+	api.Post("/registrations", deps.APIAuthController.Register)
+	api.Get("/me", middleware.RequireAPIAuth(deps.AuthService, deps.APITokenService, models.ScopeRead), deps.APIMeController.Show)
+	api.Patch("/me", middleware.RequireAPIAuth(deps.AuthService, deps.APITokenService, models.ScopeWrite), deps.APIMeController.Update)
 
 	// Logout (no middleware needed)
-	app.Post("/logout", authController.HandleLogout)
+	app.Post("/logout", deps.AuthController.HandleLogout)
 }
@@ -0,0 +1,383 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"fresh/app/services"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminSession creates an admin and returns their session cookie
+func adminSession(t *testing.T, testApp *TestApp) (*models.User, *http.Cookie) {
+	admin, err := testApp.CreateAdminUser("admin@example.com", "password123")
+	require.NoError(t, err)
+	cookie, err := testApp.SessionCookie(admin)
+	require.NoError(t, err)
+	return admin, cookie
+}
+
+func adminPost(t *testing.T, testApp *TestApp, path string, form url.Values, cookie *http.Cookie) *http.Response {
+	req, err := testApp.NewFormRequest("POST", path, form, cookie)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestUserRepository_List(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	for i := 1; i <= 30; i++ {
+		_, err := testApp.UserRepo.Create(fmt.Sprintf("user%02d@example.com", i), "password123")
+		require.NoError(t, err)
+	}
+	_, err := testApp.UserRepo.Create("Someone_Else@Example.org", "password123")
+	require.NoError(t, err)
+
+	page, err := testApp.UserRepo.List(models.UserListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(31), page.Total)
+	assert.Len(t, page.Users, models.DefaultUsersPerPage)
+	assert.Equal(t, 2, page.TotalPages())
+	assert.Equal(t, 0, page.PrevPage())
+	assert.Equal(t, 2, page.NextPage())
+	assert.Equal(t, "user01@example.com", page.Users[0].Email)
+	assert.NotEmpty(t, page.Users[0].Roles, "roles are preloaded")
+
+	page, err = testApp.UserRepo.List(models.UserListOptions{Page: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.Users, 6)
+	assert.Equal(t, 1, page.PrevPage())
+	assert.Equal(t, 0, page.NextPage())
+
+	// Search ignores case and treats LIKE wildcards literally
+	page, err = testApp.UserRepo.List(models.UserListOptions{Query: "SOMEONE_"})
+	require.NoError(t, err)
+	require.Len(t, page.Users, 1)
+	assert.Equal(t, "Someone_Else@Example.org", page.Users[0].Email)
+
+	page, err = testApp.UserRepo.List(models.UserListOptions{Query: "r_1"})
+	require.NoError(t, err)
+	assert.Empty(t, page.Users)
+
+	page, err = testApp.UserRepo.List(models.UserListOptions{Query: "user1", PerPage: 5})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), page.Total)
+	assert.Len(t, page.Users, 5)
+	assert.Equal(t, 2, page.TotalPages())
+}
+
+func TestAdminUsers_RequiresAdmin(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	member, err := testApp.CreateTestUser("member@example.com", "password123")
+	require.NoError(t, err)
+	memberCookie, err := testApp.SessionCookie(member)
+	require.NoError(t, err)
+	_, adminCookie := adminSession(t, testApp)
+
+	tests := []struct {
+		name           string
+		path           string
+		cookie         *http.Cookie
+		expectedStatus int
+	}{
+		{"anonymous", "/admin/users", nil, http.StatusFound},
+		{"member", "/admin/users", memberCookie, http.StatusForbidden},
+		{"member on a user page", fmt.Sprintf("/admin/users/%d", member.ID), memberCookie, http.StatusForbidden},
+		{"admin", "/admin/users", adminCookie, http.StatusOK},
+		{"admin root redirects", "/admin", adminCookie, http.StatusFound},
+		{"unknown user", "/admin/users/9999", adminCookie, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			resp, err := testApp.App.Test(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+		})
+	}
+
+	// Members can't act on accounts either
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/delete", member.ID), nil, memberCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = testApp.UserRepo.FindByID(member.ID)
+	assert.NoError(t, err)
+}
+
+func TestAdminUsers_LockAndUnlock(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, adminCookie := adminSession(t, testApp)
+	user, err := testApp.CreateTestUser("target@example.com", "password123")
+	require.NoError(t, err)
+	userCookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/lock", user.ID), nil, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("/admin/users/%d?notice=locked", user.ID), resp.Header.Get("Location"))
+
+	// Existing sessions end and the right password no longer signs in
+	req, _ := http.NewRequest("GET", "/dashboard", nil)
+	req.AddCookie(userCookie)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "/login", resp.Header.Get("Location"))
+
+	_, err = testApp.AuthService.Login(context.Background(), "target@example.com", "password123", "192.0.2.1")
+	assert.True(t, errors.Is(err, services.ErrAccountLocked))
+	_, err = testApp.AuthService.Login(context.Background(), "target@example.com", "wrong-password", "192.0.2.1")
+	assert.False(t, errors.Is(err, services.ErrAccountLocked), "the lock isn't revealed without the password")
+
+	resp = adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/unlock", user.ID), nil, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	reloaded, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.False(t, reloaded.Locked())
+	assert.Zero(t, reloaded.FailedLoginAttempts)
+
+	_, err = testApp.AuthService.Login(context.Background(), "target@example.com", "password123", "192.0.2.1")
+	assert.NoError(t, err)
+}
+
+func TestAdminUsers_CannotModifySelf(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	admin, adminCookie := adminSession(t, testApp)
+
+	for _, action := range []string{"lock", "delete"} {
+		resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/%s", admin.ID, action), nil, adminCookie)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, action)
+	}
+
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", admin.ID),
+		url.Values{"roles": {models.RoleMember}}, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	reloaded, err := testApp.UserRepo.FindByID(admin.ID)
+	require.NoError(t, err)
+	assert.False(t, reloaded.Locked())
+	assert.True(t, reloaded.HasRole(models.RoleAdmin))
+}
+
+// staffSession signs in a user whose only role is a custom one with the
+// given permissions
+func staffSession(t *testing.T, testApp *TestApp, role string, permissions ...string) (*models.User, *http.Cookie) {
+	roleRepo := models.NewRoleRepository(testApp.DB)
+	require.NoError(t, roleRepo.Seed([]models.RoleDefinition{{Name: role, Permissions: permissions}}))
+	user, err := testApp.CreateTestUser(role+"@example.com", "password123")
+	require.NoError(t, err)
+	require.NoError(t, roleRepo.SetRoles(user, []string{role}))
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+	return user, cookie
+}
+
+func TestAdminUsers_RolesNeedRolesManage(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	support, supportCookie := staffSession(t, testApp, "support", models.PermissionAccessAdmin, models.PermissionManageUsers)
+	for _, id := range []uint{support.ID, support.ID + 100} {
+		resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", id),
+			url.Values{"roles": {"support", models.RoleAdmin}}, supportCookie)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	reloaded, err := testApp.UserRepo.FindByID(support.ID)
+	require.NoError(t, err)
+	assert.False(t, reloaded.HasRole(models.RoleAdmin))
+}
+
+func TestAdminUsers_CannotGrantSelfRoles(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	manager, managerCookie := staffSession(t, testApp, "manager",
+		models.PermissionAccessAdmin, models.PermissionManageUsers, models.PermissionManageRoles)
+
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", manager.ID),
+		url.Values{"roles": {"manager", models.RoleAdmin}}, managerCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	reloaded, err := testApp.UserRepo.FindByID(manager.ID)
+	require.NoError(t, err)
+	assert.False(t, reloaded.HasRole(models.RoleAdmin))
+
+	// Dropping a role they hold is fine, and so is granting it to others
+	other, err := testApp.CreateTestUser("other@example.com", "password123")
+	require.NoError(t, err)
+	resp = adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", other.ID),
+		url.Values{"roles": {"manager"}}, managerCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestAdminUsers_ForcePasswordReset(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, adminCookie := adminSession(t, testApp)
+	user, err := testApp.CreateTestUser("forgetful@example.com", "password123")
+	require.NoError(t, err)
+	userCookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+	testApp.Mailer.Reset()
+
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/password-reset", user.ID), nil, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	_, err = testApp.AuthService.Login(context.Background(), "forgetful@example.com", "password123", "192.0.2.1")
+	assert.Error(t, err, "the old password stops working")
+
+	_, err = testApp.SessionStore.Find(context.Background(), userCookie.Value)
+	assert.Error(t, err, "sessions are ended")
+
+	msg := testApp.Mailer.LastMessage()
+	require.NotNil(t, msg)
+	assert.Equal(t, "forgetful@example.com", msg.To)
+	assert.Equal(t, "password_reset", msg.Subject)
+}
+
+func TestAdminUsers_UpdateRoles(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, adminCookie := adminSession(t, testApp)
+	user, err := testApp.CreateTestUser("promote@example.com", "password123")
+	require.NoError(t, err)
+
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", user.ID),
+		url.Values{"roles": {models.RoleAdmin, models.RoleMember}}, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	reloaded, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, reloaded.HasRole(models.RoleAdmin))
+	assert.True(t, reloaded.HasRole(models.RoleMember))
+
+	// Unchecking every box removes every role
+	resp = adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", user.ID), nil, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	reloaded, err = testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, reloaded.Roles)
+
+	resp = adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/roles", user.ID),
+		url.Values{"roles": {models.RoleMember, "superuser"}}, adminCookie)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(t, string(body), `there is no role named \"superuser\"`)
+
+	reloaded, err = testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, reloaded.Roles, "nothing is assigned")
+}
+
+func TestAdminUsers_Delete(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, adminCookie := adminSession(t, testApp)
+	user, err := testApp.CreateTestUser("leaving@example.com", "password123")
+	require.NoError(t, err)
+	_, err = models.NewUserIdentityRepository(testApp.DB).Create(user.ID, "standin", "sub-leaving", user.Email)
+	require.NoError(t, err)
+
+	resp := adminPost(t, testApp, fmt.Sprintf("/admin/users/%d/delete", user.ID), nil, adminCookie)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/admin/users?notice=deleted", resp.Header.Get("Location"))
+
+	_, err = testApp.UserRepo.FindByID(user.ID)
+	assert.Error(t, err)
+	assert.Empty(t, identitiesFor(t, testApp, user.ID))
+
+	var links int64
+	testApp.DB.Table("user_roles").Where("user_id = ?", user.ID).Count(&links)
+	assert.Zero(t, links)
+}
+
+func TestAdminUsers_Templates(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	templateService, err := services.NewTemplateServiceAt("../web/templates")
+	require.NoError(t, err)
+
+	admin, err := testApp.CreateAdminUser("admin@example.com", "password123")
+	require.NoError(t, err)
+	page, err := testApp.UserRepo.List(models.UserListOptions{})
+	require.NoError(t, err)
+	roles, err := models.NewRoleRepository(testApp.DB).All()
+	require.NoError(t, err)
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(services.CurrentUserKey, admin)
+		return c.Next()
+	})
+	app.Get("/index", func(c *fiber.Ctx) error {
+		return templateService.Render(c, "admin/users/index", fiber.Map{"Title": "Users", "Query": "a&b", "Page": page})
+	})
+	app.Get("/show", func(c *fiber.Ctx) error {
+		return templateService.Render(c, "admin/users/show", fiber.Map{"Title": "User", "Account": admin, "Roles": roles})
+	})
+	app.Get("/dashboard", func(c *fiber.Ctx) error {
+		return templateService.Render(c, "dashboard", fiber.Map{"Title": "Dashboard", "User": admin})
+	})
+
+	for path, want := range map[string]string{
+		"/index":     "admin@example.com",
+		"/show":      `value="admin" checked`,
+		"/dashboard": `href="/admin"`,
+	} {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Contains(t, string(body), want, path)
+		if path != "/dashboard" {
+			assert.Contains(t, string(body), "Fresh Admin", "%s uses the admin layout", path)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fresh/app/apperror"
+	"fresh/app/middleware"
+	"fresh/app/models"
+	"fresh/app/services"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// apiResponse is the union of the API's response bodies, including the
+// problem+json members of errors
+type apiResponse struct {
+	Title             string            `json:"title"`
+	Status            int               `json:"status"`
+	Detail            string            `json:"detail"`
+	Errors            map[string]string `json:"errors"`
+	TwoFactorRequired bool              `json:"two_factor_required"`
+	User              struct {
+		ID            uint     `json:"id"`
+		Email         string   `json:"email"`
+		EmailVerified bool     `json:"email_verified"`
+		Roles         []string `json:"roles"`
+	} `json:"user"`
+}
+
+// apiRequest sends a JSON request and decodes the JSON reply. State-changing
+// requests are declared JSON, body or not, and carry a CSRF token, as a
+// client that read the X-CSRF-Token header would send.
+func apiRequest(t *testing.T, testApp *TestApp, method, path string, body interface{}, cookies ...*http.Cookie) (*http.Response, apiResponse) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, path, reader)
+	require.NoError(t, err)
+	if method != "GET" {
+		req.Header.Set("Content-Type", "application/json")
+		csrfCookie, err := testApp.CSRFCookie()
+		require.NoError(t, err)
+		req.Header.Set(middleware.CSRFHeaderName, csrfCookie.Value)
+		req.AddCookie(csrfCookie)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var decoded apiResponse
+	raw, _ := io.ReadAll(resp.Body)
+	if len(raw) > 0 {
+		require.NoError(t, json.Unmarshal(raw, &decoded), "expected JSON, got %q", raw)
+		if resp.StatusCode >= http.StatusBadRequest {
+			assert.Equal(t, apperror.MIMEProblemJSON, resp.Header.Get("Content-Type"))
+			assert.Equal(t, resp.StatusCode, decoded.Status)
+		} else {
+			assert.Contains(t, resp.Header.Get("Content-Type"), "application/json")
+		}
+	}
+	return resp, decoded
+}
+
+func TestAPI_SessionLifecycle(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, err := testApp.CreateTestUser("api@example.com", "password123")
+	require.NoError(t, err)
+
+	resp, body := apiRequest(t, testApp, "POST", "/api/v1/sessions", map[string]string{
+		"email": "api@example.com", "password": "password123",
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "api@example.com", body.User.Email)
+	assert.Equal(t, []string{models.RoleMember}, body.User.Roles)
+
+	session := sessionCookieFrom(resp)
+	require.NotNil(t, session)
+
+	resp, body = apiRequest(t, testApp, "GET", "/api/v1/me", nil, session)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "api@example.com", body.User.Email)
+	assert.True(t, body.User.EmailVerified)
+
+	// Even a DELETE must be declared JSON, which a cross-site form can't do
+	csrfCookie, err := testApp.CSRFCookie()
+	require.NoError(t, err)
+	req, err := http.NewRequest("DELETE", "/api/v1/sessions", nil)
+	require.NoError(t, err)
+	req.Header.Set(middleware.CSRFHeaderName, csrfCookie.Value)
+	req.AddCookie(csrfCookie)
+	req.AddCookie(session)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, _ = apiRequest(t, testApp, "DELETE", "/api/v1/sessions", nil, session)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, body = apiRequest(t, testApp, "GET", "/api/v1/me", nil, session)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(t, body.Detail)
+}
+
+func TestAPI_SessionErrors(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("api@example.com", "password123")
+	require.NoError(t, err)
+	locked, err := testApp.CreateTestUser("locked@example.com", "password123")
+	require.NoError(t, err)
+	require.NoError(t, testApp.UserRepo.SetLocked(locked, true))
+
+	tests := []struct {
+		name           string
+		body           map[string]string
+		expectedStatus int
+	}{
+		{"missing password", map[string]string{"email": "api@example.com"}, http.StatusUnprocessableEntity},
+		{"wrong password", map[string]string{"email": "api@example.com", "password": "nope"}, http.StatusUnauthorized},
+		{"unknown email", map[string]string{"email": "ghost@example.com", "password": "password123"}, http.StatusUnauthorized},
+		{"locked account", map[string]string{"email": "locked@example.com", "password": "password123"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := apiRequest(t, testApp, "POST", "/api/v1/sessions", tt.body)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			assert.NotEmpty(t, body.Detail)
+			assert.Nil(t, sessionCookieFrom(resp))
+		})
+	}
+
+	t.Run("form body is refused", func(t *testing.T) {
+		req, err := testApp.NewFormRequest("POST", "/api/v1/sessions", url.Values{"email": {"api@example.com"}, "password": {"password123"}})
+		require.NoError(t, err)
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
+
+	t.Run("unknown route", func(t *testing.T) {
+		resp, body := apiRequest(t, testApp, "GET", "/api/v1/nope", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "Not Found", body.Title)
+	})
+
+	t.Run("throttled", func(t *testing.T) {
+		var resp *http.Response
+		for i := 0; i < 10; i++ {
+			resp, _ = apiRequest(t, testApp, "POST", "/api/v1/sessions", map[string]string{
+				"email": user.Email, "password": "wrong-password",
+			})
+		}
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	})
+}
+
+func TestAPI_SessionWithTwoFactor(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("secure@example.com", "password123")
+	require.NoError(t, err)
+	secret, _ := enableTwoFactor(t, testApp, user)
+
+	resp, body := apiRequest(t, testApp, "POST", "/api/v1/sessions", map[string]string{
+		"email": "secure@example.com", "password": "password123",
+	})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.True(t, body.TwoFactorRequired)
+	assert.Nil(t, sessionCookieFrom(resp))
+
+	resp, _ = apiRequest(t, testApp, "POST", "/api/v1/sessions", map[string]string{
+		"email": "secure@example.com", "password": "password123", "code": "000000",
+	})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Nil(t, sessionCookieFrom(resp))
+
+	resp, body = apiRequest(t, testApp, "POST", "/api/v1/sessions", map[string]string{
+		"email": "secure@example.com", "password": "password123", "code": totpAt(t, secret, time.Now().Add(30*time.Second)),
+	})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, user.ID, body.User.ID)
+	assert.NotNil(t, sessionCookieFrom(resp))
+}
+
+func TestAPI_Registration(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	resp, body := apiRequest(t, testApp, "POST", "/api/v1/registrations", map[string]string{
+		"email": "new@example.com", "password": "password123",
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "new@example.com", body.User.Email)
+	assert.False(t, body.User.EmailVerified)
+	assert.NotNil(t, sessionCookieFrom(resp))
+
+	msg := testApp.Mailer.LastMessage()
+	require.NotNil(t, msg)
+	assert.Equal(t, "new@example.com", msg.To)
+
+	resp, body = apiRequest(t, testApp, "POST", "/api/v1/registrations", map[string]string{
+		"email": "new@example.com", "password": "password123",
+	})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, "email already exists", body.Detail)
+
+	resp, _ = apiRequest(t, testApp, "POST", "/api/v1/registrations", map[string]string{"email": "other@example.com"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestAPI_UpdateMe(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("me@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+	_, err = testApp.CreateTestUser("taken@example.com", "password123")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		body           map[string]string
+		expectedStatus int
+	}{
+		{"nothing to change", map[string]string{"current_password": "password123"}, http.StatusUnprocessableEntity},
+		{"wrong password", map[string]string{"current_password": "nope", "email": "x@example.com"}, http.StatusUnprocessableEntity},
+		{"email taken", map[string]string{"current_password": "password123", "email": "taken@example.com"}, http.StatusConflict},
+		{"password too short", map[string]string{"current_password": "password123", "password": "abc"}, http.StatusUnprocessableEntity},
+		{"not an address", map[string]string{"current_password": "password123", "email": "not an address"}, http.StatusUnprocessableEntity},
+		{"named address", map[string]string{"current_password": "password123", "email": "Me <x@example.com>"}, http.StatusUnprocessableEntity},
+		{"bad password with new email", map[string]string{"current_password": "password123", "email": "half@example.com", "password": "abc"}, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := apiRequest(t, testApp, "PATCH", "/api/v1/me", tt.body, session)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			assert.NotEmpty(t, body.Detail)
+		})
+	}
+
+	// Rejected updates change nothing, not even the parts that were valid
+	unchanged, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "me@example.com", unchanged.Email)
+	assert.Nil(t, testApp.Mailer.LastMessage())
+
+	// Changing the password ends the old session but hands back a new one
+	resp, body := apiRequest(t, testApp, "PATCH", "/api/v1/me", map[string]string{
+		"current_password": "password123", "email": "moved@example.com", "password": "new-password",
+	}, session)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "moved@example.com", body.User.Email)
+	assert.False(t, body.User.EmailVerified, "the new address must be verified")
+
+	renewed := sessionCookieFrom(resp)
+	require.NotNil(t, renewed)
+
+	resp, _ = apiRequest(t, testApp, "GET", "/api/v1/me", nil, session)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = apiRequest(t, testApp, "GET", "/api/v1/me", nil, renewed)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, err = testApp.AuthService.Login(context.Background(), "moved@example.com", "new-password", "192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "moved@example.com", testApp.Mailer.LastMessage().To)
+}
+
+func TestAPI_UpdateMeThrottlesPasswordGuesses(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("me@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	for i := 0; i < services.DefaultLoginThrottleConfig().MaxPerEmail; i++ {
+		resp, _ := apiRequest(t, testApp, "PATCH", "/api/v1/me", map[string]string{
+			"current_password": "guess", "email": "moved@example.com",
+		}, session)
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	}
+
+	resp, _ := apiRequest(t, testApp, "PATCH", "/api/v1/me", map[string]string{
+		"current_password": "password123", "email": "moved@example.com",
+	}, session)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	unchanged, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "me@example.com", unchanged.Email)
+}
+
+func TestAPI_BearerTokens(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("ci@example.com", "password123")
+	require.NoError(t, err)
+	readOnly, _, err := testApp.APITokens.Create(context.Background(), user, "read", []string{models.ScopeRead}, 0)
+	require.NoError(t, err)
+
+	send := func(method, token string, body interface{}) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			payload, _ := json.Marshal(body)
+			reader = bytes.NewReader(payload)
+		}
+		req, _ := http.NewRequest(method, "/api/v1/me", reader)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, send("GET", readOnly, nil).StatusCode)
+	assert.Equal(t, http.StatusForbidden, send("PATCH", readOnly, map[string]string{
+		"current_password": "password123", "email": "hijack@example.com",
+	}).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "fresh_bogus", nil).StatusCode)
+}
@@ -0,0 +1,306 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"fresh/app/apperror"
+	"fresh/app/middleware"
+	"fresh/app/models"
+	"fresh/app/services"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mountWhoAmI adds routes behind RequireAPIToken that echo the current user
+func mountWhoAmI(testApp *TestApp) {
+	whoAmI := func(c *fiber.Ctx) error {
+		user, err := testApp.AuthService.GetCurrentUser(c)
+		if err != nil {
+			return err
+		}
+		return c.SendString(user.Email)
+	}
+
+	testApp.App.Get("/test/whoami", middleware.RequireAPIToken(testApp.APITokens, models.ScopeRead), whoAmI)
+	testApp.App.Post("/test/whoami", middleware.RequireAPIToken(testApp.APITokens, models.ScopeWrite), whoAmI)
+}
+
+func bearerRequest(t *testing.T, testApp *TestApp, method, token string) *http.Response {
+	req, _ := http.NewRequest(method, "/test/whoami", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestAPIToken_CreateShowsTokenOnce(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("scripter@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	req, err := testApp.NewFormRequest("POST", "/account/tokens", url.Values{
+		"name":       {"CI"},
+		"scopes":     {models.ScopeRead, models.ScopeWrite},
+		"expires_in": {"90"},
+	}, session)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var rendered struct {
+		Data struct {
+			NewToken string
+			Tokens   []models.APIToken
+		}
+	}
+	require.NoError(t, json.Unmarshal(body, &rendered))
+	plaintext := rendered.Data.NewToken
+	require.True(t, strings.HasPrefix(plaintext, "fresh_"))
+	require.Len(t, rendered.Data.Tokens, 1)
+	assert.True(t, strings.HasPrefix(plaintext, rendered.Data.Tokens[0].Prefix))
+
+	// Only the hash is stored, and the list page never shows the token again
+	var stored models.APIToken
+	require.NoError(t, testApp.DB.First(&stored).Error)
+	assert.NotEqual(t, plaintext, stored.TokenHash)
+	assert.Equal(t, "read write", stored.Scopes)
+	require.NotNil(t, stored.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(90*24*time.Hour), *stored.ExpiresAt, time.Minute)
+
+	req, _ = http.NewRequest("GET", "/account/tokens", nil)
+	req.AddCookie(session)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NotContains(t, string(body), plaintext)
+}
+
+func TestAPIToken_CreateValidation(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("scripter@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		form url.Values
+	}{
+		{"missing name", url.Values{"scopes": {models.ScopeRead}}},
+		{"no scopes", url.Values{"name": {"CI"}}},
+		{"unknown scope", url.Values{"name": {"CI"}, "scopes": {"admin"}}},
+		{"unoffered lifetime", url.Values{"name": {"CI"}, "scopes": {models.ScopeRead}, "expires_in": {"7"}}},
+		{"overflowing lifetime", url.Values{"name": {"CI"}, "scopes": {models.ScopeRead}, "expires_in": {"9999999999"}}},
+		{"negative lifetime", url.Values{"name": {"CI"}, "scopes": {models.ScopeRead}, "expires_in": {"-1"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := testApp.NewFormRequest("POST", "/account/tokens", tt.form, session)
+			require.NoError(t, err)
+			resp, err := testApp.App.Test(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		})
+	}
+
+	tokens, err := testApp.APITokens.List(context.Background(), user)
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func TestRequireAPIToken(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+	mountWhoAmI(testApp)
+
+	user, err := testApp.CreateTestUser("scripter@example.com", "password123")
+	require.NoError(t, err)
+
+	readOnly, _, err := testApp.APITokens.Create(context.Background(), user, "read only", []string{models.ScopeRead}, 0)
+	require.NoError(t, err)
+	readWrite, _, err := testApp.APITokens.Create(context.Background(), user, "read write", []string{models.ScopeRead, models.ScopeWrite}, time.Hour)
+	require.NoError(t, err)
+	expired, expiredToken, err := testApp.APITokens.Create(context.Background(), user, "old", []string{models.ScopeRead}, time.Hour)
+	require.NoError(t, err)
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, testApp.DB.Model(expiredToken).Update("expires_at", past).Error)
+
+	tests := []struct {
+		name           string
+		method         string
+		token          string
+		expectedStatus int
+	}{
+		{"no header", "GET", "", http.StatusUnauthorized},
+		{"unknown token", "GET", "fresh_not-a-real-token", http.StatusUnauthorized},
+		{"foreign format", "GET", "abc.def.ghi", http.StatusUnauthorized},
+		{"expired token", "GET", expired, http.StatusUnauthorized},
+		{"read token reads", "GET", readOnly, http.StatusOK},
+		{"read token can't write", "POST", readOnly, http.StatusForbidden},
+		{"write token writes without CSRF", "POST", readWrite, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := bearerRequest(t, testApp, tt.method, tt.token)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			switch tt.expectedStatus {
+			case http.StatusOK:
+				assert.Equal(t, "scripter@example.com", string(body))
+			case http.StatusUnauthorized:
+				assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+				if tt.token != "" {
+					assert.Equal(t, apperror.MIMEProblemJSON, resp.Header.Get("Content-Type"))
+				}
+			case http.StatusForbidden:
+				assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "insufficient_scope")
+			}
+		})
+	}
+
+	tokens, err := testApp.APITokens.List(context.Background(), user)
+	require.NoError(t, err)
+	for _, token := range tokens {
+		if token.Name == "read only" {
+			assert.NotNil(t, token.LastUsedAt, "use is recorded")
+		}
+	}
+}
+
+func TestAPIToken_RevokedAndLockedTokensStopWorking(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+	mountWhoAmI(testApp)
+
+	user, err := testApp.CreateTestUser("scripter@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+	other, err := testApp.CreateTestUser("other@example.com", "password123")
+	require.NoError(t, err)
+	otherSession, err := testApp.SessionCookie(other)
+	require.NoError(t, err)
+
+	plaintext, token, err := testApp.APITokens.Create(context.Background(), user, "CI", []string{models.ScopeRead}, 0)
+	require.NoError(t, err)
+	kept, _, err := testApp.APITokens.Create(context.Background(), user, "laptop", []string{models.ScopeRead}, 0)
+	require.NoError(t, err)
+
+	// Someone else can't revoke the token
+	req, err := testApp.NewFormRequest("POST", fmt.Sprintf("/account/tokens/%d/revoke", token.ID), nil, otherSession)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = bearerRequest(t, testApp, "GET", plaintext)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err = testApp.NewFormRequest("POST", fmt.Sprintf("/account/tokens/%d/revoke", token.ID), nil, session)
+	require.NoError(t, err)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	resp = bearerRequest(t, testApp, "GET", plaintext)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// An admin lock shuts out API access too
+	require.NoError(t, testApp.UserRepo.SetLocked(user, true))
+	resp = bearerRequest(t, testApp, "GET", kept)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAPIToken_PasswordResetsRevokeTokens(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+	mountWhoAmI(testApp)
+
+	user, err := testApp.CreateTestUser("scripter@example.com", "password123")
+	require.NoError(t, err)
+
+	plaintext, _, err := testApp.APITokens.Create(context.Background(), user, "CI", []string{models.ScopeRead}, 0)
+	require.NoError(t, err)
+	resp := bearerRequest(t, testApp, "GET", plaintext)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// An admin's forced reset shuts out the old token
+	require.NoError(t, testApp.AuthService.ForcePasswordReset(context.Background(), user))
+	resp = bearerRequest(t, testApp, "GET", plaintext)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// A token made afterwards works until the next change
+	fresh, _, err := testApp.APITokens.Create(context.Background(), user, "CI", []string{models.ScopeRead}, 0)
+	require.NoError(t, err)
+	resp = bearerRequest(t, testApp, "GET", fresh)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, testApp.UserRepo.UpdatePassword(user, "new-password123"))
+	resp = bearerRequest(t, testApp, "GET", fresh)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestAPIToken_Template(t *testing.T) {
+	templateService, err := services.NewTemplateServiceAt("../web/templates")
+	require.NoError(t, err)
+
+	expiresAt := time.Now().Add(time.Hour)
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return templateService.Render(c, "api_tokens", fiber.Map{
+			"Title":     "API Tokens",
+			"Scopes":    models.APIScopes(),
+			"Lifetimes": []string{"30", "0"},
+			"NewToken":  "fresh_secret",
+			"Tokens": []models.APIToken{
+				{ID: 1, Name: "CI", Prefix: "fresh_abcd", Scopes: "read", ExpiresAt: &expiresAt},
+			},
+		})
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `value="fresh_secret"`)
+	assert.Contains(t, string(body), `/account/tokens/1/revoke`)
+	assert.Contains(t, string(body), "Never")
+}
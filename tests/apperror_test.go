@@ -0,0 +1,245 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fresh/app/apperror"
+	"fresh/app/services"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newErrorApp mounts handlers that fail with err under /api/fail and /fail
+func newErrorApp(config apperror.HandlerConfig, err error) *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: apperror.Handler(config)})
+	fail := func(c *fiber.Ctx) error {
+		// Written output must not leak into the error response
+		c.WriteString("partial")
+		return err
+	}
+	app.Get("/api/fail", fail)
+	app.Get("/fail", fail)
+	return app
+}
+
+func decodeProblem(t *testing.T, resp *http.Response) map[string]interface{} {
+	defer resp.Body.Close()
+	assert.Equal(t, apperror.MIMEProblemJSON, resp.Header.Get("Content-Type"))
+
+	var problem map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	return problem
+}
+
+func TestAppError_ProblemJSON(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedDetail string
+	}{
+		{"validation", apperror.Validation("bad input", nil), http.StatusUnprocessableEntity, "bad input"},
+		{"unauthorized", apperror.Unauthorized("sign in"), http.StatusUnauthorized, "sign in"},
+		{"forbidden", apperror.Forbidden("no"), http.StatusForbidden, "no"},
+		{"not found", apperror.NotFound("no such thing"), http.StatusNotFound, "no such thing"},
+		{"conflict", apperror.Conflict("taken"), http.StatusConflict, "taken"},
+		{"too many requests", apperror.TooManyRequests("slow down"), http.StatusTooManyRequests, "slow down"},
+		{"fiber error", fiber.NewError(http.StatusBadRequest, "bad JSON"), http.StatusBadRequest, "bad JSON"},
+		{"wrapped", errors.Join(errors.New("context"), apperror.Conflict("taken")), http.StatusConflict, "taken"},
+		{"plain error", errors.New("boom"), http.StatusInternalServerError, "boom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newErrorApp(apperror.HandlerConfig{Renderer: &MockTemplateService{}}, tt.err)
+			resp, err := app.Test(httptest.NewRequest("GET", "/api/fail", nil))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+
+			problem := decodeProblem(t, resp)
+			assert.Equal(t, "about:blank", problem["type"])
+			assert.Equal(t, http.StatusText(tt.expectedStatus), problem["title"])
+			assert.EqualValues(t, tt.expectedStatus, problem["status"])
+			assert.Equal(t, tt.expectedDetail, problem["detail"])
+			assert.Equal(t, "/api/fail", problem["instance"])
+		})
+	}
+}
+
+func TestAppError_InstanceMasksTokens(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: apperror.Handler(apperror.HandlerConfig{})})
+	app.Get("/api/reset/:token", func(c *fiber.Ctx) error {
+		return apperror.NotFound("this link has expired")
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/reset/s3cr3t?token=s3cr3t", nil))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	var problem map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &problem))
+	assert.Equal(t, "/api/reset/:token", problem["instance"])
+	assert.NotContains(t, string(body), "s3cr3t")
+}
+
+func TestAppError_FieldsAndExtensions(t *testing.T) {
+	err := apperror.Validation("some fields are missing", map[string]string{"email": "is required"}).
+		With("hint", "see the docs")
+	app := newErrorApp(apperror.HandlerConfig{}, err)
+
+	resp, testErr := app.Test(httptest.NewRequest("GET", "/api/fail", nil))
+	require.NoError(t, testErr)
+	problem := decodeProblem(t, resp)
+
+	assert.Equal(t, map[string]interface{}{"email": "is required"}, problem["errors"])
+	assert.Equal(t, "see the docs", problem["hint"])
+}
+
+func TestAppError_ProductionHidesServerErrors(t *testing.T) {
+	cause := errors.New("dial tcp 10.0.0.5:5432: connection refused")
+
+	for _, production := range []bool{false, true} {
+		app := newErrorApp(apperror.HandlerConfig{Production: production}, apperror.Internal(cause))
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/fail", nil))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+		problem := decodeProblem(t, resp)
+		if production {
+			assert.NotContains(t, problem["detail"], "10.0.0.5")
+		} else {
+			assert.Contains(t, problem["detail"], "10.0.0.5")
+		}
+	}
+
+	// Client errors are meant for the user and stay visible
+	app := newErrorApp(apperror.HandlerConfig{Production: true}, apperror.Conflict("email already exists"))
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/fail", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "email already exists", decodeProblem(t, resp)["detail"])
+}
+
+func TestAppError_ContentNegotiation(t *testing.T) {
+	app := newErrorApp(apperror.HandlerConfig{Renderer: &MockTemplateService{}}, apperror.NotFound("gone"))
+
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		wantJSON bool
+	}{
+		{"browser", "/fail", "text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"no accept header", "/fail", "", false},
+		{"prefers JSON", "/fail", "application/json", true},
+		{"prefers problem JSON", "/fail", "application/problem+json", true},
+		{"API path", "/api/fail", "text/html", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := app.Test(req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			if tt.wantJSON {
+				assert.Equal(t, "gone", decodeProblem(t, resp)["detail"])
+				return
+			}
+
+			// The mock renderer echoes the template and its data
+			var rendered struct {
+				Template string
+				Data     map[string]interface{}
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&rendered))
+			resp.Body.Close()
+			assert.Equal(t, "errors/404", rendered.Template)
+			assert.Equal(t, "gone", rendered.Data["Error"])
+		})
+	}
+}
+
+func TestAppError_UnknownRoutes(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	req := httptest.NewRequest("GET", "/no-such-page", nil)
+	req.Header.Set("Accept", "text/html")
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, string(body), `"template":"errors/404"`)
+
+	resp, err = testApp.App.Test(httptest.NewRequest("GET", "/api/v1/no-such-endpoint", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.EqualValues(t, http.StatusNotFound, decodeProblem(t, resp)["status"])
+}
+
+func TestAppError_Templates(t *testing.T) {
+	templateService, err := services.NewTemplateServiceAt("../web/templates")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		err      error
+		config   apperror.HandlerConfig
+		expected []string
+		hidden   string
+	}{
+		{
+			name:     "not found",
+			err:      apperror.NotFound("no such user"),
+			config:   apperror.HandlerConfig{Renderer: templateService},
+			expected: []string{"404", "Page not found"},
+		},
+		{
+			name:     "forbidden",
+			err:      apperror.Forbidden("admins only"),
+			config:   apperror.HandlerConfig{Renderer: templateService},
+			expected: []string{"Forbidden", "admins only"},
+		},
+		{
+			name:     "server error in production",
+			err:      apperror.Internal(errors.New("secret <b>details</b>")),
+			config:   apperror.HandlerConfig{Renderer: templateService, Production: true},
+			expected: []string{"500", "Something went wrong"},
+			hidden:   "secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newErrorApp(tt.config, tt.err)
+			resp, err := app.Test(httptest.NewRequest("GET", "/fail", nil))
+			require.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.err.(*apperror.Error).Kind.Status(), resp.StatusCode)
+			assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+			assert.False(t, strings.HasPrefix(string(body), "partial"))
+			for _, want := range tt.expected {
+				assert.Contains(t, string(body), want)
+			}
+			if tt.hidden != "" {
+				assert.NotContains(t, string(body), tt.hidden)
+			}
+		})
+	}
+}
@@ -1,8 +1,12 @@
 package tests
 
 import (
+	"context"
+	"fmt"
+	"fresh/app/services"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/stretchr/testify/assert"
@@ -51,7 +55,7 @@ func TestAuthService_Register(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			user, err := testApp.AuthService.Register(tt.email, tt.password)
+			user, err := testApp.AuthService.Register(context.Background(), tt.email, tt.password)
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -124,7 +128,7 @@ func TestAuthService_Login(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			user, err := testApp.AuthService.Login(tt.email, tt.password)
+			user, err := testApp.AuthService.Login(context.Background(), tt.email, tt.password, "192.0.2.1")
 
 			if tt.expectError {
 				assert.Error(t, err)
@@ -149,58 +153,50 @@ func TestAuthService_GetCurrentUser(t *testing.T) {
 	testUser, err := testApp.CreateTestUser("current@example.com", "password123")
 	require.NoError(t, err)
 
+	validCookie, err := testApp.SessionCookie(testUser)
+	require.NoError(t, err)
+
+	expired, err := testApp.SessionStore.Create(context.Background(), testUser.ID, -time.Minute)
+	require.NoError(t, err)
+
 	tests := []struct {
 		name        string
-		setupCookie func(*fiber.Ctx)
+		cookie      *http.Cookie
 		expectError bool
 	}{
 		{
-			name: "valid user cookie",
-			setupCookie: func(c *fiber.Ctx) {
-				testApp.AuthService.SetUserSession(c, testUser)
-			},
+			name:        "valid session cookie",
+			cookie:      validCookie,
 			expectError: false,
 		},
 		{
-			name: "no cookie",
-			setupCookie: func(c *fiber.Ctx) {
-				// Don't set any cookie
-			},
+			name:        "no cookie",
+			cookie:      nil,
 			expectError: true,
 		},
 		{
-			name: "invalid user ID",
-			setupCookie: func(c *fiber.Ctx) {
-				c.Cookie(&fiber.Cookie{
-					Name:  "user_id",
-					Value: "99999", // Non-existent user
-				})
-			},
+			name:        "unknown session ID",
+			cookie:      &http.Cookie{Name: validCookie.Name, Value: "not-a-real-session"},
 			expectError: true,
 		},
 		{
-			name: "malformed cookie",
-			setupCookie: func(c *fiber.Ctx) {
-				c.Cookie(&fiber.Cookie{
-					Name:  "user_id",
-					Value: "invalid",
-				})
-			},
+			name:        "expired session",
+			cookie:      &http.Cookie{Name: validCookie.Name, Value: expired.ID},
+			expectError: true,
+		},
+		{
+			name:        "legacy user_id cookie",
+			cookie:      &http.Cookie{Name: "user_id", Value: "1"},
 			expectError: true,
 		},
 	}
 
-	for _, tt := range tests {
+	for i, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Use the existing test app instead of creating a new context
-			req, err := http.NewRequest("GET", "/test", nil)
-			require.NoError(t, err)
-
-			// Create a test handler that sets up the cookie and calls GetCurrentUser
-			testApp.App.Get("/test", func(c *fiber.Ctx) error {
-				// Setup cookie as specified
-				tt.setupCookie(c)
+			path := fmt.Sprintf("/test/%d", i)
 
+			// Create a test handler that calls GetCurrentUser with the request's cookies
+			testApp.App.Get(path, func(c *fiber.Ctx) error {
 				user, err := testApp.AuthService.GetCurrentUser(c)
 
 				if tt.expectError {
@@ -216,9 +212,61 @@ func TestAuthService_GetCurrentUser(t *testing.T) {
 				return c.SendString("OK")
 			})
 
+			req, err := http.NewRequest("GET", path, nil)
+			require.NoError(t, err)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
 			resp, err := testApp.App.Test(req)
 			require.NoError(t, err)
 			defer resp.Body.Close()
 		})
 	}
+
+	// Expired sessions are removed once they've been seen
+	_, err = testApp.SessionStore.Find(context.Background(), expired.ID)
+	assert.ErrorIs(t, err, services.ErrSessionNotFound)
+}
+
+func TestAuthService_SetUserSession(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	testUser, err := testApp.CreateTestUser("session@example.com", "password123")
+	require.NoError(t, err)
+
+	previous, err := testApp.SessionCookie(testUser)
+	require.NoError(t, err)
+
+	testApp.App.Get("/test/login", func(c *fiber.Ctx) error {
+		return testApp.AuthService.SetUserSession(c, testUser)
+	})
+
+	req, err := http.NewRequest("GET", "/test/login", nil)
+	require.NoError(t, err)
+	req.AddCookie(previous)
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var sessionCookie *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == previous.Name {
+			sessionCookie = cookie
+		}
+	}
+	require.NotNil(t, sessionCookie)
+	assert.True(t, sessionCookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, sessionCookie.SameSite)
+	assert.NotEqual(t, previous.Value, sessionCookie.Value)
+
+	session, err := testApp.SessionStore.Find(context.Background(), sessionCookie.Value)
+	require.NoError(t, err)
+	assert.Equal(t, testUser.ID, session.UserID)
+
+	// The session the browser arrived with is replaced, not reused
+	_, err = testApp.SessionStore.Find(context.Background(), previous.Value)
+	assert.ErrorIs(t, err, services.ErrSessionNotFound)
 }
@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"fresh/app/cli"
+	"fresh/app/models"
+	"fresh/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// newTestCLI returns a CLI on db that reads stdin and captures its output
+func newTestCLI(db *gorm.DB, stdin string) (*cli.CLI, *bytes.Buffer) {
+	var stdout bytes.Buffer
+	c := cli.New()
+	c.Stdin = strings.NewReader(stdin)
+	c.Stdout = &stdout
+	c.Stderr = &bytes.Buffer{}
+	c.OpenDatabase = func() (*gorm.DB, error) { return db, nil }
+	// The tests share db between commands, so it stays open
+	c.CloseDatabase = func(*gorm.DB) error { return nil }
+	c.DatabaseConfig = func() (*config.DatabaseConfig, error) {
+		return nil, errors.New("no database config in tests")
+	}
+	return c, &stdout
+}
+
+func TestCLI_UserCreate(t *testing.T) {
+	ta := SetupTestApp(t)
+	defer ta.TeardownTestApp()
+
+	c, stdout := newTestCLI(ta.DB, "s3cret-pass\n")
+	require.NoError(t, c.Run([]string{"user", "create", "-admin", "ops@example.com"}))
+	assert.Contains(t, stdout.String(), "Created user ops@example.com")
+
+	user, err := ta.UserRepo.FindByEmail("ops@example.com")
+	require.NoError(t, err)
+	assert.True(t, user.CheckPassword("s3cret-pass"))
+	assert.True(t, user.EmailVerified())
+	require.NoError(t, ta.UserRepo.LoadRoles(user))
+	assert.True(t, user.HasRole(models.RoleAdmin))
+
+	c, _ = newTestCLI(ta.DB, "another-pass\n")
+	assert.Error(t, c.Run([]string{"user", "create", "ops@example.com"}), "the email is taken")
+
+	c, _ = newTestCLI(ta.DB, "short\n")
+	assert.ErrorContains(t, c.Run([]string{"user", "create", "new@example.com"}), "at least")
+
+	c, _ = newTestCLI(ta.DB, "")
+	assert.ErrorContains(t, c.Run([]string{"user", "create", "new@example.com"}), "no password")
+}
+
+func TestCLI_UserResetPasswordAndPromote(t *testing.T) {
+	ta := SetupTestApp(t)
+	defer ta.TeardownTestApp()
+
+	user, err := ta.CreateTestUser("member@example.com", "old-password")
+	require.NoError(t, err)
+	lockedUntil := time.Now().Add(time.Hour)
+	user.LockedUntil = &lockedUntil
+	require.NoError(t, ta.UserRepo.UpdateLoginState(user))
+
+	c, _ := newTestCLI(ta.DB, "new-password\n")
+	require.NoError(t, c.Run([]string{"user", "reset-password", "member@example.com"}))
+
+	user, err = ta.UserRepo.FindByEmail("member@example.com")
+	require.NoError(t, err)
+	assert.True(t, user.CheckPassword("new-password"))
+	assert.NotNil(t, user.PasswordChangedAt, "older sessions are invalidated")
+	assert.Nil(t, user.LockedUntil)
+
+	c, stdout := newTestCLI(ta.DB, "")
+	require.NoError(t, c.Run([]string{"user", "promote", "member@example.com"}))
+	assert.Contains(t, stdout.String(), "Granted admin")
+	require.NoError(t, c.Run([]string{"user", "promote", "member@example.com"}), "promoting twice is harmless")
+	require.NoError(t, ta.UserRepo.LoadRoles(user))
+	assert.True(t, user.HasRole(models.RoleAdmin))
+	assert.Len(t, user.Roles, 2)
+
+	assert.ErrorContains(t, c.Run([]string{"user", "promote", "-role", "owner", "member@example.com"}), "db seed")
+	assert.ErrorContains(t, c.Run([]string{"user", "promote", "nobody@example.com"}), "no user")
+}
+
+func TestCLI_Database(t *testing.T) {
+	db := openTestDB(t)
+
+	c, stdout := newTestCLI(db, "")
+	require.NoError(t, c.Run([]string{"db", "status"}))
+	assert.Contains(t, stdout.String(), "pending  20250101000000")
+
+	stdout.Reset()
+	require.NoError(t, c.Run([]string{"db", "migrate"}))
+	assert.Contains(t, stdout.String(), "Applied 20250101000000_create_schema")
+	assert.True(t, db.Migrator().HasTable(&models.User{}))
+
+	stdout.Reset()
+	require.NoError(t, c.Run([]string{"db", "migrate"}))
+	assert.Equal(t, "Nothing to migrate\n", stdout.String())
+
+	require.NoError(t, c.Run([]string{"db", "seed"}))
+	_, err := models.NewRoleRepository(db).FindByName(models.RoleAdmin)
+	assert.NoError(t, err)
+
+	stdout.Reset()
+	require.NoError(t, c.Run([]string{"db", "rollback"}))
+	assert.Contains(t, stdout.String(), "Rolled back 20250102000000")
+
+	stdout.Reset()
+	require.NoError(t, c.Run([]string{"db", "status"}))
+	assert.Contains(t, stdout.String(), "up       20250101000000")
+	assert.Contains(t, stdout.String(), "pending  20250102000000")
+
+	c.MigrationsDir = t.TempDir()
+	c.Now = func() time.Time { return time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC) }
+	require.NoError(t, c.Run([]string{"db", "new", "-go", "backfill_users"}))
+	_, err = os.Stat(filepath.Join(c.MigrationsDir, "20250304050607_backfill_users.go"))
+	assert.NoError(t, err)
+}
+
+func TestCLI_CommandsCloseTheDatabase(t *testing.T) {
+	ta := SetupTestApp(t)
+	defer ta.TeardownTestApp()
+
+	commands := [][]string{
+		{"user", "create", "ops@example.com"},
+		{"user", "reset-password", "ops@example.com"},
+		{"user", "promote", "ops@example.com"},
+		{"db", "status"},
+		{"db", "seed"},
+		{"db", "migrate"},
+		{"db", "rollback"},
+	}
+	for _, args := range commands {
+		c, _ := newTestCLI(ta.DB, "s3cret-pass\n")
+		opened, closed := 0, 0
+		c.OpenDatabase = func() (*gorm.DB, error) {
+			opened++
+			return ta.DB, nil
+		}
+		c.CloseDatabase = func(*gorm.DB) error {
+			closed++
+			return nil
+		}
+
+		_ = c.Run(args) // whether or not it succeeds, the connection is closed
+		assert.Equal(t, 1, opened, "%v", args)
+		assert.Equal(t, opened, closed, "%v closes what it opens", args)
+	}
+}
+
+func TestCLI_Routes(t *testing.T) {
+	c, stdout := newTestCLI(nil, "")
+	require.NoError(t, c.Run([]string{"routes"}))
+
+	out := stdout.String()
+	assert.Regexp(t, `(?m)^POST\s+/login$`, out)
+	assert.Regexp(t, `(?m)^PATCH\s+/api/v1/me$`, out)
+	assert.NotContains(t, out, "HEAD")
+}
+
+func TestCLI_UsageErrors(t *testing.T) {
+	c, _ := newTestCLI(nil, "")
+
+	for _, args := range [][]string{
+		{"frobnicate"},
+		{"db"},
+		{"db", "rollback", "zero"},
+		{"user", "create"},
+		{"user", "promote", "-bogus", "a@example.com"},
+	} {
+		var usageErr *cli.UsageError
+		assert.ErrorAs(t, c.Run(args), &usageErr, "%v", args)
+	}
+
+	t.Setenv("ENV", "production")
+	err := c.Run([]string{"db", "drop"})
+	assert.ErrorContains(t, err, "-force")
+}
+
+func TestCLI_DatabaseReset(t *testing.T) {
+	dbConfig := &config.DatabaseConfig{Adapter: "sqlite3", Database: filepath.Join(t.TempDir(), "reset.sqlite3")}
+
+	var stdout bytes.Buffer
+	c := cli.New()
+	c.Stdout = &stdout
+	c.Stderr = &bytes.Buffer{}
+	c.DatabaseConfig = func() (*config.DatabaseConfig, error) { return dbConfig, nil }
+
+	require.NoError(t, c.Run([]string{"db", "create"}))
+	require.NoError(t, c.Run([]string{"db", "reset"}))
+	out := stdout.String()
+	assert.Contains(t, out, "Dropped database")
+	assert.Contains(t, out, "Applied 20250101000000_create_schema")
+	assert.Contains(t, out, "Seeded roles and permissions")
+
+	require.NoError(t, c.Run([]string{"db", "drop"}))
+	_, err := os.Stat(dbConfig.Database)
+	assert.True(t, os.IsNotExist(err))
+}
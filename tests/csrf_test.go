@@ -0,0 +1,224 @@
+package tests
+
+import (
+	"fresh/app/apperror"
+	"fresh/app/middleware"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSRF_IssuesCookieOnGET(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	cookie, err := testApp.CSRFCookie()
+	require.NoError(t, err)
+	assert.NotEmpty(t, cookie.Value)
+	assert.True(t, cookie.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+}
+
+func TestCSRF_RejectsStateChangingRequests(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	csrfCookie, err := testApp.CSRFCookie()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie *http.Cookie
+		token  string
+	}{
+		{name: "login without token", path: "/login"},
+		{name: "register without token", path: "/register", cookie: csrfCookie},
+		{name: "logout with mismatched token", path: "/logout", cookie: csrfCookie, token: "forged"},
+		{name: "token without cookie", path: "/login", token: csrfCookie.Value},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Set("email", "attacker@example.com")
+			form.Set("password", "password123")
+			if tt.token != "" {
+				form.Set(middleware.CSRFFieldName, tt.token)
+			}
+
+			req, err := http.NewRequest("POST", tt.path, strings.NewReader(form.Encode()))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			resp, err := testApp.App.Test(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		})
+	}
+
+	// The rejected register request must not have created an account
+	_, err = testApp.UserRepo.FindByEmail("attacker@example.com")
+	assert.Error(t, err)
+}
+
+func TestCSRF_AcceptsHeaderToken(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	csrfCookie, err := testApp.CSRFCookie()
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("POST", "/logout", nil)
+	require.NoError(t, err)
+	req.AddCookie(csrfCookie)
+	req.Header.Set(middleware.CSRFHeaderName, csrfCookie.Value)
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+}
+
+// csrfCookieFrom returns the CSRF cookie a response set, or nil
+func csrfCookieFrom(resp *http.Response) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == middleware.CSRFCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestCSRF_TokenRotatesOnLoginAndLogout(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, err := testApp.CreateTestUser("rotate@example.com", "password123")
+	require.NoError(t, err)
+
+	req, err := testApp.NewFormRequest("POST", "/login", url.Values{
+		"email":    {"rotate@example.com"},
+		"password": {"password123"},
+	})
+	require.NoError(t, err)
+	anonymous, err := req.Cookie(middleware.CSRFCookieName)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	signedIn := csrfCookieFrom(resp)
+	require.NotNil(t, signedIn, "signing in issues a new token")
+	assert.NotEqual(t, anonymous.Value, signedIn.Value)
+	session := sessionCookieFrom(resp)
+	require.NotNil(t, session)
+
+	logout := func(token string) *http.Response {
+		req, err := http.NewRequest("POST", "/logout", nil)
+		require.NoError(t, err)
+		req.AddCookie(signedIn)
+		req.AddCookie(session)
+		req.Header.Set(middleware.CSRFHeaderName, token)
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// A token from before sign-in, e.g. one an attacker planted, is dead
+	assert.Equal(t, http.StatusForbidden, logout(anonymous.Value).StatusCode)
+
+	resp = logout(signedIn.Value)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	signedOut := csrfCookieFrom(resp)
+	require.NotNil(t, signedOut, "signing out issues a new token")
+	assert.NotEqual(t, signedIn.Value, signedOut.Value)
+}
+
+func TestCSRF_BearerRequestsOptOut(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	testApp.App.Post("/test/api", func(c *fiber.Ctx) error {
+		return c.SendStatus(http.StatusNoContent)
+	})
+
+	req, err := http.NewRequest("POST", "/test/api", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer some-api-token")
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestCSRF_CookieAuthenticatedAPIRequests(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("api-csrf@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	patch := func(cookies []*http.Cookie, token string) *http.Response {
+		req, err := http.NewRequest("PATCH", "/api/v1/me", strings.NewReader(`{"current_password": "password123", "email": "moved@example.com"}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(middleware.CSRFHeaderName, token)
+		}
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// A session cookie alone is what a cross-site request would carry
+	resp := patch([]*http.Cookie{session}, "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, apperror.MIMEProblemJSON, resp.Header.Get("Content-Type"))
+
+	unchanged, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "api-csrf@example.com", unchanged.Email)
+
+	// API clients read the token from the response header
+	req, err := http.NewRequest("GET", "/api/v1/me", nil)
+	require.NoError(t, err)
+	req.AddCookie(session)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	csrfCookie := csrfCookieFrom(resp)
+	require.NotNil(t, csrfCookie)
+	assert.Equal(t, csrfCookie.Value, resp.Header.Get(middleware.CSRFHeaderName))
+
+	resp = patch([]*http.Cookie{session, csrfCookie}, csrfCookie.Value)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Signing in through the API hands over the new token the same way
+	resp, _ = apiRequest(t, testApp, "POST", "/api/v1/sessions", map[string]string{
+		"email": "moved@example.com", "password": "password123",
+	})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	signedIn := csrfCookieFrom(resp)
+	require.NotNil(t, signedIn)
+	assert.Equal(t, signedIn.Value, resp.Header.Get(middleware.CSRFHeaderName))
+}
@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"context"
+	"fresh/app/models"
+	"fresh/app/services"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var verifyLinkPattern = regexp.MustCompile(`/verify-email/([A-Za-z0-9_.-]+)`)
+
+// verificationTokenFromMail pulls the token out of the last verification email
+func verificationTokenFromMail(t *testing.T, mailer *services.MemoryMailer) string {
+	msg := mailer.LastMessage()
+	require.NotNil(t, msg, "expected a verification email")
+
+	match := verifyLinkPattern.FindStringSubmatch(msg.Text)
+	require.Len(t, match, 2, "verification email should contain a link")
+	return match[1]
+}
+
+func TestEmailVerification_RegisterSendsLink(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	form := url.Values{}
+	form.Set("email", "newcomer@example.com")
+	form.Set("password", "password123")
+
+	req, err := testApp.NewFormRequest("POST", "/register", form)
+	require.NoError(t, err)
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/verify-email", resp.Header.Get("Location"))
+
+	msg := testApp.Mailer.LastMessage()
+	require.NotNil(t, msg)
+	assert.Equal(t, "newcomer@example.com", msg.To)
+	assert.Equal(t, "verify_email", msg.Subject)
+
+	user, err := testApp.UserRepo.FindByEmail("newcomer@example.com")
+	require.NoError(t, err)
+	assert.False(t, user.EmailVerified())
+}
+
+func TestEmailVerification_FollowLink(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.UserRepo.Create("unverified@example.com", "password123")
+	require.NoError(t, err)
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	// Unverified users are sent to the notice instead of the dashboard
+	req, _ := http.NewRequest("GET", "/dashboard", nil)
+	req.AddCookie(cookie)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/verify-email", resp.Header.Get("Location"))
+
+	require.NoError(t, testApp.AuthService.SendEmailVerification(context.Background(), user))
+	token := verificationTokenFromMail(t, testApp.Mailer)
+
+	// The link works without a session, e.g. opened on another device
+	req, _ = http.NewRequest("GET", "/verify-email/"+token, nil)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login?verified=1", resp.Header.Get("Location"))
+
+	verified, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, verified.EmailVerified())
+
+	req, _ = http.NewRequest("GET", "/dashboard", nil)
+	req.AddCookie(cookie)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestEmailVerification_RejectsBadTokens(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.UserRepo.Create("target@example.com", "password123")
+	require.NoError(t, err)
+	other, err := testApp.UserRepo.Create("other@example.com", "password123")
+	require.NoError(t, err)
+
+	require.NoError(t, testApp.AuthService.SendEmailVerification(context.Background(), other))
+	otherToken := verificationTokenFromMail(t, testApp.Mailer)
+
+	require.NoError(t, testApp.AuthService.SendEmailVerification(context.Background(), user))
+	token := verificationTokenFromMail(t, testApp.Mailer)
+
+	// Swap in another user's payload while keeping this token's signature
+	otherPayload, _, _ := strings.Cut(otherToken, ".")
+	_, signature, _ := strings.Cut(token, ".")
+	forged := otherPayload + "." + signature
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"garbage", "not-a-token"},
+		{"truncated signature", token[:len(token)-4]},
+		{"payload from another token", forged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testApp.AuthService.VerifyEmail(context.Background(), tt.token)
+			assert.ErrorIs(t, err, services.ErrInvalidVerificationToken)
+		})
+	}
+
+	// A link stops working once the address it was sent to changes
+	require.NoError(t, testApp.DB.Model(&models.User{}).Where("id = ?", user.ID).
+		Update("email", "changed@example.com").Error)
+	_, err = testApp.AuthService.VerifyEmail(context.Background(), token)
+	assert.ErrorIs(t, err, services.ErrInvalidVerificationToken)
+
+	reloaded, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.False(t, reloaded.EmailVerified())
+}
+
+func TestEmailVerification_ExpiredLink(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	mailer := services.NewMemoryMailer()
+	authService := services.NewAuthService(testApp.UserRepo, services.NewMemorySessionStore(),
+		services.WithEmailVerification(testSecretKeyBase, services.EmailVerificationConfig{
+			TTL:          -time.Minute,
+			ResendWindow: time.Hour,
+			MaxResends:   3,
+		}),
+		services.WithMailer(mailer, testApp.TemplateService.(services.MailRenderer), "http://localhost:3000"),
+	)
+
+	user, err := testApp.UserRepo.Create("late@example.com", "password123")
+	require.NoError(t, err)
+
+	require.NoError(t, authService.SendEmailVerification(context.Background(), user))
+	_, err = authService.VerifyEmail(context.Background(), verificationTokenFromMail(t, mailer))
+	assert.ErrorIs(t, err, services.ErrInvalidVerificationToken)
+}
+
+func TestEmailVerification_ResendThrottled(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.UserRepo.Create("impatient@example.com", "password123")
+	require.NoError(t, err)
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	maxResends := services.DefaultEmailVerificationConfig().MaxResends
+	for i := 0; i < maxResends; i++ {
+		req, err := testApp.NewFormRequest("POST", "/verify-email/resend", nil, cookie)
+		require.NoError(t, err)
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Len(t, testApp.Mailer.Messages(), maxResends)
+
+	req, err := testApp.NewFormRequest("POST", "/verify-email/resend", nil, cookie)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Len(t, testApp.Mailer.Messages(), maxResends, "throttled resends must not send mail")
+}
+
+func TestEmailVerification_VerifiedUsersSkipNotice(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("done@example.com", "password123")
+	require.NoError(t, err)
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/verify-email", nil)
+	req.AddCookie(cookie)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/dashboard", resp.Header.Get("Location"))
+
+	require.NoError(t, testApp.AuthService.SendEmailVerification(context.Background(), user))
+	assert.Empty(t, testApp.Mailer.Messages(), "verified users get no verification email")
+}
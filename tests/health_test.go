@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fresh/app/controllers"
+	"fresh/app/health"
+	"fresh/db/migrations"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// getJSON requests path and decodes the JSON reply into v
+func getJSON(t *testing.T, app *fiber.App, path string, v interface{}) int {
+	resp, err := app.Test(httptest.NewRequest("GET", path, nil), 5000)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, "no-store", resp.Header.Get(fiber.HeaderCacheControl), path)
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(raw, v), "expected JSON, got %q", raw)
+	return resp.StatusCode
+}
+
+func findCheck(report health.Report, name string) *health.Result {
+	for i := range report.Checks {
+		if report.Checks[i].Name == name {
+			return &report.Checks[i]
+		}
+	}
+	return nil
+}
+
+func TestHealth_Liveness(t *testing.T) {
+	testApp := SetupTestApp(t)
+	testApp.HealthChecks.Register(health.CheckFunc("broken", func(context.Context) error {
+		return errors.New("down")
+	}))
+
+	var body map[string]string
+	status := getJSON(t, testApp.App, "/healthz", &body)
+	assert.Equal(t, fiber.StatusOK, status, "liveness doesn't depend on the checks")
+	assert.Equal(t, "ok", body["status"])
+}
+
+func TestHealth_Readiness(t *testing.T) {
+	testApp := SetupTestApp(t)
+
+	var report health.Report
+	status := getJSON(t, testApp.App, "/readyz", &report)
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Equal(t, health.StatusOK, report.Status)
+	for _, name := range []string{"database", "migrations"} {
+		check := findCheck(report, name)
+		require.NotNil(t, check, name)
+		assert.Equal(t, health.StatusOK, check.Status, name)
+		assert.GreaterOrEqual(t, check.LatencyMS, 0.0, name)
+	}
+}
+
+func TestHealth_ReadinessFailures(t *testing.T) {
+	testApp := SetupTestApp(t)
+	testApp.HealthChecks.Timeout = 100 * time.Millisecond
+	testApp.HealthChecks.Register(health.CheckFunc("cache", func(context.Context) error {
+		return errors.New("connection refused")
+	}))
+	testApp.HealthChecks.Register(health.CheckFunc("search", func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}))
+
+	var report health.Report
+	status := getJSON(t, testApp.App, "/readyz", &report)
+	assert.Equal(t, fiber.StatusServiceUnavailable, status)
+	assert.Equal(t, health.StatusFail, report.Status)
+
+	assert.Equal(t, health.StatusOK, findCheck(report, "database").Status, "other checks still report")
+	cache := findCheck(report, "cache")
+	assert.Equal(t, health.StatusFail, cache.Status)
+	assert.Equal(t, "connection refused", cache.Error)
+	search := findCheck(report, "search")
+	assert.Equal(t, health.StatusFail, search.Status)
+	assert.Contains(t, search.Error, "timed out", "a hung check doesn't hold up the probe")
+	assert.Less(t, search.LatencyMS, 1000.0)
+}
+
+func TestHealth_MigrationsCheckIsReadOnly(t *testing.T) {
+	db := openTestDB(t)
+	all, err := migrations.All()
+	require.NoError(t, err)
+	migrator, err := migrations.NewMigrator(db)
+	require.NoError(t, err)
+	check := health.Migrations(migrator)
+
+	err = check.Check(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("%d pending", len(all)))
+	assert.False(t, db.Migrator().HasTable("schema_migrations"), "probes don't create tables")
+
+	_, err = migrator.Up()
+	require.NoError(t, err)
+	assert.NoError(t, check.Check(context.Background()))
+}
+
+func TestHealth_ReadinessFailsDuringShutdown(t *testing.T) {
+	testApp := SetupTestApp(t)
+	testApp.HealthChecks.MarkShuttingDown()
+
+	var report health.Report
+	status := getJSON(t, testApp.App, "/readyz", &report)
+	assert.Equal(t, fiber.StatusServiceUnavailable, status)
+	shutdown := findCheck(report, "shutdown")
+	require.NotNil(t, shutdown)
+	assert.Equal(t, health.ErrShuttingDown.Error(), shutdown.Error)
+	assert.Equal(t, health.StatusOK, findCheck(report, "database").Status)
+}
+
+func TestHealth_ProductionHidesErrors(t *testing.T) {
+	checks := health.NewRegistry(health.CheckFunc("database", func(context.Context) error {
+		return errors.New("dial tcp db.internal:5432: connection refused")
+	}))
+	app := fiber.New()
+	app.Get("/readyz", controllers.NewHealthController(checks, true).Readyz)
+
+	var report health.Report
+	status := getJSON(t, app, "/readyz", &report)
+	assert.Equal(t, fiber.StatusServiceUnavailable, status)
+	assert.Equal(t, health.StatusFail, report.Checks[0].Status)
+	assert.Empty(t, report.Checks[0].Error)
+}
+
+func TestHealth_Version(t *testing.T) {
+	testApp := SetupTestApp(t)
+
+	resp, err := testApp.App.Test(httptest.NewRequest("GET", "/version", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	var info map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, "dev", info["version"])
+	assert.Contains(t, info["go_version"], "go")
+}
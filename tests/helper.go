@@ -1,18 +1,31 @@
 package tests
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"fresh/app/apperror"
 	"fresh/app/controllers"
+	"fresh/app/health"
+	"fresh/app/logging"
+	"fresh/app/metrics"
+	"fresh/app/middleware"
 	"fresh/app/models"
 	"fresh/app/services"
+	"fresh/config"
+	"fresh/db/migrations"
 	"fresh/routes"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 // TestApp holds the test application setup
@@ -20,59 +33,220 @@ type TestApp struct {
 	App             *fiber.App
 	DB              *gorm.DB
 	UserRepo        *models.UserRepository
+	SessionStore    services.SessionStore
+	Mailer          *services.MemoryMailer
 	AuthService     *services.AuthService
 	TemplateService services.TemplateRenderer
 	AuthController  *controllers.AuthController
 	DashController  *controllers.DashboardController
+	PasswordCtrl    *controllers.PasswordController
+	VerifyCtrl      *controllers.VerificationController
+	TwoFactor       *services.TwoFactorService
+	TwoFactorCtrl   *controllers.TwoFactorController
+	OIDC            *services.OIDCService
+	OIDCCtrl        *controllers.OIDCController
+	AdminUsers      *services.UserAdminService
+	AdminUsersCtrl  *controllers.AdminUsersController
+	APITokens       *services.APITokenService
+	APITokenCtrl    *controllers.APITokenController
+	APIAuthCtrl     *controllers.APIAuthController
+	APIMeCtrl       *controllers.APIMeController
+	HealthChecks    *health.Registry
+	Metrics         *metrics.Metrics
+	// Logs holds what the app logged, as JSON lines
+	Logs *LogBuffer
 }
 
-// SetupTestApp creates a test application with in-memory SQLite database
-func SetupTestApp(t *testing.T) *TestApp {
-	// Create in-memory SQLite database for testing
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent), // Quiet during tests
+// LogBuffer collects log output across goroutines
+type LogBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *LogBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// The OpenID Connect provider shared by the package's tests, configured as
+// the "standin" social login provider. It starts with the first test app.
+var (
+	standInIdP     *StandInIdP
+	standInIdPOnce sync.Once
+)
+
+func startStandInIdP(t *testing.T) *StandInIdP {
+	standInIdPOnce.Do(func() {
+		idp, err := NewStandInIdP()
+		if err != nil {
+			t.Fatalf("Failed to start stand-in IdP: %v", err)
+		}
+		standInIdP = idp
 	})
+	return standInIdP
+}
+
+// testSecretKeyBase signs verification links in tests
+const testSecretKeyBase = "test-only-secret-key-base-not-for-production"
+
+// openTestDB connects to the test environment's database from
+// config/database.yml, a private in-memory SQLite database, the same way the
+// app connects to its own
+func openTestDB(t *testing.T) *gorm.DB {
+	dbConfig, err := config.LoadConfig("../config/database.yml")
+	if err != nil {
+		t.Fatalf("Failed to load database config: %v", err)
+	}
+	db, err := dbConfig.ConnectDatabase("test")
 	if err != nil {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
-	// Auto migrate
-	err = db.AutoMigrate(&models.User{})
-	if err != nil {
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// SetupTestApp creates a test application with in-memory SQLite database
+func SetupTestApp(t *testing.T) *TestApp {
+	db := openTestDB(t)
+
+	// Build the schema the way the app does
+	if err := config.MigrateDatabase(db); err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
 
+	if err := models.NewRoleRepository(db).Seed(models.DefaultRoles()); err != nil {
+		t.Fatalf("Failed to seed roles: %v", err)
+	}
+
 	// Create mock template service for tests
 	templateService := &MockTemplateService{}
 
 	// Initialize services and controllers
 	userRepo := models.NewUserRepository(db)
-	authService := services.NewAuthService(userRepo)
-	authController := controllers.NewAuthController(authService, templateService)
+	sessionStore := services.NewMemorySessionStore()
+	mailer := services.NewMemoryMailer()
+	twoFactor, err := services.NewTwoFactorService(userRepo, models.NewRecoveryCodeRepository(db), testSecretKeyBase, "Fresh")
+	if err != nil {
+		t.Fatalf("Failed to create two-factor service: %v", err)
+	}
+	appMetrics := metrics.New()
+	authService := services.NewAuthService(userRepo, sessionStore,
+		services.WithMetrics(appMetrics),
+		services.WithPasswordResetTokens(models.NewPasswordResetTokenRepository(db)),
+		services.WithEmailVerification(testSecretKeyBase, services.DefaultEmailVerificationConfig()),
+		services.WithTwoFactor(twoFactor),
+		services.WithMailer(mailer, templateService, "http://localhost:3000"),
+	)
+	oidcService, err := services.NewOIDCService(config.OIDCConfig{
+		Providers: []config.OIDCProviderConfig{{
+			Name:         "standin",
+			DisplayName:  "Stand-in IdP",
+			Issuer:       startStandInIdP(t).URL(),
+			ClientID:     standInClientID,
+			ClientSecret: standInClientSecret,
+		}},
+	}, userRepo, models.NewUserIdentityRepository(db), testSecretKeyBase, "http://localhost:3000")
+	if err != nil {
+		t.Fatalf("Failed to create OIDC service: %v", err)
+	}
+
+	authController := controllers.NewAuthController(authService, oidcService, templateService)
 	dashController := controllers.NewDashboardController(authService, templateService)
+	passwordCtrl := controllers.NewPasswordController(authService, templateService)
+	verifyCtrl := controllers.NewVerificationController(authService, templateService)
+	twoFactorCtrl := controllers.NewTwoFactorController(authService, twoFactor, templateService)
+	oidcCtrl := controllers.NewOIDCController(authService, oidcService, templateService)
+	adminUsers := services.NewUserAdminService(userRepo, models.NewRoleRepository(db), sessionStore, authService)
+	adminUsersCtrl := controllers.NewAdminUsersController(authService, adminUsers, templateService)
+	apiTokens := services.NewAPITokenService(models.NewAPITokenRepository(db), userRepo)
+	apiTokenCtrl := controllers.NewAPITokenController(authService, apiTokens, templateService)
+	apiAuthCtrl := controllers.NewAPIAuthController(authService)
+	apiMeCtrl := controllers.NewAPIMeController(authService)
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("Failed to create migrator: %v", err)
+	}
+	healthChecks := health.NewRegistry(health.Database(db), health.Migrations(migrator))
+
+	errorHandler := apperror.Handler(apperror.HandlerConfig{Renderer: templateService})
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		// Disable startup message in tests
 		DisableStartupMessage: true,
-		// Custom error handler for tests
+		// The app's error handler, logging through the test
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			t.Logf("Test app error: %v", err)
-			return c.Status(500).SendString("Internal Server Error")
+			return errorHandler(c, err)
 		},
 	})
 
+	// Request IDs and access logs, as the app has them
+	logs := &LogBuffer{}
+	logger, err := logging.New(config.LogConfig{Format: "json", Level: "debug"}, logs)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	app.Use(middleware.RequestID(logger))
+	app.Use(middleware.AccessLog())
+
 	// Setup routes
-	routes.SetupRoutes(app, authController, dashController, authService)
+	routes.SetupRoutes(app, routes.Dependencies{
+		AuthController:         authController,
+		DashboardController:    dashController,
+		PasswordController:     passwordCtrl,
+		VerificationController: verifyCtrl,
+		TwoFactorController:    twoFactorCtrl,
+		OIDCController:         oidcCtrl,
+		AdminUsersController:   adminUsersCtrl,
+		APITokenController:     apiTokenCtrl,
+		APIAuthController:      apiAuthCtrl,
+		APIMeController:        apiMeCtrl,
+		HealthController:       controllers.NewHealthController(healthChecks, false),
+		AuthService:            authService,
+		APITokenService:        apiTokens,
+		TemplateService:        templateService,
+		Metrics:                appMetrics,
+		MetricsHandler:         appMetrics.Handler(""),
+	})
 
 	return &TestApp{
 		App:             app,
 		DB:              db,
 		UserRepo:        userRepo,
+		SessionStore:    sessionStore,
+		Mailer:          mailer,
 		AuthService:     authService,
 		TemplateService: templateService,
 		AuthController:  authController,
 		DashController:  dashController,
+		PasswordCtrl:    passwordCtrl,
+		VerifyCtrl:      verifyCtrl,
+		TwoFactor:       twoFactor,
+		TwoFactorCtrl:   twoFactorCtrl,
+		OIDC:            oidcService,
+		OIDCCtrl:        oidcCtrl,
+		AdminUsers:      adminUsers,
+		AdminUsersCtrl:  adminUsersCtrl,
+		APITokens:       apiTokens,
+		APITokenCtrl:    apiTokenCtrl,
+		APIAuthCtrl:     apiAuthCtrl,
+		APIMeCtrl:       apiMeCtrl,
+		HealthChecks:    healthChecks,
+		Metrics:         appMetrics,
+		Logs:            logs,
 	}
 }
 
@@ -84,9 +258,86 @@ func (ta *TestApp) TeardownTestApp() {
 	}
 }
 
-// CreateTestUser creates a user for testing
+// CreateTestUser creates a user with a verified email address for testing
 func (ta *TestApp) CreateTestUser(email, password string) (*models.User, error) {
-	return ta.UserRepo.Create(email, password)
+	user, err := ta.UserRepo.Create(email, password)
+	if err != nil {
+		return nil, err
+	}
+	if err := ta.UserRepo.MarkEmailVerified(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateAdminUser creates a verified user with the admin role
+func (ta *TestApp) CreateAdminUser(email, password string) (*models.User, error) {
+	user, err := ta.CreateTestUser(email, password)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.NewRoleRepository(ta.DB).AssignRole(user, models.RoleAdmin); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SessionCookie starts a session for the user and returns the cookie a
+// browser would send back on subsequent requests
+func (ta *TestApp) SessionCookie(user *models.User) (*http.Cookie, error) {
+	session, err := ta.SessionStore.Create(context.Background(), user.ID, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Cookie{Name: services.DefaultSessionConfig().CookieName, Value: session.ID}, nil
+}
+
+// CSRFCookie performs a GET like a browser loading a form and returns the
+// CSRF cookie the app issued
+func (ta *TestApp) CSRFCookie() (*http.Cookie, error) {
+	req, err := http.NewRequest("GET", "/login", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ta.App.Test(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == middleware.CSRFCookieName {
+			return cookie, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s cookie issued", middleware.CSRFCookieName)
+}
+
+// NewFormRequest builds a form POST carrying a valid CSRF token, plus any
+// extra cookies (e.g. a session) the request should send
+func (ta *TestApp) NewFormRequest(method, path string, form url.Values, cookies ...*http.Cookie) (*http.Request, error) {
+	csrfCookie, err := ta.CSRFCookie()
+	if err != nil {
+		return nil, err
+	}
+
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(middleware.CSRFFieldName, csrfCookie.Value)
+
+	req, err := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(csrfCookie)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	return req, nil
 }
 
 // MockTemplateService is a mock template service for tests
@@ -100,6 +351,14 @@ func (m *MockTemplateService) Render(c *fiber.Ctx, templateName string, data int
 	})
 }
 
+func (m *MockTemplateService) RenderMail(name string, data interface{}) (*services.Message, error) {
+	// Mock mail rendering: the template name as subject, the data as body
+	return &services.Message{
+		Subject: name,
+		Text:    fmt.Sprintf("%v", data),
+	}, nil
+}
+
 // TestMain sets up and tears down for all tests in the package
 func TestMain(m *testing.M) {
 	// Setup
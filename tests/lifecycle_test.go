@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fresh/app/lifecycle"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves a /slow route, which takes delay to answer, until the
+// returned cancel function is called. Serve's result arrives on the channel.
+func startServer(t *testing.T, delay time.Duration, timeout time.Duration, hooks *lifecycle.Hooks) (string, context.CancelFunc, <-chan error, <-chan struct{}) {
+	started := make(chan struct{}, 1)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		started <- struct{}{}
+		time.Sleep(delay)
+		return c.SendString("done")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- lifecycle.Serve(ctx, app, ln, lifecycle.Config{ShutdownTimeout: timeout}, hooks)
+	}()
+	t.Cleanup(cancel)
+
+	return "http://" + ln.Addr().String(), cancel, served, started
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	var order []string
+	hooks := &lifecycle.Hooks{}
+	hooks.Notify(func() {
+		order = append(order, "notify")
+	})
+	hooks.Add("database", func(context.Context) error {
+		order = append(order, "database")
+		return nil
+	})
+	hooks.Add("jobs", func(context.Context) error {
+		order = append(order, "jobs")
+		return nil
+	})
+
+	baseURL, shutdown, served, started := startServer(t, 300*time.Millisecond, 5*time.Second, hooks)
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(baseURL + "/slow")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	shutdown()
+
+	response := <-responses
+	require.NoError(t, response.err, "the request in flight when the signal came is answered")
+	assert.Equal(t, "done", response.body)
+
+	require.NoError(t, <-served)
+	assert.Equal(t, []string{"notify", "jobs", "database"}, order, "listeners hear of the shutdown first; hooks run newest first, after the server stopped")
+
+	_, err := http.Get(baseURL + "/slow")
+	assert.Error(t, err, "new connections are refused")
+}
+
+func TestServe_DrainTimeout(t *testing.T) {
+	hookRan := false
+	hooks := &lifecycle.Hooks{}
+	hooks.Add("database", func(context.Context) error {
+		hookRan = true
+		return nil
+	})
+
+	baseURL, shutdown, served, started := startServer(t, 2*time.Second, 100*time.Millisecond, hooks)
+	go http.Get(baseURL + "/slow")
+
+	<-started
+	shutdown()
+
+	err := <-served
+	assert.ErrorIs(t, err, lifecycle.ErrDrainTimeout)
+	assert.True(t, hookRan, "hooks run even when draining timed out")
+}
+
+func TestHooks_RunCollectsFailures(t *testing.T) {
+	ran := 0
+	hooks := &lifecycle.Hooks{}
+	hooks.Add("database", func(context.Context) error {
+		ran++
+		return nil
+	})
+	hooks.Add("mailer", func(context.Context) error {
+		ran++
+		return errors.New("queue not flushed")
+	})
+
+	err := hooks.Run(context.Background())
+	assert.ErrorContains(t, err, "shutdown hook mailer: queue not flushed")
+	assert.Equal(t, 2, ran, "a failing hook doesn't stop the others")
+
+	require.NoError(t, hooks.Run(context.Background()))
+	assert.Equal(t, 2, ran, "hooks run once")
+}
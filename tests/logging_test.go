@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fresh/app/logging"
+	"fresh/app/services"
+	"fresh/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logLines decodes the JSON log lines with the given message
+func logLines(t *testing.T, logs *LogBuffer, msg string) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, raw := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(raw), &line), raw)
+		if line["msg"] == msg {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestRequestID_GeneratedAndEchoed(t *testing.T) {
+	testApp := SetupTestApp(t)
+
+	resp, err := testApp.App.Test(httptest.NewRequest("GET", "/login", nil))
+	require.NoError(t, err)
+	id := resp.Header.Get(fiber.HeaderXRequestID)
+	assert.Len(t, id, 32)
+
+	requests := logLines(t, testApp.Logs, "request")
+	require.Len(t, requests, 1)
+	assert.Equal(t, id, requests[0]["request_id"])
+	assert.Equal(t, "/login", requests[0]["path"])
+	assert.Equal(t, float64(fiber.StatusOK), requests[0]["status"])
+
+	resp, err = testApp.App.Test(httptest.NewRequest("GET", "/login", nil))
+	require.NoError(t, err)
+	assert.NotEqual(t, id, resp.Header.Get(fiber.HeaderXRequestID), "every request gets its own")
+}
+
+func TestRequestID_Propagated(t *testing.T) {
+	testApp := SetupTestApp(t)
+
+	req := httptest.NewRequest("GET", "/no/such/page?token=secret", nil)
+	req.Header.Set(fiber.HeaderXRequestID, "edge-4f1c:7")
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	assert.Equal(t, "edge-4f1c:7", resp.Header.Get(fiber.HeaderXRequestID))
+
+	requests := logLines(t, testApp.Logs, "request")
+	require.Len(t, requests, 1)
+	assert.Equal(t, "edge-4f1c:7", requests[0]["request_id"])
+	assert.Equal(t, float64(fiber.StatusNotFound), requests[0]["status"], "the status the error handler sent")
+	assert.NotContains(t, testApp.Logs.String(), "secret", "query strings aren't logged")
+
+	for _, bad := range []string{"has spaces", "quote\"d", strings.Repeat("a", 129)} {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.Header.Set(fiber.HeaderXRequestID, bad)
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		assert.Len(t, resp.Header.Get(fiber.HeaderXRequestID), 32, "%q is replaced", bad)
+	}
+}
+
+func TestAccessLog_MasksTokensInPaths(t *testing.T) {
+	testApp := SetupTestApp(t)
+	const secret = "s3cr3t-link-token_value"
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/password/reset/"+secret, nil),
+		httptest.NewRequest("GET", "/verify-email/"+secret, nil),
+		// Turned away by the CSRF middleware before any route runs
+		httptest.NewRequest("POST", "/password/reset/"+secret, nil),
+	} {
+		_, err := testApp.App.Test(req)
+		require.NoError(t, err)
+	}
+
+	var paths []interface{}
+	for _, line := range logLines(t, testApp.Logs, "request") {
+		paths = append(paths, line["path"])
+	}
+	assert.Equal(t, []interface{}{"/password/reset/:token", "/verify-email/:token", "/password/reset/:token"}, paths)
+	assert.NotContains(t, testApp.Logs.String(), secret)
+}
+
+func TestLogging_ControllersLogPerRequestWithoutEmails(t *testing.T) {
+	testApp := SetupTestApp(t)
+	_, err := testApp.AuthService.Register(context.Background(), "jane.doe@example.com", "password123")
+	require.NoError(t, err)
+
+	req, err := testApp.NewFormRequest("POST", "/login", url.Values{
+		"email":    {"jane.doe@example.com"},
+		"password": {"wrong-password"},
+	})
+	require.NoError(t, err)
+	req.Header.Set(fiber.HeaderXRequestID, "login-1")
+	_, err = testApp.App.Test(req)
+	require.NoError(t, err)
+
+	failures := logLines(t, testApp.Logs, "login failed")
+	require.Len(t, failures, 1)
+	assert.Equal(t, "login-1", failures[0]["request_id"], "controller lines carry the request ID")
+	assert.Equal(t, "j***@example.com", failures[0]["email"])
+	assert.NotContains(t, testApp.Logs.String(), "jane.doe@example.com")
+}
+
+// brokenAttemptStore fails to record anything
+type brokenAttemptStore struct{ services.AttemptStore }
+
+func (brokenAttemptStore) Record(context.Context, string, time.Time) error {
+	return errors.New("store unavailable")
+}
+
+func TestLogging_ServicesLogPerRequestWithoutEmails(t *testing.T) {
+	testApp := SetupTestApp(t)
+	authService := services.NewAuthService(testApp.UserRepo, testApp.SessionStore,
+		services.WithLoginThrottle(services.DefaultLoginThrottleConfig(), brokenAttemptStore{services.NewMemoryAttemptStore()}))
+
+	logger, err := logging.New(config.LogConfig{Format: "json"}, testApp.Logs)
+	require.NoError(t, err)
+	ctx := logging.NewContext(context.Background(), logger.With("request_id", "login-2"))
+	_, err = authService.Login(ctx, "jane.doe@example.com", "wrong-password", "192.0.2.1")
+	assert.ErrorIs(t, err, services.ErrInvalidCredentials)
+
+	failures := logLines(t, testApp.Logs, "failed to record attempt")
+	require.Len(t, failures, 3)
+	for i, bucket := range []string{"ip", "email", "failures:email"} {
+		assert.Equal(t, bucket, failures[i]["bucket"])
+		assert.Equal(t, "login-2", failures[i]["request_id"], "service lines carry the request ID")
+	}
+	assert.NotContains(t, testApp.Logs.String(), "jane.doe@example.com")
+	assert.NotContains(t, testApp.Logs.String(), "192.0.2.1")
+}
+
+func TestLogging_Config(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logging.New(config.LogConfig{Format: "text", Level: "warn"}, &buf)
+	require.NoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", "email", "bob@example.com")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "msg=shown email=b***@example.com")
+
+	_, err = logging.New(config.LogConfig{Format: "xml"}, &buf)
+	assert.Error(t, err)
+	_, err = logging.New(config.LogConfig{Level: "loud"}, &buf)
+	assert.Error(t, err)
+}
+
+func TestRedactEmail(t *testing.T) {
+	assert.Equal(t, "j***@example.com", logging.RedactEmail("jane@example.com"))
+	assert.Equal(t, "***", logging.RedactEmail("not-an-email"))
+	assert.Equal(t, "***", logging.RedactEmail("@example.com"))
+}
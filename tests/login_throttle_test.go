@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fresh/app/models"
+	"fresh/app/services"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newThrottledAuthService(testApp *TestApp, cfg services.LoginThrottleConfig) *services.AuthService {
+	return services.NewAuthService(testApp.UserRepo, testApp.SessionStore,
+		services.WithLoginThrottle(cfg, services.NewMemoryAttemptStore()))
+}
+
+func TestLogin_ThrottlesPerEmail(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, err := testApp.CreateTestUser("throttle@example.com", "password123")
+	require.NoError(t, err)
+
+	cfg := services.DefaultLoginThrottleConfig()
+	cfg.MaxPerEmail = 3
+	authService := newThrottledAuthService(testApp, cfg)
+
+	// Failures spread over several IPs still count against the email
+	for i := 0; i < cfg.MaxPerEmail; i++ {
+		_, err := authService.Login(context.Background(), "Throttle@example.com", "wrong", "192.0.2."+strconv.Itoa(i))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid credentials")
+	}
+
+	// Even the right password is refused until the window slides
+	_, err = authService.Login(context.Background(), "throttle@example.com", "password123", "192.0.2.100")
+	var throttled *services.TooManyAttemptsError
+	require.True(t, errors.As(err, &throttled), "expected TooManyAttemptsError, got %v", err)
+	assert.Greater(t, throttled.RetryAfter, 14*time.Minute)
+	assert.Contains(t, err.Error(), "too many attempts, try again in 15 minutes")
+}
+
+func TestLogin_ThrottlesPerIP(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	cfg := services.DefaultLoginThrottleConfig()
+	cfg.MaxPerIP = 3
+	authService := newThrottledAuthService(testApp, cfg)
+
+	// Unknown accounts count too, so spraying many emails is throttled
+	for i := 0; i < cfg.MaxPerIP; i++ {
+		_, err := authService.Login(context.Background(), "nobody"+strconv.Itoa(i)+"@example.com", "wrong", "198.51.100.7")
+		require.Error(t, err)
+	}
+
+	_, err := authService.Login(context.Background(), "someone-else@example.com", "wrong", "198.51.100.7")
+	var throttled *services.TooManyAttemptsError
+	assert.True(t, errors.As(err, &throttled), "expected TooManyAttemptsError, got %v", err)
+
+	// Another IP is unaffected
+	_, err = authService.Login(context.Background(), "someone-else@example.com", "wrong", "198.51.100.8")
+	assert.False(t, errors.As(err, &throttled))
+}
+
+func TestLogin_LocksAccountAfterConsecutiveFailures(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("lockout@example.com", "password123")
+	require.NoError(t, err)
+
+	cfg := services.DefaultLoginThrottleConfig()
+	cfg.MaxPerEmail = 100
+	cfg.MaxPerIP = 100
+	cfg.LockoutThreshold = 3
+	cfg.LockoutDuration = time.Hour
+	authService := newThrottledAuthService(testApp, cfg)
+
+	for i := 0; i < cfg.LockoutThreshold; i++ {
+		_, err := authService.Login(context.Background(), user.Email, "wrong", "203.0.113.1")
+		require.Error(t, err)
+	}
+
+	locked, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, locked.LockedUntil, "lockout must be persisted on the user")
+	assert.Greater(t, locked.LockedFor(), 59*time.Minute)
+
+	_, err = authService.Login(context.Background(), user.Email, "password123", "203.0.113.1")
+	var throttled *services.TooManyAttemptsError
+	require.True(t, errors.As(err, &throttled), "expected TooManyAttemptsError, got %v", err)
+
+	// Once the lockout has passed the right password works and clears it
+	past := time.Now().Add(-time.Minute)
+	locked.LockedUntil = &past
+	locked.FailedLoginAttempts = 2
+	require.NoError(t, testApp.UserRepo.UpdateLoginState(locked))
+
+	loggedIn, err := authService.Login(context.Background(), user.Email, "password123", "203.0.113.1")
+	require.NoError(t, err)
+	assert.Zero(t, loggedIn.FailedLoginAttempts)
+	assert.Nil(t, loggedIn.LockedUntil)
+}
+
+func TestLogin_UnknownEmailsLockOutLikeAccounts(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("lockout@example.com", "password123")
+	require.NoError(t, err)
+
+	cfg := services.DefaultLoginThrottleConfig()
+	cfg.MaxPerEmail = 100
+	cfg.MaxPerIP = 100
+	cfg.LockoutThreshold = 3
+	cfg.LockoutDuration = time.Hour
+	authService := newThrottledAuthService(testApp, cfg)
+
+	// The same failures get the same answers whether or not the account exists
+	for _, email := range []string{user.Email, "nobody@example.com"} {
+		for i := 0; i < cfg.LockoutThreshold; i++ {
+			_, err := authService.Login(context.Background(), email, "wrong", "203.0.113.1")
+			assert.ErrorIs(t, err, services.ErrInvalidCredentials, email)
+		}
+
+		_, err = authService.Login(context.Background(), email, "wrong", "203.0.113.1")
+		var throttled *services.TooManyAttemptsError
+		require.True(t, errors.As(err, &throttled), "expected TooManyAttemptsError for %s, got %v", email, err)
+		assert.Greater(t, throttled.RetryAfter, 59*time.Minute)
+	}
+}
+
+func TestRoutes_POST_Login_Throttled(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, err := testApp.CreateTestUser("route-throttle@example.com", "password123")
+	require.NoError(t, err)
+
+	attempt := func() *http.Response {
+		form := url.Values{}
+		form.Set("email", "route-throttle@example.com")
+		form.Set("password", "wrong")
+
+		req, err := testApp.NewFormRequest("POST", "/login", form)
+		require.NoError(t, err)
+
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	for i := 0; i < services.DefaultLoginThrottleConfig().MaxPerEmail; i++ {
+		resp := attempt()
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp := attempt()
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Greater(t, retryAfter, 0)
+}
+
+func TestDatabaseAttemptStore(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	store := services.NewDatabaseAttemptStore(testApp.DB)
+	now := time.Now()
+
+	require.NoError(t, store.Record(context.Background(), "email:a@example.com", now.Add(-time.Hour)))
+	require.NoError(t, store.Record(context.Background(), "email:a@example.com", now.Add(-time.Minute)))
+	require.NoError(t, store.Record(context.Background(), "email:a@example.com", now))
+	require.NoError(t, store.Record(context.Background(), "email:b@example.com", now))
+
+	attempts, err := store.Since(context.Background(), "email:a@example.com", now.Add(-10*time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, attempts, 2)
+
+	require.NoError(t, store.DeleteBefore(context.Background(), now.Add(-30*time.Minute)))
+	attempts, err = store.Since(context.Background(), "email:a@example.com", now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	assert.Len(t, attempts, 2)
+
+	require.NoError(t, store.Reset(context.Background(), "email:a@example.com"))
+	attempts, err = store.Since(context.Background(), "email:a@example.com", now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, attempts)
+
+	attempts, err = store.Since(context.Background(), "email:b@example.com", now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, attempts, 1)
+
+	// Keys are stored hashed, so the longest address fits and isn't kept
+	long := "reset:email:" + strings.Repeat("a", 308) + "@example.com"
+	require.NoError(t, store.Record(context.Background(), long, now))
+	attempts, err = store.Since(context.Background(), long, now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, attempts, 1)
+
+	var buckets []string
+	require.NoError(t, testApp.DB.Model(&models.LoginAttempt{}).Pluck("bucket", &buckets).Error)
+	for _, bucket := range buckets {
+		assert.Len(t, bucket, 64)
+		assert.NotContains(t, bucket, "example.com")
+	}
+}
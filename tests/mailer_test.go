@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"bufio"
+	"fresh/app/services"
+	"fresh/config"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpStandIn is a minimal SMTP server that accepts a single message
+type smtpStandIn struct {
+	listener net.Listener
+	from     string
+	rcpt     string
+	data     chan string
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &smtpStandIn{listener: listener, data: make(chan string, 1)}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *smtpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStandIn) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			s.from = line
+			reply("250 OK")
+		case "RCPT":
+			s.rcpt = line
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var body strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				body.WriteString(l)
+			}
+			s.data <- body.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func testMessage() *services.Message {
+	return &services.Message{
+		To:      "user@example.com",
+		Subject: "Hello there",
+		Text:    "Plain body",
+		HTML:    "<p>HTML body</p>",
+	}
+}
+
+func TestSMTPMailer_Send(t *testing.T) {
+	server := startSMTPStandIn(t)
+
+	mailer := &services.SMTPMailer{
+		Host: "127.0.0.1",
+		Port: server.port(),
+		TLS:  "none",
+		From: "Fresh <noreply@example.com>",
+	}
+
+	require.NoError(t, mailer.Send(testMessage()))
+
+	data := <-server.data
+	assert.Contains(t, server.from, "<noreply@example.com>")
+	assert.Contains(t, server.rcpt, "<user@example.com>")
+	assert.Contains(t, data, "Subject: Hello there")
+	assert.Contains(t, data, "multipart/alternative")
+	assert.Contains(t, data, "Plain body")
+	assert.Contains(t, data, "<p>HTML body</p>")
+}
+
+func TestSMTPMailer_InvalidRecipient(t *testing.T) {
+	mailer := &services.SMTPMailer{Host: "127.0.0.1", From: "noreply@example.com"}
+
+	msg := testMessage()
+	msg.To = "not an address"
+	assert.Error(t, mailer.Send(msg))
+}
+
+func TestSMTPMailer_RequiresSTARTTLS(t *testing.T) {
+	for _, mode := range []string{"starttls", ""} {
+		server := startSMTPStandIn(t)
+		mailer := &services.SMTPMailer{Host: "127.0.0.1", Port: server.port(), TLS: mode, From: "noreply@example.com"}
+
+		err := mailer.Send(testMessage())
+		require.Error(t, err, "mode %q", mode)
+		assert.Contains(t, err.Error(), "doesn't offer STARTTLS")
+		assert.Empty(t, server.from, "nothing is sent in cleartext")
+	}
+
+	mailer := &services.SMTPMailer{Host: "127.0.0.1", TLS: "ssl", From: "noreply@example.com"}
+	assert.ErrorContains(t, mailer.Send(testMessage()), "unsupported SMTP TLS setting")
+	_, err := services.NewMailer(config.MailConfig{Transport: "smtp", SMTP: config.SMTPConfig{Host: "mail.example.com", TLS: "ssl"}})
+	assert.ErrorContains(t, err, "mail.smtp.tls")
+}
+
+func TestMessage_RejectsHeaderInjection(t *testing.T) {
+	for _, msg := range []services.Message{
+		{From: "noreply@example.com", To: "user@example.com\r\nBcc: victim@example.com"},
+		{From: "Fresh <noreply@example.com>\nBcc: victim@example.com", To: "user@example.com"},
+		{From: "noreply@example.com", To: "one@example.com, two@example.com"},
+	} {
+		_, err := msg.Bytes()
+		assert.Error(t, err, "%q -> %q", msg.From, msg.To)
+	}
+
+	msg := services.Message{From: "Frésh Team <noreply@example.com>", To: "user@example.com", Text: "hi"}
+	body, err := msg.Bytes()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "From: =?utf-8?q?Fr=C3=A9sh_Team?= <noreply@example.com>\r\n")
+	assert.Contains(t, string(body), "To: user@example.com\r\n")
+}
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := t.TempDir()
+	mailer := &services.FileMailer{Dir: dir, From: "noreply@example.com"}
+
+	require.NoError(t, mailer.Send(testMessage()))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "From: noreply@example.com")
+	assert.Contains(t, string(content), "To: user@example.com")
+	assert.Contains(t, string(content), "Plain body")
+}
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := services.NewMemoryMailer()
+	assert.Nil(t, mailer.LastMessage())
+
+	require.NoError(t, mailer.Send(testMessage()))
+	require.Len(t, mailer.Messages(), 1)
+	assert.Equal(t, "Hello there", mailer.LastMessage().Subject)
+
+	mailer.Reset()
+	assert.Empty(t, mailer.Messages())
+}
+
+func TestTemplateService_RenderMail(t *testing.T) {
+	templateService, err := services.NewTemplateServiceAt("../web/templates")
+	require.NoError(t, err)
+
+	link := "http://localhost:3000/password/reset/abc123"
+	msg, err := templateService.RenderMail("password_reset", map[string]interface{}{
+		"Link":      link,
+		"ExpiresIn": "1 hour",
+	})
+	require.NoError(t, err)
+
+	assert.NotEmpty(t, msg.Subject)
+	assert.Contains(t, msg.Text, link)
+	assert.Contains(t, msg.HTML, link)
+
+	_, err = templateService.RenderMail("does_not_exist", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"context"
+	"fresh/app/apperror"
+	"fresh/app/metrics"
+	"fresh/app/services"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape fetches /metrics in the Prometheus text format
+func scrape(t *testing.T, app *fiber.App, token string) (int, string) {
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestMetrics_HTTPRequestsByRoute(t *testing.T) {
+	testApp := SetupTestApp(t)
+
+	for _, path := range []string{"/login", "/login", "/auth/nowhere", "/no/such/page/1", "/no/such/page/2", "/healthz"} {
+		resp, err := testApp.App.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	status, body := scrape(t, testApp.App, "")
+	require.Equal(t, fiber.StatusOK, status)
+
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/login",status="200"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/auth/:provider",status="404"} 1`,
+		"labelled by route template, with the status the error handler sent")
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",status="404"} 2`,
+		"unknown paths share one series")
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/login",status="200"} 2`)
+	assert.NotContains(t, body, `route="/healthz"`, "probes aren't counted")
+	assert.NotContains(t, body, `route="/"`)
+}
+
+func TestMetrics_AuthEvents(t *testing.T) {
+	testApp := SetupTestApp(t)
+
+	_, err := testApp.AuthService.Register(context.Background(), "metrics@example.com", "password123")
+	require.NoError(t, err)
+	_, err = testApp.AuthService.Login(context.Background(), "metrics@example.com", "password123", "10.0.0.1")
+	require.NoError(t, err)
+	_, err = testApp.AuthService.Login(context.Background(), "metrics@example.com", "wrong-password", "10.0.0.1")
+	require.ErrorIs(t, err, services.ErrInvalidCredentials)
+	_, err = testApp.AuthService.Login(context.Background(), "nobody@example.com", "password123", "10.0.0.1")
+	require.ErrorIs(t, err, services.ErrInvalidCredentials)
+
+	_, body := scrape(t, testApp.App, "")
+	assert.Contains(t, body, "auth_registrations_total 1")
+	assert.Contains(t, body, `auth_login_attempts_total{result="success"} 1`)
+	assert.Contains(t, body, `auth_login_attempts_total{result="invalid_credentials"} 2`)
+	assert.Contains(t, body, `auth_login_attempts_total{result="throttled"} 0`)
+}
+
+func TestMetrics_DatabasePool(t *testing.T) {
+	testApp := SetupTestApp(t)
+	m := metrics.New()
+	require.NoError(t, m.RegisterDB(testApp.DB))
+
+	app := fiber.New()
+	app.Get("/metrics", m.Handler(""))
+
+	_, body := scrape(t, app, "")
+	assert.Contains(t, body, `go_sql_max_open_connections{db_name=`)
+	assert.Contains(t, body, `go_sql_in_use_connections{db_name=`)
+}
+
+func TestMetrics_Token(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: apperror.Handler(apperror.HandlerConfig{})})
+	app.Get("/metrics", metrics.New().Handler("s3cret"))
+
+	status, _ := scrape(t, app, "")
+	assert.Equal(t, fiber.StatusUnauthorized, status)
+	status, _ = scrape(t, app, "wrong")
+	assert.Equal(t, fiber.StatusUnauthorized, status)
+
+	status, body := scrape(t, app, "s3cret")
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Contains(t, body, "auth_registrations_total 0")
+}
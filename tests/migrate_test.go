@@ -0,0 +1,299 @@
+package tests
+
+import (
+	"errors"
+	"fresh/app/models"
+	"fresh/config"
+	"fresh/db/migrate"
+	"fresh/db/migrations"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// schemaOf returns the DDL of every table and index except schema_migrations,
+// without the quoting and spacing that differ between GORM and SQL files
+func schemaOf(t *testing.T, db *gorm.DB) map[string]string {
+	var rows []struct {
+		Name string
+		SQL  string
+	}
+	require.NoError(t, db.Raw(`SELECT name, sql FROM sqlite_master
+		WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' AND tbl_name <> 'schema_migrations'`).Scan(&rows).Error)
+
+	normalize := strings.NewReplacer("`", "", " (", "(", "IF NOT EXISTS ", "")
+	schema := make(map[string]string, len(rows))
+	for _, row := range rows {
+		// GORM doesn't emit constraints in a stable order
+		parts := strings.Split(strings.TrimSuffix(normalize.Replace(row.SQL), ")"), ",")
+		sort.Strings(parts)
+		schema[row.Name] = strings.Join(parts, ",")
+	}
+	return schema
+}
+
+func TestMigrations_MatchModels(t *testing.T) {
+	migrated := openTestDB(t)
+	require.NoError(t, config.MigrateDatabase(migrated))
+
+	autoMigrated := openTestDB(t)
+	require.NoError(t, autoMigrated.AutoMigrate(models.All()...))
+
+	// A model change without a migration shows up here
+	assert.Equal(t, schemaOf(t, autoMigrated), schemaOf(t, migrated))
+}
+
+func TestMigrations_UpgradeAutoMigratedDatabase(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.AutoMigrate(models.All()...))
+	require.NoError(t, db.Create(&models.User{Email: "existing@example.com", Password: "hash"}).Error)
+
+	migrator, err := migrations.NewMigrator(db)
+	require.NoError(t, err)
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+	assert.NotEmpty(t, applied)
+
+	pending, err := migrator.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	assert.Equal(t, int64(1), count, "existing rows survive the baseline")
+}
+
+func TestMigrations_RollBackEverything(t *testing.T) {
+	db := openTestDB(t)
+	migrator, err := migrations.NewMigrator(db)
+	require.NoError(t, err)
+
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+
+	reverted, err := migrator.Rollback(len(applied))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(applied))
+	assert.Empty(t, schemaOf(t, db))
+
+	_, err = migrator.Up()
+	require.NoError(t, err)
+	assert.True(t, db.Migrator().HasTable(&models.User{}))
+}
+
+// widgetMigrations are three Go migrations on a scratch table
+func widgetMigrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version: 20240101000000,
+			Name:    "create_widgets",
+			Up:      func(tx *gorm.DB) error { return tx.Exec("CREATE TABLE widgets (id integer primary key)").Error },
+			Down:    func(tx *gorm.DB) error { return tx.Exec("DROP TABLE widgets").Error },
+		},
+		{
+			Version: 20240102000000,
+			Name:    "add_widget_name",
+			Up:      func(tx *gorm.DB) error { return tx.Exec("ALTER TABLE widgets ADD COLUMN name text").Error },
+			Down:    func(tx *gorm.DB) error { return tx.Exec("ALTER TABLE widgets DROP COLUMN name").Error },
+		},
+		{
+			Version: 20240103000000,
+			Name:    "add_widget_color",
+			Up:      func(tx *gorm.DB) error { return tx.Exec("ALTER TABLE widgets ADD COLUMN color text").Error },
+			Down:    func(tx *gorm.DB) error { return tx.Exec("ALTER TABLE widgets DROP COLUMN color").Error },
+		},
+	}
+}
+
+func TestMigrator_UpRollbackAndStatus(t *testing.T) {
+	db := openTestDB(t)
+	// Out of order on purpose; versions decide the order
+	list := widgetMigrations()
+	list[0], list[2] = list[2], list[0]
+	migrator, err := migrate.New(db, list)
+	require.NoError(t, err)
+
+	applied, err := migrator.Up()
+	require.NoError(t, err)
+	require.Len(t, applied, 3)
+	assert.Equal(t, "20240101000000_create_widgets", applied[0].String())
+	assert.True(t, db.Migrator().HasColumn("widgets", "color"))
+
+	applied, err = migrator.Up()
+	require.NoError(t, err)
+	assert.Empty(t, applied, "a second run has nothing to do")
+
+	reverted, err := migrator.Rollback(2)
+	require.NoError(t, err)
+	require.Len(t, reverted, 2)
+	assert.Equal(t, "add_widget_color", reverted[0].Name)
+	assert.Equal(t, "add_widget_name", reverted[1].Name)
+	assert.False(t, db.Migrator().HasColumn("widgets", "name"))
+	assert.True(t, db.Migrator().HasTable("widgets"))
+
+	statuses, err := migrator.Status()
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	assert.True(t, statuses[0].Applied())
+	assert.False(t, statuses[1].Applied())
+	assert.False(t, statuses[2].Applied())
+
+	// A migration that was applied and then deleted is reported as missing
+	shorter, err := migrate.New(db, widgetMigrations()[1:])
+	require.NoError(t, err)
+	statuses, err = shorter.Status()
+	require.NoError(t, err)
+	require.Len(t, statuses, 3)
+	assert.True(t, statuses[2].Missing)
+	assert.Equal(t, int64(20240101000000), statuses[2].Migration.Version)
+	_, err = shorter.Rollback(1)
+	assert.ErrorContains(t, err, "no longer exists")
+}
+
+func TestMigrator_FailedMigrationIsRolledBack(t *testing.T) {
+	db := openTestDB(t)
+	list := append(widgetMigrations()[:1], migrate.Migration{
+		Version: 20240102000000,
+		Name:    "broken",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("CREATE TABLE gadgets (id integer)").Error; err != nil {
+				return err
+			}
+			return errors.New("boom")
+		},
+	})
+	migrator, err := migrate.New(db, list)
+	require.NoError(t, err)
+
+	applied, err := migrator.Up()
+	assert.ErrorContains(t, err, "20240102000000_broken")
+	assert.Len(t, applied, 1)
+	assert.False(t, db.Migrator().HasTable("gadgets"), "the failed migration's changes are undone")
+
+	pending, err := migrator.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+
+	// It has no down step, so it can't be rolled back once fixed and applied
+	list[1].Up = func(tx *gorm.DB) error { return nil }
+	migrator, err = migrate.New(db, list)
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+	_, err = migrator.Rollback(1)
+	assert.ErrorContains(t, err, "can't be rolled back")
+}
+
+func TestMigrator_RejectsDuplicateVersions(t *testing.T) {
+	list := append(widgetMigrations(), migrate.Migration{
+		Version: 20240101000000,
+		Name:    "again",
+		Up:      func(tx *gorm.DB) error { return nil },
+	})
+	_, err := migrate.New(openTestDB(t), list)
+	assert.ErrorContains(t, err, "share a version")
+}
+
+func TestLoadSQL(t *testing.T) {
+	fsys := fstest.MapFS{
+		"20240101000000_create_things.up.sql":       {Data: []byte("CREATE TABLE things (id integer);\nCREATE TABLE other_things (id integer);")},
+		"20240101000000_create_things.down.sql":     {Data: []byte("DROP TABLE things; DROP TABLE other_things;")},
+		"20240102000000_index_things.up.sql":        {Data: []byte("-- generic\nCREATE INDEX idx_things_generic ON things (id);")},
+		"20240102000000_index_things.up.sqlite.sql": {Data: []byte("CREATE INDEX idx_things_sqlite ON things (id);")},
+		"20240103000000_vacuum.up.sql":              {Data: []byte(migrate.NoTransactionDirective + "\nVACUUM;")},
+		"20240104000000_todo.up.sql":                {Data: []byte("-- nothing yet\n\n")},
+		"20240105000000_mention.up.sql":             {Data: []byte("-- not " + migrate.NoTransactionDirective + "\nSELECT 1;\n" + migrate.NoTransactionDirective)},
+		"README.md":                                 {Data: []byte("not a migration")},
+	}
+
+	list, err := migrate.LoadSQL(fsys)
+	require.NoError(t, err)
+	require.Len(t, list, 5)
+
+	byName := map[string]migrate.Migration{}
+	for _, migration := range list {
+		byName[migration.Name] = migration
+	}
+	assert.NotNil(t, byName["create_things"].Down)
+	assert.Nil(t, byName["index_things"].Down)
+	assert.True(t, byName["vacuum"].NoTransaction)
+	assert.False(t, byName["create_things"].NoTransaction)
+	assert.False(t, byName["mention"].NoTransaction, "the directive only counts as the first line")
+
+	db := openTestDB(t)
+	migrator, err := migrate.New(db, list)
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+
+	assert.True(t, db.Migrator().HasTable("other_things"), "a file can hold several statements")
+	assert.True(t, db.Migrator().HasIndex("things", "idx_things_sqlite"), "the dialect's own file wins")
+	assert.False(t, db.Migrator().HasIndex("things", "idx_things_generic"))
+
+	t.Run("bad file names", func(t *testing.T) {
+		_, err := migrate.LoadSQL(fstest.MapFS{"create_things.sql": {Data: []byte("")}})
+		assert.ErrorContains(t, err, "should be named")
+	})
+
+	t.Run("down without up", func(t *testing.T) {
+		_, err := migrate.LoadSQL(fstest.MapFS{"20240101000000_x.down.sql": {Data: []byte("")}})
+		assert.ErrorContains(t, err, "no .up.sql")
+	})
+
+	t.Run("clashing versions", func(t *testing.T) {
+		_, err := migrate.LoadSQL(fstest.MapFS{
+			"20240101000000_a.up.sql": {Data: []byte("")},
+			"20240101000000_b.up.sql": {Data: []byte("")},
+		})
+		assert.ErrorContains(t, err, "share a version")
+	})
+}
+
+func TestCreateMigration(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	paths, err := migrate.Create(dir, "Add widgets table!", migrate.KindSQL, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "20250304050607_add_widgets_table.down.sql"),
+		filepath.Join(dir, "20250304050607_add_widgets_table.up.sql"),
+	}, paths)
+
+	// The skeleton loads as a transactional migration and applies as a no-op
+	list, err := migrate.LoadSQL(os.DirFS(dir))
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.False(t, list[0].NoTransaction)
+	migrator, err := migrate.New(openTestDB(t), list)
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+	_, err = migrator.Rollback(1)
+	require.NoError(t, err)
+
+	_, err = migrate.Create(dir, "add widgets table", migrate.KindSQL, now)
+	assert.ErrorContains(t, err, "already exists")
+
+	paths, err = migrate.Create(dir, "backfill_widgets", migrate.KindGo, now.Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	source, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(paths[0], "20250304050608_backfill_widgets.go"))
+	assert.Contains(t, string(source), "Version: 20250304050608,")
+	assert.Contains(t, string(source), `Name:    "backfill_widgets",`)
+
+	_, err = migrate.Create(dir, "!!!", migrate.KindSQL, now)
+	assert.Error(t, err)
+	_, err = migrate.Create(dir, "x", "yaml", now)
+	assert.Error(t, err)
+}
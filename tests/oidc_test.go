@@ -0,0 +1,329 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fresh/app/models"
+	"fresh/app/services"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// oidcSignIn runs the whole browser round trip: start at /auth/standin,
+// let the stand-in IdP authorize, and return the response to the callback.
+// rewrite may alter the callback URL before it is requested.
+func oidcSignIn(t *testing.T, testApp *TestApp, rewrite func(*url.URL), cookies ...*http.Cookie) *http.Response {
+	req, err := http.NewRequest("GET", "/auth/standin", nil)
+	require.NoError(t, err)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	var flow *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "fresh_oidc" {
+			flow = cookie
+		}
+	}
+	require.NotNil(t, flow, "expected the OIDC flow cookie")
+
+	callback, err := standInIdP.Authorize(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "/auth/standin/callback", callback.Path)
+	if rewrite != nil {
+		rewrite(callback)
+	}
+
+	req, err = http.NewRequest("GET", callback.RequestURI(), nil)
+	require.NoError(t, err)
+	req.AddCookie(flow)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func identitiesFor(t *testing.T, testApp *TestApp, userID uint) []models.UserIdentity {
+	identities, err := models.NewUserIdentityRepository(testApp.DB).ListByUser(userID)
+	require.NoError(t, err)
+	return identities
+}
+
+func TestOIDC_LoginPageListsProviders(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	req, _ := http.NewRequest("GET", "/login", nil)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var rendered struct {
+		Data struct {
+			Providers []struct{ Name, DisplayName string }
+		}
+	}
+	require.NoError(t, json.Unmarshal(body, &rendered))
+	require.Len(t, rendered.Data.Providers, 1)
+	assert.Equal(t, "standin", rendered.Data.Providers[0].Name)
+}
+
+func TestOIDC_CreatesAccountForNewUser(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	standInIdP.SignInAs(StandInIdentity{Subject: "sub-new", Email: "social@example.com", EmailVerified: true})
+
+	resp := oidcSignIn(t, testApp, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/dashboard", resp.Header.Get("Location"))
+	require.NotNil(t, sessionCookieFrom(resp))
+
+	user, err := testApp.UserRepo.FindByEmail("social@example.com")
+	require.NoError(t, err)
+	assert.True(t, user.EmailVerified(), "the provider vouched for the address")
+
+	identities := identitiesFor(t, testApp, user.ID)
+	require.Len(t, identities, 1)
+	assert.Equal(t, "standin", identities[0].Provider)
+	assert.Equal(t, "sub-new", identities[0].Subject)
+
+	// Signing in again reuses the identity, even if the email changed upstream
+	standInIdP.SignInAs(StandInIdentity{Subject: "sub-new", Email: "renamed@example.com", EmailVerified: true})
+	resp = oidcSignIn(t, testApp, nil)
+	resp.Body.Close()
+	assert.Equal(t, "/dashboard", resp.Header.Get("Location"))
+
+	identities = identitiesFor(t, testApp, user.ID)
+	require.Len(t, identities, 1)
+	assert.Equal(t, "renamed@example.com", identities[0].Email)
+
+	var users int64
+	testApp.DB.Model(&models.User{}).Count(&users)
+	assert.Equal(t, int64(1), users)
+}
+
+func TestOIDC_LinkingRules(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	verified, err := testApp.CreateTestUser("verified@example.com", "password123")
+	require.NoError(t, err)
+	unverified, err := testApp.UserRepo.Create("squatted@example.com", "password123")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		identity    StandInIdentity
+		wantSession bool
+		linkedTo    *models.User
+	}{
+		{
+			name:        "verified email matching a verified account links",
+			identity:    StandInIdentity{Subject: "sub-1", Email: "verified@example.com", EmailVerified: true},
+			wantSession: true,
+			linkedTo:    verified,
+		},
+		{
+			name:     "unverified local account is not taken over",
+			identity: StandInIdentity{Subject: "sub-2", Email: "squatted@example.com", EmailVerified: true},
+			linkedTo: unverified,
+		},
+		{
+			name:     "unverified provider email is refused",
+			identity: StandInIdentity{Subject: "sub-3", Email: "unconfirmed@example.com", EmailVerified: false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standInIdP.SignInAs(tt.identity)
+
+			resp := oidcSignIn(t, testApp, nil)
+			resp.Body.Close()
+
+			if tt.wantSession {
+				assert.Equal(t, http.StatusFound, resp.StatusCode)
+				assert.NotNil(t, sessionCookieFrom(resp))
+				assert.Len(t, identitiesFor(t, testApp, tt.linkedTo.ID), 1)
+				return
+			}
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Nil(t, sessionCookieFrom(resp))
+			if tt.linkedTo != nil {
+				assert.Empty(t, identitiesFor(t, testApp, tt.linkedTo.ID))
+			}
+		})
+	}
+
+	_, err = testApp.UserRepo.FindByEmail("unconfirmed@example.com")
+	assert.Error(t, err, "no account is created for an unverified address")
+}
+
+func TestOIDC_LookupFailuresDontCreateAccounts(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	claims := &services.OIDCClaims{Subject: "sub-1", Email: "social@example.com", EmailVerified: true}
+
+	// Reads from one table fail while the database can still write
+	for _, table := range []string{"user_identities", "users"} {
+		t.Run(table, func(t *testing.T) {
+			require.NoError(t, testApp.DB.Callback().Query().Before("gorm:query").Register("test:fail_reads", func(db *gorm.DB) {
+				if db.Statement.Table == table {
+					db.AddError(errors.New("database unavailable"))
+				}
+			}))
+			defer testApp.DB.Callback().Query().Remove("test:fail_reads")
+
+			_, err := testApp.OIDC.ResolveUser(context.Background(), "standin", claims, nil)
+			assert.ErrorContains(t, err, "database unavailable")
+		})
+	}
+
+	var users int64
+	require.NoError(t, testApp.DB.Model(&models.User{}).Count(&users).Error)
+	assert.Zero(t, users)
+}
+
+func TestOIDC_SignedInUserConnectsIdentity(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("owner@example.com", "password123")
+	require.NoError(t, err)
+	session, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	// The provider account may use a different address
+	standInIdP.SignInAs(StandInIdentity{Subject: "sub-owner", Email: "other-address@example.com", EmailVerified: true})
+
+	resp := oidcSignIn(t, testApp, nil, session)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/dashboard", resp.Header.Get("Location"))
+
+	identities := identitiesFor(t, testApp, user.ID)
+	require.Len(t, identities, 1)
+	assert.Equal(t, "sub-owner", identities[0].Subject)
+}
+
+func TestOIDC_RejectsTamperedFlows(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	tests := []struct {
+		name    string
+		tamper  func(claims map[string]interface{})
+		rewrite func(callback *url.URL)
+	}{
+		{
+			name: "state mismatch",
+			rewrite: func(callback *url.URL) {
+				q := callback.Query()
+				q.Set("state", "attacker-state")
+				callback.RawQuery = q.Encode()
+			},
+		},
+		{
+			name:   "wrong nonce",
+			tamper: func(claims map[string]interface{}) { claims["nonce"] = "replayed" },
+		},
+		{
+			name:   "wrong audience",
+			tamper: func(claims map[string]interface{}) { claims["aud"] = "some-other-client" },
+		},
+		{
+			name:   "wrong issuer",
+			tamper: func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+		},
+		{
+			name:   "expired token",
+			tamper: func(claims map[string]interface{}) { claims["exp"] = int64(1) },
+		},
+		{
+			name: "provider error",
+			rewrite: func(callback *url.URL) {
+				callback.RawQuery = url.Values{"error": {"access_denied"}, "state": {callback.Query().Get("state")}}.Encode()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standInIdP.SignInAs(StandInIdentity{Subject: "sub-tamper", Email: "tamper@example.com", EmailVerified: true})
+			standInIdP.Tamper = tt.tamper
+
+			resp := oidcSignIn(t, testApp, tt.rewrite)
+			resp.Body.Close()
+
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Nil(t, sessionCookieFrom(resp))
+		})
+	}
+
+	_, err := testApp.UserRepo.FindByEmail("tamper@example.com")
+	assert.Error(t, err)
+}
+
+func TestOIDC_CallbackWithoutFlowCookie(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	req, _ := http.NewRequest("GET", "/auth/standin/callback?code=abc&state=xyz", nil)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, sessionCookieFrom(resp))
+}
+
+func TestOIDC_UnknownProvider(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	req, _ := http.NewRequest("GET", "/auth/nope", nil)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.NotEqual(t, http.StatusFound, resp.StatusCode)
+}
+
+func TestOIDC_TwoFactorStillRequired(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("secure@example.com", "password123")
+	require.NoError(t, err)
+	enableTwoFactor(t, testApp, user)
+
+	standInIdP.SignInAs(StandInIdentity{Subject: "sub-secure", Email: "secure@example.com", EmailVerified: true})
+
+	resp := oidcSignIn(t, testApp, nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login/2fa", resp.Header.Get("Location"))
+	assert.Nil(t, sessionCookieFrom(resp))
+}
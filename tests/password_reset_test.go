@@ -0,0 +1,296 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fresh/app/models"
+	"fresh/app/services"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+var resetLinkPattern = regexp.MustCompile(`/password/reset/([A-Za-z0-9_-]+)`)
+
+// resetTokenFromMail pulls the token out of the last email sent
+func resetTokenFromMail(t *testing.T, mailer *services.MemoryMailer) string {
+	msg := mailer.LastMessage()
+	require.NotNil(t, msg, "expected a reset email")
+	match := resetLinkPattern.FindStringSubmatch(msg.Text)
+	require.Len(t, match, 2, "no reset link in %q", msg.Text)
+	return match[1]
+}
+
+func TestPasswordReset_RequestDoesNotRevealAccounts(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, err := testApp.CreateTestUser("known@example.com", "password123")
+	require.NoError(t, err)
+
+	bodies := map[string]string{}
+	for _, email := range []string{"known@example.com", "unknown@example.com"} {
+		form := url.Values{}
+		form.Set("email", email)
+
+		req, err := testApp.NewFormRequest("POST", "/password/forgot", form)
+		require.NoError(t, err)
+
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body := make([]byte, 4096)
+		n, _ := resp.Body.Read(body)
+		bodies[email] = string(body[:n])
+	}
+
+	assert.Equal(t, bodies["known@example.com"], bodies["unknown@example.com"])
+	testApp.AuthService.Wait()
+	require.Len(t, testApp.Mailer.Messages(), 1, "only the registered address gets mail")
+	assert.Equal(t, "known@example.com", testApp.Mailer.Messages()[0].To)
+
+	// Only a hash of the emailed token is stored
+	token := resetTokenFromMail(t, testApp.Mailer)
+	var stored models.PasswordResetToken
+	require.NoError(t, testApp.DB.First(&stored).Error)
+	assert.NotEqual(t, token, stored.TokenHash)
+	assert.NotContains(t, stored.TokenHash, token)
+}
+
+func TestPasswordReset_RequestsAreThrottled(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	_, err := testApp.CreateTestUser("flooded@example.com", "password123")
+	require.NoError(t, err)
+
+	// The limit applies to unknown addresses too, so it reveals nothing
+	for _, email := range []string{"flooded@example.com", "nobody@example.com"} {
+		var status int
+		for i := 0; i < 6; i++ {
+			form := url.Values{"email": {email}}
+			req, err := testApp.NewFormRequest("POST", "/password/forgot", form)
+			require.NoError(t, err)
+			resp, err := testApp.App.Test(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			status = resp.StatusCode
+		}
+		assert.Equal(t, http.StatusTooManyRequests, status, email)
+	}
+	testApp.AuthService.Wait()
+	assert.Len(t, testApp.Mailer.Messages(), 5, "the flood stops at the per-email limit")
+
+	var throttled *services.TooManyAttemptsError
+	err = testApp.AuthService.RequestPasswordReset(context.Background(), "FLOODED@example.com", "198.51.100.7")
+	assert.ErrorAs(t, err, &throttled, "per email, whatever the IP or case")
+}
+
+func TestPasswordReset_ConsumeToken(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("reset@example.com", "oldpassword")
+	require.NoError(t, err)
+	existingSession, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	require.NoError(t, testApp.AuthService.RequestPasswordReset(context.Background(), user.Email, "192.0.2.1"))
+	testApp.AuthService.Wait()
+	token := resetTokenFromMail(t, testApp.Mailer)
+	require.NoError(t, testApp.AuthService.ValidatePasswordResetToken(context.Background(), token))
+
+	// Mismatched confirmation is rejected without consuming the token
+	form := url.Values{}
+	form.Set("password", "newpassword")
+	form.Set("password_confirmation", "different")
+	req, err := testApp.NewFormRequest("POST", "/password/reset/"+token, form)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, testApp.AuthService.ValidatePasswordResetToken(context.Background(), token))
+
+	form.Set("password_confirmation", "newpassword")
+	req, err = testApp.NewFormRequest("POST", "/password/reset/"+token, form)
+	require.NoError(t, err)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login?reset=1", resp.Header.Get("Location"))
+
+	// New password works, old one doesn't
+	_, err = testApp.AuthService.Login(context.Background(), user.Email, "oldpassword", "192.0.2.1")
+	assert.Error(t, err)
+	_, err = testApp.AuthService.Login(context.Background(), user.Email, "newpassword", "192.0.2.1")
+	assert.NoError(t, err)
+
+	// Existing sessions are gone
+	_, err = testApp.SessionStore.Find(context.Background(), existingSession.Value)
+	assert.ErrorIs(t, err, services.ErrSessionNotFound)
+
+	// The token is single-use
+	assert.ErrorIs(t, testApp.AuthService.ValidatePasswordResetToken(context.Background(), token), services.ErrInvalidResetToken)
+	_, err = testApp.AuthService.ResetPassword(context.Background(), token, "anotherpassword")
+	assert.ErrorIs(t, err, services.ErrInvalidResetToken)
+}
+
+func TestPasswordReset_ConcurrentSubmitsUseTokenOnce(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("race@example.com", "oldpassword")
+	require.NoError(t, err)
+	require.NoError(t, testApp.AuthService.RequestPasswordReset(context.Background(), user.Email, "192.0.2.1"))
+	testApp.AuthService.Wait()
+	token := resetTokenFromMail(t, testApp.Mailer)
+
+	const submits = 8
+	var wg sync.WaitGroup
+	results := make(chan error, submits)
+	for i := 0; i < submits; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := testApp.AuthService.ResetPassword(context.Background(), token, fmt.Sprintf("newpassword%d", i))
+			results <- err
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	var succeeded int
+	for err := range results {
+		if err == nil {
+			succeeded++
+		} else {
+			assert.ErrorIs(t, err, services.ErrInvalidResetToken)
+		}
+	}
+	assert.Equal(t, 1, succeeded)
+}
+
+func TestPasswordResetTokenRepository_Consume(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("consume@example.com", "password123")
+	require.NoError(t, err)
+	tokens := models.NewPasswordResetTokenRepository(testApp.DB)
+	_, err = tokens.Create(user.ID, "live", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = tokens.Create(user.ID, "sibling", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = tokens.Create(user.ID, "expired", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+
+	// A failing callback rolls the whole thing back
+	err = tokens.Consume("live", func(tx *gorm.DB, userID uint) error {
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "boom")
+	_, err = tokens.FindUsable("live")
+	require.NoError(t, err, "still usable after a rollback")
+
+	var consumedFor uint
+	require.NoError(t, tokens.Consume("live", func(tx *gorm.DB, userID uint) error {
+		consumedFor = userID
+		return nil
+	}))
+	assert.Equal(t, user.ID, consumedFor)
+
+	for _, hash := range []string{"live", "sibling", "expired", "unknown"} {
+		err := tokens.Consume(hash, func(*gorm.DB, uint) error {
+			t.Errorf("%s: callback ran for an unusable token", hash)
+			return nil
+		})
+		assert.ErrorIs(t, err, models.ErrResetTokenNotUsable, hash)
+	}
+}
+
+func TestPasswordReset_RejectsBadTokens(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("expired@example.com", "password123")
+	require.NoError(t, err)
+
+	require.NoError(t, testApp.AuthService.RequestPasswordReset(context.Background(), user.Email, "192.0.2.1"))
+	testApp.AuthService.Wait()
+	token := resetTokenFromMail(t, testApp.Mailer)
+
+	// Age the token past its expiry
+	require.NoError(t, testApp.DB.Model(&models.PasswordResetToken{}).
+		Where("user_id = ?", user.ID).
+		Update("expires_at", time.Now().Add(-time.Minute)).Error)
+
+	tests := []struct {
+		name     string
+		token    string
+		password string
+	}{
+		{name: "expired token", token: token, password: "newpassword"},
+		{name: "unknown token", token: "not-a-token", password: "newpassword"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := testApp.AuthService.ResetPassword(context.Background(), tt.token, tt.password)
+			assert.ErrorIs(t, err, services.ErrInvalidResetToken)
+		})
+	}
+
+	require.NoError(t, testApp.AuthService.RequestPasswordReset(context.Background(), user.Email, "192.0.2.1"))
+	testApp.AuthService.Wait()
+	_, err = testApp.AuthService.ResetPassword(context.Background(), resetTokenFromMail(t, testApp.Mailer), "short")
+	assert.ErrorContains(t, err, "at least 6 characters")
+}
+
+func TestPasswordReset_InvalidatesStatelessSessions(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("stateless-reset@example.com", "password123")
+	require.NoError(t, err)
+
+	store, err := services.NewCookieSessionStore("test-only-secret-key-base")
+	require.NoError(t, err)
+	authService := services.NewAuthService(testApp.UserRepo, store)
+
+	session, err := store.Create(context.Background(), user.ID, time.Hour)
+	require.NoError(t, err)
+
+	// The password changes after the session was issued
+	changedAt := time.Now().Add(2 * time.Second)
+	require.NoError(t, testApp.DB.Model(user).Update("password_changed_at", changedAt).Error)
+
+	testApp.App.Get("/test/whoami", func(c *fiber.Ctx) error {
+		if _, err := authService.GetCurrentUser(c); err != nil {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+		return c.SendStatus(http.StatusOK)
+	})
+
+	req, err := http.NewRequest("GET", "/test/whoami", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: services.DefaultSessionConfig().CookieName, Value: session.ID})
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"context"
+	"fresh/app/middleware"
+	"fresh/app/models"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleRepository_SeedIsIdempotent(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	// SetupTestApp already seeded once
+	roleRepo := models.NewRoleRepository(testApp.DB)
+	require.NoError(t, roleRepo.Seed(models.DefaultRoles()))
+
+	roles, err := roleRepo.All()
+	require.NoError(t, err)
+	require.Len(t, roles, 2)
+
+	admin, err := roleRepo.FindByName(models.RoleAdmin)
+	require.NoError(t, err)
+	assert.Len(t, admin.Permissions, 4)
+
+	var permissions int64
+	testApp.DB.Model(&models.Permission{}).Count(&permissions)
+	assert.Equal(t, int64(4), permissions)
+}
+
+func TestRBAC_NewUsersAreMembers(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.AuthService.Register(context.Background(), "member@example.com", "password123")
+	require.NoError(t, err)
+
+	assert.True(t, testApp.AuthService.HasRole(context.Background(), user, models.RoleMember))
+	assert.False(t, testApp.AuthService.HasRole(context.Background(), user, models.RoleAdmin))
+	assert.True(t, testApp.AuthService.Can(context.Background(), user, models.PermissionManageAccount))
+	assert.False(t, testApp.AuthService.Can(context.Background(), user, models.PermissionManageUsers))
+}
+
+func TestRBAC_AssignAndRemoveRoles(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	roleRepo := models.NewRoleRepository(testApp.DB)
+	user, err := testApp.CreateTestUser("promoted@example.com", "password123")
+	require.NoError(t, err)
+
+	require.NoError(t, roleRepo.AssignRole(user, models.RoleAdmin))
+	assert.True(t, testApp.AuthService.Can(context.Background(), user, models.PermissionManageUsers))
+
+	// A bare user struct has its roles loaded on demand
+	bare := &models.User{ID: user.ID}
+	assert.True(t, testApp.AuthService.Can(context.Background(), bare, models.PermissionAccessAdmin))
+
+	require.NoError(t, roleRepo.RemoveRole(user, models.RoleAdmin))
+	assert.False(t, testApp.AuthService.Can(context.Background(), user, models.PermissionManageUsers))
+	assert.True(t, testApp.AuthService.HasRole(context.Background(), user, models.RoleMember))
+
+	require.NoError(t, roleRepo.SetRoles(user, []string{}))
+	reloaded, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, reloaded.Roles)
+	assert.False(t, testApp.AuthService.Can(context.Background(), reloaded, models.PermissionManageAccount))
+
+	assert.Error(t, roleRepo.AssignRole(user, "no-such-role"))
+	assert.False(t, testApp.AuthService.Can(context.Background(), nil, models.PermissionManageAccount))
+}
+
+func TestRBAC_Middleware(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	access := middleware.AccessConfig{
+		AuthService: testApp.AuthService,
+		Renderer:    testApp.TemplateService,
+	}
+	ok := func(c *fiber.Ctx) error { return c.SendString("ok") }
+
+	staff := testApp.App.Group("/staff", middleware.RequireRole(access, models.RoleAdmin))
+	staff.Get("/", ok)
+	users := testApp.App.Group("/manage", middleware.RequirePermission(access, models.PermissionAccessAdmin, models.PermissionManageUsers))
+	users.Get("/", ok)
+
+	member, err := testApp.CreateTestUser("plain@example.com", "password123")
+	require.NoError(t, err)
+	admin, err := testApp.CreateTestUser("boss@example.com", "password123")
+	require.NoError(t, err)
+	require.NoError(t, models.NewRoleRepository(testApp.DB).AssignRole(admin, models.RoleAdmin))
+
+	memberCookie, err := testApp.SessionCookie(member)
+	require.NoError(t, err)
+	adminCookie, err := testApp.SessionCookie(admin)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		path           string
+		cookie         *http.Cookie
+		expectedStatus int
+	}{
+		{"anonymous role check redirects", "/staff", nil, http.StatusFound},
+		{"member lacks role", "/staff", memberCookie, http.StatusForbidden},
+		{"admin has role", "/staff", adminCookie, http.StatusOK},
+		{"anonymous permission check redirects", "/manage", nil, http.StatusFound},
+		{"member lacks permissions", "/manage", memberCookie, http.StatusForbidden},
+		{"admin has permissions", "/manage", adminCookie, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			resp, err := testApp.App.Test(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus == http.StatusFound {
+				assert.Equal(t, "/login", resp.Header.Get("Location"))
+			}
+		})
+	}
+}
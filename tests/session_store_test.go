@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"context"
+	"fresh/app/models"
+	"fresh/app/services"
+	"fresh/config"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionStoreBackends(t *testing.T, testApp *TestApp) map[string]services.SessionStore {
+	cookieStore, err := services.NewCookieSessionStore("test-only-secret-key-base")
+	require.NoError(t, err)
+
+	return map[string]services.SessionStore{
+		"database": services.NewDatabaseSessionStore(testApp.DB),
+		"memory":   services.NewMemorySessionStore(),
+		"cookie":   cookieStore,
+	}
+}
+
+func TestSessionStore_Lifecycle(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("store@example.com", "password123")
+	require.NoError(t, err)
+
+	for name, store := range sessionStoreBackends(t, testApp) {
+		t.Run(name, func(t *testing.T) {
+			session, err := store.Create(context.Background(), user.ID, time.Hour)
+			require.NoError(t, err)
+			assert.NotEmpty(t, session.ID)
+			assert.False(t, session.Expired())
+
+			found, err := store.Find(context.Background(), session.ID)
+			require.NoError(t, err)
+			assert.Equal(t, user.ID, found.UserID)
+			assert.WithinDuration(t, session.ExpiresAt, found.ExpiresAt, time.Second)
+
+			before := found.LastSeenAt
+			time.Sleep(1100 * time.Millisecond)
+			require.NoError(t, store.Touch(context.Background(), found))
+			assert.True(t, found.LastSeenAt.After(before))
+
+			touched, err := store.Find(context.Background(), found.ID)
+			require.NoError(t, err)
+			assert.True(t, touched.LastSeenAt.After(before))
+
+			_, err = store.Find(context.Background(), "does-not-exist")
+			assert.ErrorIs(t, err, services.ErrSessionNotFound)
+
+			assert.NoError(t, store.Delete(context.Background(), "does-not-exist"))
+		})
+	}
+}
+
+func TestSessionStore_DeleteAndExpire(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("expire@example.com", "password123")
+	require.NoError(t, err)
+
+	// The cookie store is stateless, so deletion and GC don't apply to it
+	for _, name := range []string{"database", "memory"} {
+		store := sessionStoreBackends(t, testApp)[name]
+
+		t.Run(name, func(t *testing.T) {
+			live, err := store.Create(context.Background(), user.ID, time.Hour)
+			require.NoError(t, err)
+			stale, err := store.Create(context.Background(), user.ID, -time.Minute)
+			require.NoError(t, err)
+			deleted, err := store.Create(context.Background(), user.ID, time.Hour)
+			require.NoError(t, err)
+
+			require.NoError(t, store.Delete(context.Background(), deleted.ID))
+			_, err = store.Find(context.Background(), deleted.ID)
+			assert.ErrorIs(t, err, services.ErrSessionNotFound)
+
+			require.NoError(t, store.DeleteExpired(context.Background()))
+			_, err = store.Find(context.Background(), stale.ID)
+			assert.ErrorIs(t, err, services.ErrSessionNotFound)
+
+			_, err = store.Find(context.Background(), live.ID)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCookieSessionStore_RejectsTampering(t *testing.T) {
+	store, err := services.NewCookieSessionStore("test-only-secret-key-base")
+	require.NoError(t, err)
+
+	session, err := store.Create(context.Background(), 1, time.Hour)
+	require.NoError(t, err)
+
+	// Flip a character in the middle of the sealed payload
+	tampered := []byte(session.ID)
+	mid := len(tampered) / 2
+	if tampered[mid] == 'A' {
+		tampered[mid] = 'B'
+	} else {
+		tampered[mid] = 'A'
+	}
+	_, err = store.Find(context.Background(), string(tampered))
+	assert.ErrorIs(t, err, services.ErrSessionNotFound)
+
+	// A store keyed with a different secret can't read the session either
+	otherStore, err := services.NewCookieSessionStore("another-secret-key-base")
+	require.NoError(t, err)
+	_, err = otherStore.Find(context.Background(), session.ID)
+	assert.ErrorIs(t, err, services.ErrSessionNotFound)
+
+	_, err = services.NewCookieSessionStore("")
+	assert.Error(t, err)
+}
+
+func TestNewSessionStore_FromConfig(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	tests := []struct {
+		store       string
+		expectError bool
+	}{
+		{store: "database"},
+		{store: "memory"},
+		{store: "cookie"},
+		{store: "redis", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.store, func(t *testing.T) {
+			store, err := services.NewSessionStore(config.SessionConfig{Store: tt.store}, "test-only-secret-key-base", testApp.DB)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			session, err := store.Create(context.Background(), 1, time.Hour)
+			require.NoError(t, err)
+			assert.IsType(t, &models.Session{}, session)
+		})
+	}
+}
+
+func TestAuthService_CookieSessionStore(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("stateless@example.com", "password123")
+	require.NoError(t, err)
+
+	store, err := services.NewCookieSessionStore("test-only-secret-key-base")
+	require.NoError(t, err)
+	authService := services.NewAuthService(testApp.UserRepo, store)
+
+	session, err := store.Create(context.Background(), user.ID, time.Hour)
+	require.NoError(t, err)
+
+	testApp.App.Get("/test/whoami", func(c *fiber.Ctx) error {
+		current, err := authService.GetCurrentUser(c)
+		if err != nil {
+			return c.SendStatus(http.StatusUnauthorized)
+		}
+		return c.SendString(current.Email)
+	})
+
+	req, err := http.NewRequest("GET", "/test/whoami", nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: services.DefaultSessionConfig().CookieName, Value: session.ID})
+
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, user.Email, string(body))
+
+	var count int64
+	require.NoError(t, testApp.DB.Model(&models.Session{}).Count(&count).Error)
+	assert.Zero(t, count, "cookie sessions must not touch the database")
+}
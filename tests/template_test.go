@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"fmt"
+	"fresh/app/services"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTemplates lays out a template root with the given files and a copy
+// of the real mail templates
+func writeTemplates(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	mail, err := filepath.Glob("../web/templates/mail/*")
+	require.NoError(t, err)
+	for _, path := range mail {
+		src, err := os.ReadFile(path)
+		require.NoError(t, err)
+		files["mail/"+filepath.Base(path)] = string(src)
+	}
+
+	for name, src := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(src), 0o644))
+	}
+	return root
+}
+
+// renderPage renders one page and returns the status and body sent
+func renderPage(t *testing.T, templateService *services.TemplateService, page string, data interface{}) (int, string) {
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		return templateService.Render(c, page, data)
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestTemplateService_DiscoversPages(t *testing.T) {
+	root := writeTemplates(t, map[string]string{
+		"layout.html":                  `{{define "layout"}}<main>{{template "content" .}}</main>{{end}}`,
+		"admin/layout.html":            `{{define "layout"}}<admin>{{template "content" .}}</admin>{{end}}`,
+		"layouts/print.html":           `{{define "layout"}}<print>{{template "content" .}}</print>{{end}}`,
+		"partials/greeting.html":       `{{define "greeting"}}Hello {{.Name}}{{end}}`,
+		"partials/forms/submit.html":   `{{define "submit"}}<button>{{.}}</button>{{end}}`,
+		"home.html":                    `{{template "layout" .}}{{define "content"}}{{template "greeting" .}}{{end}}`,
+		"reports/monthly/summary.html": `{{template "layout" .}}{{define "content"}}summary{{template "submit" "Go"}}{{end}}`,
+		"admin/users/index.html":       `{{template "layout" .}}{{define "content"}}users{{end}}`,
+		"invoice.html":                 "{{/* layout: print */}}\n{{template \"layout\" .}}{{define \"content\"}}invoice{{end}}",
+		"notes.txt":                    "not a template",
+	})
+
+	templateService, err := services.NewTemplateServiceAt(root)
+	require.NoError(t, err)
+
+	for page, want := range map[string]string{
+		"home":                    "<main>Hello Ada</main>",
+		"reports/monthly/summary": "<main>summary<button>Go</button></main>",
+		"admin/users/index":       "<admin>users</admin>",
+		"invoice":                 "<print>invoice</print>",
+	} {
+		status, body := renderPage(t, templateService, page, fiber.Map{"Name": "Ada"})
+		assert.Equal(t, fiber.StatusOK, status, page)
+		assert.Contains(t, body, want, page)
+	}
+
+	// Layouts, partials and mail aren't pages
+	for _, name := range []string{"layout", "admin/layout", "layouts/print", "partials/greeting", "mail/verify_email", "notes"} {
+		status, _ := renderPage(t, templateService, name, nil)
+		assert.Equal(t, fiber.StatusInternalServerError, status, name)
+	}
+}
+
+func TestTemplateService_DiscoversMail(t *testing.T) {
+	root := writeTemplates(t, map[string]string{
+		"layout.html":       `{{define "layout"}}{{template "content" .}}{{end}}`,
+		"home.html":         `{{template "layout" .}}{{define "content"}}home{{end}}`,
+		"mail/welcome.html": `{{define "content"}}<p>Hi {{.Name}}</p>{{end}}`,
+		"mail/welcome.txt":  `{{define "subject"}}Welcome, {{.Name}}{{end}}Hi {{.Name}}`,
+	})
+
+	templateService, err := services.NewTemplateServiceAt(root)
+	require.NoError(t, err)
+
+	msg, err := templateService.RenderMail("welcome", map[string]interface{}{"Name": "Ada"})
+	require.NoError(t, err, "a new mail template needs no registering")
+	assert.Equal(t, "Welcome, Ada", msg.Subject)
+	assert.Equal(t, "Hi Ada\n", msg.Text)
+	assert.Contains(t, msg.HTML, "<p>Hi Ada</p>")
+
+	_, err = templateService.RenderMail("layout", nil)
+	assert.Error(t, err, "the mail layout isn't a mail")
+
+	// Every mail needs its plain text part
+	require.NoError(t, os.Remove(filepath.Join(root, "mail", "welcome.txt")))
+	assert.ErrorContains(t, templateService.Reload(), "welcome.txt")
+}
+
+func TestTemplateService_ParseErrors(t *testing.T) {
+	layout := `{{define "layout"}}{{template "content" .}}{{end}}`
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "every broken page with its line",
+			files: map[string]string{
+				"layout.html":       layout,
+				"ok.html":           `{{template "layout" .}}`,
+				"admin/broken.html": "{{template \"layout\" .}}\n\n{{define \"content\"}}{{if .X}}\n",
+				"typo.html":         "{{template \"layout\" .}}\n{{define \"content\"}}{{nosuchfunc}}{{end}}",
+			},
+			want: []string{
+				filepath.Join("admin", "broken.html") + ":4: unexpected EOF",
+				"typo.html:2: function \"nosuchfunc\" not defined",
+			},
+		},
+		{
+			name: "broken partial",
+			files: map[string]string{
+				"layout.html":          layout,
+				"page.html":            `{{template "layout" .}}`,
+				"partials/alerts.html": "\n{{define \"alert\"}}{{end}\n",
+			},
+			want: []string{filepath.Join("partials", "alerts.html") + ":2:"},
+		},
+		{
+			name: "broken layout",
+			files: map[string]string{
+				"layout.html": "{{define \"layout\"}}\n{{range}}{{end}}{{end}}",
+				"page.html":   `{{template "layout" .}}`,
+			},
+			want: []string{"layout.html:2: missing value for range"},
+		},
+		{
+			name: "unknown layout",
+			files: map[string]string{
+				"layout.html": layout,
+				"page.html":   "\n{{/* layout: fancy */}}\n",
+			},
+			want: []string{"page.html:2: layout \"fancy\" not found"},
+		},
+		{
+			name: "no layout",
+			files: map[string]string{
+				"page.html": `{{define "content"}}{{end}}`,
+			},
+			want: []string{"page.html: no layout.html"},
+		},
+		{
+			name: "layout without layout template",
+			files: map[string]string{
+				"layout.html": `{{define "frame"}}{{end}}`,
+				"page.html":   `{{define "content"}}{{end}}`,
+			},
+			want: []string{`layout.html doesn't define "layout"`},
+		},
+		{
+			name:  "no pages",
+			files: map[string]string{"layout.html": layout},
+			want:  []string{"no page templates found"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeTemplates(t, tt.files)
+			_, err := services.NewTemplateServiceAt(root)
+			require.Error(t, err)
+			assert.NotContains(t, err.Error(), "template: ")
+			for _, want := range tt.want {
+				assert.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestTemplateService_SharedPartials(t *testing.T) {
+	templateService, err := services.NewTemplateServiceAt("../web/templates")
+	require.NoError(t, err)
+
+	_, body := renderPage(t, templateService, "login", fiber.Map{"Title": "Sign in", "Error": "Invalid email or password"})
+	assert.Contains(t, body, `role="alert"`)
+	assert.Contains(t, body, "Invalid email or password")
+	assert.NotContains(t, body, `role="status"`, "no notice without one set")
+
+	_, body = renderPage(t, templateService, "verify_email", fiber.Map{"Title": "Verify", "Notice": "Check your inbox"})
+	assert.Contains(t, body, `role="status"`)
+	assert.Contains(t, body, "Check your inbox")
+
+	status, body := renderPage(t, templateService, "errors/404", fiber.Map{"Title": "Not Found"})
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Contains(t, body, "Fresh", "nested pages use the root layout")
+}
+
+func TestTemplateService_RequestHelpersFollowTheRequest(t *testing.T) {
+	root := writeTemplates(t, map[string]string{
+		"layout.html": `{{define "layout"}}{{template "content" .}}{{end}}`,
+		"form.html":   `{{template "layout" .}}{{define "content"}}{{range .Items}}{{csrfToken}}{{end}}{{end}}`,
+	})
+	templateService, err := services.NewTemplateServiceAt(root)
+	require.NoError(t, err)
+
+	app := fiber.New()
+	app.Get("/:token", func(c *fiber.Ctx) error {
+		c.Locals(services.CSRFTokenKey, c.Params("token"))
+		return templateService.Render(c, "form", fiber.Map{"Items": []int{1, 2}})
+	})
+
+	// Renders running at once each see their own request's token
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			resp, err := app.Test(httptest.NewRequest("GET", "/"+token, nil))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, token+token, string(body))
+		}(fmt.Sprintf("token%02d", i))
+	}
+	wg.Wait()
+}
+
+func TestTemplateService_Reload(t *testing.T) {
+	root := writeTemplates(t, map[string]string{
+		"layout.html": `{{define "layout"}}<main>{{template "content" .}}</main>{{end}}`,
+		"home.html":   `{{template "layout" .}}{{define "content"}}v1{{end}}`,
+	})
+	templateService, err := services.NewTemplateServiceAt(root)
+	require.NoError(t, err)
+
+	write := func(name, src string) {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(src), 0o644))
+	}
+
+	write("home.html", `{{template "layout" .}}{{define "content"}}v2{{end}}`)
+	write("about.html", `{{template "layout" .}}{{define "content"}}about{{end}}`)
+	require.NoError(t, templateService.Reload())
+	_, body := renderPage(t, templateService, "home", nil)
+	assert.Contains(t, body, "<main>v2</main>")
+	_, body = renderPage(t, templateService, "about", nil)
+	assert.Contains(t, body, "about", "new pages are picked up")
+
+	// A broken template keeps the last good set and shows the error instead
+	write("home.html", "{{template \"layout\" .}}\n{{define \"content\"}}{{if}}{{end}}")
+	err = templateService.Reload()
+	require.ErrorContains(t, err, "home.html:2: missing value for if")
+
+	status, body := renderPage(t, templateService, "about", nil)
+	assert.Equal(t, fiber.StatusInternalServerError, status)
+	assert.Contains(t, body, "Templates failed to reload")
+	assert.Contains(t, body, "home.html:2: missing value for if")
+	assert.Error(t, templateService.Loaded(), "not ready while broken")
+
+	msg, err := templateService.RenderMail("verify_email", map[string]interface{}{"Link": "http://localhost/verify"})
+	require.NoError(t, err, "mail uses the last good templates")
+	assert.Contains(t, msg.Text, "http://localhost/verify")
+
+	write("home.html", `{{template "layout" .}}{{define "content"}}v3{{end}}`)
+	require.NoError(t, templateService.Reload())
+	status, body = renderPage(t, templateService, "home", nil)
+	assert.Equal(t, fiber.StatusOK, status)
+	assert.Contains(t, body, "<main>v3</main>")
+	assert.NoError(t, templateService.Loaded())
+}
+
+func TestTemplateService_Watch(t *testing.T) {
+	root := writeTemplates(t, map[string]string{
+		"layout.html": `{{define "layout"}}{{template "content" .}}{{end}}`,
+		"home.html":   `{{template "layout" .}}{{define "content"}}before{{end}}`,
+		"about.html":  `{{template "layout" .}}{{define "content"}}about{{end}}`,
+	})
+	templateService, err := services.NewTemplateServiceAt(root)
+	require.NoError(t, err)
+	stop := templateService.Watch(10 * time.Millisecond)
+	defer stop()
+
+	page := filepath.Join(root, "home.html")
+	require.NoError(t, os.WriteFile(page, []byte(`{{template "layout" .}}{{define "content"}}after the edit{{end}}`), 0o644))
+	assert.Eventually(t, func() bool {
+		_, body := renderPage(t, templateService, "home", nil)
+		return strings.Contains(body, "after the edit")
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.Remove(page))
+	assert.Eventually(t, func() bool {
+		status, _ := renderPage(t, templateService, "home", nil)
+		return status == fiber.StatusInternalServerError
+	}, 2*time.Second, 10*time.Millisecond, "deleted pages go away")
+	assert.NoError(t, templateService.Loaded())
+}
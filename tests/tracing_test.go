@@ -0,0 +1,278 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"fresh/app/logging"
+	"fresh/app/models"
+	"fresh/app/services"
+	"fresh/app/tracing"
+	"fresh/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// exportedSpan is the part of the file exporter's JSON the tests look at
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ TraceID, SpanID string }
+	Parent      struct{ TraceID, SpanID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+	Status struct{ Code string }
+}
+
+func (s exportedSpan) attr(key string) interface{} {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			return attr.Value.Value
+		}
+	}
+	return nil
+}
+
+// traceToFile records spans to a file for the rest of the test; the
+// returned function flushes them and reads them back
+func traceToFile(t *testing.T) func() map[string]exportedSpan {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := tracing.Setup(config.TracingConfig{Exporter: tracing.ExporterFile, File: path, ServiceName: "fresh-test", SampleRatio: 1})
+	require.NoError(t, err)
+	t.Cleanup(func() { shutdown(context.Background()) })
+
+	return func() map[string]exportedSpan {
+		require.NoError(t, shutdown(context.Background()))
+
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+
+		spans := make(map[string]exportedSpan)
+		decoder := json.NewDecoder(bufio.NewReader(file))
+		for decoder.More() {
+			var span exportedSpan
+			require.NoError(t, decoder.Decode(&span))
+			spans[span.Name] = span
+		}
+		return spans
+	}
+}
+
+func TestTracing_RequestSpans(t *testing.T) {
+	spans := traceToFile(t)
+	testApp := SetupTestApp(t)
+	require.NoError(t, tracing.InstrumentGORM(testApp.DB))
+
+	user, err := testApp.CreateTestUser("traced@example.com", "password123")
+	require.NoError(t, err)
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/dashboard", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	req.AddCookie(cookie)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	assert.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	recorded := spans()
+	server, ok := recorded["GET /dashboard"]
+	require.True(t, ok, "server span named after the route, got %v", recorded)
+	assert.Equal(t, traceID, server.SpanContext.TraceID, "the incoming trace continues")
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID)
+	assert.Equal(t, "/dashboard", server.attr("http.route"))
+	assert.Equal(t, float64(fiber.StatusOK), server.attr("http.response.status_code"))
+
+	currentUser := recorded["AuthService.GetCurrentUser"]
+	assert.Equal(t, server.SpanContext.SpanID, currentUser.Parent.SpanID)
+
+	query, ok := recorded["SELECT users"]
+	require.True(t, ok, "the user lookup is a child span, got %v", recorded)
+	assert.Equal(t, currentUser.SpanContext.SpanID, query.Parent.SpanID)
+	assert.Equal(t, "sqlite", query.attr("db.system"))
+	assert.Contains(t, query.attr("db.query.text"), "FROM `users`")
+	assert.NotContains(t, query.attr("db.query.text"), "traced@example.com", "bound values aren't recorded")
+
+	for name, span := range recorded {
+		assert.Equal(t, traceID, span.SpanContext.TraceID, "%s belongs to the request's trace", name)
+	}
+
+	var logged bool
+	for _, line := range logLines(t, testApp.Logs, "request") {
+		logged = logged || line["trace_id"] == traceID
+	}
+	assert.True(t, logged, "log lines carry the trace ID")
+}
+
+func TestTracing_QueriesFollowTheRequest(t *testing.T) {
+	testApp := SetupTestApp(t)
+	require.NoError(t, tracing.InstrumentGORM(testApp.DB))
+	_, admin := adminSession(t, testApp)
+	user, err := testApp.CreateTestUser("traced@example.com", "password123")
+	require.NoError(t, err)
+	token, _, err := testApp.APITokens.Create(context.Background(), user, "ci", []string{models.ScopeRead}, time.Hour)
+	require.NoError(t, err)
+	mountWhoAmI(testApp)
+
+	tests := []struct {
+		name    string
+		server  string
+		queries []string
+		request func() *http.Request
+	}{
+		{
+			name:    "failed login",
+			server:  "POST /login",
+			queries: []string{"SELECT users", "UPDATE users"},
+			request: func() *http.Request {
+				req, err := testApp.NewFormRequest("POST", "/login", url.Values{"email": {user.Email}, "password": {"wrong-password"}})
+				require.NoError(t, err)
+				return req
+			},
+		},
+		{
+			name:    "admin",
+			server:  "GET /admin/users/",
+			queries: []string{"SELECT users", "SELECT roles", "SELECT permissions"},
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/admin/users", nil)
+				req.AddCookie(admin)
+				return req
+			},
+		},
+		{
+			name:    "api token",
+			server:  "GET /test/whoami",
+			queries: []string{"SELECT api_tokens", "UPDATE api_tokens", "SELECT users", "SELECT roles"},
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/test/whoami", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				return req
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := traceToFile(t)
+			req := tt.request()
+			_, err := testApp.App.Test(req)
+			require.NoError(t, err)
+
+			recorded := spans()
+			server, ok := recorded[tt.server]
+			require.True(t, ok, "got %v", recorded)
+			for _, name := range tt.queries {
+				query, ok := recorded[name]
+				if assert.True(t, ok, "%s is traced", name) {
+					assert.Equal(t, server.SpanContext.TraceID, query.SpanContext.TraceID, name)
+				}
+			}
+		})
+	}
+
+	// Throttling and sessions kept in the database are traced too
+	spans := traceToFile(t)
+	ctx, span := tracing.Tracer().Start(context.Background(), "request")
+	attempts := services.NewDatabaseAttemptStore(testApp.DB)
+	require.NoError(t, attempts.Record(ctx, "ip:192.0.2.1", time.Now()))
+	_, err = attempts.Since(ctx, "ip:192.0.2.1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	sessions := services.NewDatabaseSessionStore(testApp.DB)
+	session, err := sessions.Create(ctx, user.ID, time.Hour)
+	require.NoError(t, err)
+	_, err = sessions.Find(ctx, session.ID)
+	require.NoError(t, err)
+	span.End()
+
+	recorded := spans()
+	for _, name := range []string{"INSERT login_attempts", "SELECT login_attempts", "INSERT sessions", "SELECT sessions"} {
+		assert.Equal(t, recorded["request"].SpanContext.SpanID, recorded[name].Parent.SpanID, name)
+	}
+}
+
+func TestTracing_MasksTokensInPaths(t *testing.T) {
+	spans := traceToFile(t)
+	testApp := SetupTestApp(t)
+	const secret = "s3cr3t-link-token_value"
+
+	for _, path := range []string{"/password/reset/" + secret, "/verify-email/" + secret} {
+		_, err := testApp.App.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+	}
+
+	recorded := spans()
+	assert.Equal(t, "/password/reset/:token", recorded["GET /password/reset/:token"].attr("url.path"))
+	assert.Equal(t, "/verify-email/:token", recorded["GET /verify-email/:token"].attr("url.path"))
+	for name, span := range recorded {
+		for _, attr := range span.Attributes {
+			assert.NotContains(t, fmt.Sprint(attr.Value.Value), secret, "%s: %s", name, attr.Key)
+		}
+	}
+}
+
+func TestTracing_RenderAndErrorSpans(t *testing.T) {
+	spans := traceToFile(t)
+	templateService, err := services.NewTemplateServiceAt("../web/templates")
+	require.NoError(t, err)
+
+	app := fiber.New()
+	app.Use(tracing.Middleware())
+	app.Get("/login", func(c *fiber.Ctx) error {
+		return templateService.Render(c, "login", fiber.Map{"Title": "Login"})
+	})
+	app.Get("/missing", func(c *fiber.Ctx) error {
+		return templateService.Render(c, "no_such_page", nil)
+	})
+
+	for _, path := range []string{"/login", "/missing"} {
+		_, err := app.Test(httptest.NewRequest("GET", path, nil))
+		require.NoError(t, err)
+	}
+
+	recorded := spans()
+	render, ok := recorded["render login"]
+	require.True(t, ok, "got %v", recorded)
+	assert.Equal(t, recorded["GET /login"].SpanContext.SpanID, render.Parent.SpanID)
+
+	assert.Equal(t, "Error", recorded["render no_such_page"].Status.Code)
+	failed := recorded["GET /missing"]
+	assert.Equal(t, "Error", failed.Status.Code)
+	assert.Equal(t, float64(fiber.StatusInternalServerError), failed.attr("http.response.status_code"))
+}
+
+func TestTracing_UntracedQueriesAndConfig(t *testing.T) {
+	spans := traceToFile(t)
+	db := openTestDB(t)
+	require.NoError(t, tracing.InstrumentGORM(db))
+	require.NoError(t, db.Exec("SELECT 1").Error)
+	assert.Empty(t, spans(), "queries outside a request don't start traces")
+
+	_, err := tracing.Setup(config.TracingConfig{Exporter: "jaeger"})
+	assert.ErrorContains(t, err, "unknown exporter")
+	_, err = tracing.Setup(config.TracingConfig{Exporter: tracing.ExporterStdout, SampleRatio: 2})
+	assert.ErrorContains(t, err, "sample_ratio")
+
+	// The request logger is untouched when nothing is traced
+	app := fiber.New()
+	app.Use(tracing.Middleware())
+	app.Get("/", func(c *fiber.Ctx) error {
+		assert.Same(t, logging.FromCtx(c), logging.FromContext(context.Background()))
+		return nil
+	})
+	_, err = app.Test(httptest.NewRequest("GET", "/", nil))
+	require.NoError(t, err)
+}
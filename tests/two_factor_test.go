@@ -0,0 +1,340 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"fresh/app/models"
+	"fresh/app/services"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// totpAt is an independent RFC 6238 implementation, so the tests act like
+// an authenticator app rather than reusing the code under test
+func totpAt(t *testing.T, base32Secret string, at time.Time) string {
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(base32Secret)
+	require.NoError(t, err)
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(at.Unix()/30))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func TestTOTP_RFC6238Vector(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	assert.Equal(t, "287082", totpAt(t, secret, time.Unix(59, 0)))
+	assert.Equal(t, "081804", totpAt(t, secret, time.Unix(1111111109, 0)))
+}
+
+// enableTwoFactor enrolls the user and returns the base32 secret and the
+// recovery codes
+func enableTwoFactor(t *testing.T, testApp *TestApp, user *models.User) (string, []string) {
+	enrollment, err := testApp.TwoFactor.BeginEnrollment(context.Background(), user)
+	require.NoError(t, err)
+
+	codes, err := testApp.TwoFactor.ConfirmEnrollment(context.Background(), user, totpAt(t, enrollment.Secret, time.Now()))
+	require.NoError(t, err)
+
+	return enrollment.Secret, codes
+}
+
+// passwordStep submits the login form and returns the pending 2FA cookie
+func passwordStep(t *testing.T, testApp *TestApp, email, password string) *http.Cookie {
+	form := url.Values{}
+	form.Set("email", email)
+	form.Set("password", password)
+
+	req, err := testApp.NewFormRequest("POST", "/login", form)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "/login/2fa", resp.Header.Get("Location"))
+
+	var pending *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		assert.NotEqual(t, "fresh_session", cookie.Name, "the password step must not start a session")
+		if cookie.Name == "fresh_2fa" {
+			pending = cookie
+		}
+	}
+	require.NotNil(t, pending, "expected the pending second factor cookie")
+	return pending
+}
+
+func codeStep(t *testing.T, testApp *TestApp, pending *http.Cookie, code string) *http.Response {
+	form := url.Values{}
+	form.Set("code", code)
+
+	req, err := testApp.NewFormRequest("POST", "/login/2fa", form, pending)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func sessionCookieFrom(resp *http.Response) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "fresh_session" && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestTwoFactor_Enrollment(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("enroll@example.com", "password123")
+	require.NoError(t, err)
+
+	enrollment, err := testApp.TwoFactor.BeginEnrollment(context.Background(), user)
+	require.NoError(t, err)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+	assert.Contains(t, string(enrollment.QRCode), "<svg")
+
+	// The secret is encrypted at rest and 2FA isn't on until confirmed
+	stored, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.NotEmpty(t, stored.TOTPSecret)
+	assert.NotContains(t, stored.TOTPSecret, enrollment.Secret)
+	assert.False(t, stored.TwoFactorEnabled())
+
+	_, err = testApp.TwoFactor.ConfirmEnrollment(context.Background(), stored, "000000")
+	assert.ErrorIs(t, err, services.ErrInvalidTwoFactorCode)
+
+	codes, err := testApp.TwoFactor.ConfirmEnrollment(context.Background(), stored, totpAt(t, enrollment.Secret, time.Now()))
+	require.NoError(t, err)
+	assert.Len(t, codes, 10)
+
+	stored, err = testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.TwoFactorEnabled())
+}
+
+func TestTwoFactor_LoginNeedsCode(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("twofa@example.com", "password123")
+	require.NoError(t, err)
+	secret, _ := enableTwoFactor(t, testApp, user)
+
+	pending := passwordStep(t, testApp, "twofa@example.com", "password123")
+
+	// Half-authenticated: the dashboard is still off limits
+	req, _ := http.NewRequest("GET", "/dashboard", nil)
+	req.AddCookie(pending)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login", resp.Header.Get("Location"))
+
+	resp = codeStep(t, testApp, pending, "000000")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, sessionCookieFrom(resp))
+
+	// The enrollment code can't be replayed; use the next step's code
+	resp = codeStep(t, testApp, pending, totpAt(t, secret, time.Now().Add(30*time.Second)))
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/dashboard", resp.Header.Get("Location"))
+
+	session := sessionCookieFrom(resp)
+	require.NotNil(t, session)
+
+	req, _ = http.NewRequest("GET", "/dashboard", nil)
+	req.AddCookie(session)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTwoFactor_RejectsReplayedCode(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("replay@example.com", "password123")
+	require.NoError(t, err)
+	secret, _ := enableTwoFactor(t, testApp, user)
+
+	// A concurrent request holds a copy loaded before the code was used
+	stale, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+
+	code := totpAt(t, secret, time.Now().Add(30*time.Second))
+	require.NoError(t, testApp.TwoFactor.Verify(context.Background(), user, code))
+	assert.ErrorIs(t, testApp.TwoFactor.Verify(context.Background(), user, code), services.ErrInvalidTwoFactorCode)
+	assert.ErrorIs(t, testApp.TwoFactor.Verify(context.Background(), stale, code), services.ErrInvalidTwoFactorCode)
+}
+
+func TestTwoFactor_RecoveryCodes(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("recovery@example.com", "password123")
+	require.NoError(t, err)
+	_, codes := enableTwoFactor(t, testApp, user)
+
+	// Codes are accepted regardless of case and dashes, but only once
+	pending := passwordStep(t, testApp, "recovery@example.com", "password123")
+	resp := codeStep(t, testApp, pending, strings.ToUpper(strings.ReplaceAll(codes[0], "-", "")))
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	require.NotNil(t, sessionCookieFrom(resp))
+
+	pending = passwordStep(t, testApp, "recovery@example.com", "password123")
+	resp = codeStep(t, testApp, pending, codes[0])
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, sessionCookieFrom(resp))
+
+	remaining, err := testApp.TwoFactor.RemainingRecoveryCodes(context.Background(), user)
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), remaining)
+
+	// Regenerating invalidates the old set
+	fresh, err := testApp.TwoFactor.RegenerateRecoveryCodes(context.Background(), user)
+	require.NoError(t, err)
+	assert.Len(t, fresh, 10)
+	assert.ErrorIs(t, testApp.TwoFactor.Verify(context.Background(), user, codes[1]), services.ErrInvalidTwoFactorCode)
+	assert.NoError(t, testApp.TwoFactor.Verify(context.Background(), user, fresh[0]))
+}
+
+func TestTwoFactor_DisableRequiresPassword(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("disable@example.com", "password123")
+	require.NoError(t, err)
+	enableTwoFactor(t, testApp, user)
+
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	form := url.Values{}
+	form.Set("password", "wrongpassword")
+	req, err := testApp.NewFormRequest("POST", "/account/2fa/disable", form, cookie)
+	require.NoError(t, err)
+	resp, err := testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	stored, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.TwoFactorEnabled())
+
+	form.Set("password", "password123")
+	req, err = testApp.NewFormRequest("POST", "/account/2fa/disable", form, cookie)
+	require.NoError(t, err)
+	resp, err = testApp.App.Test(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	stored, err = testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.False(t, stored.TwoFactorEnabled())
+	assert.Empty(t, stored.TOTPSecret)
+
+	remaining, err := models.NewRecoveryCodeRepository(testApp.DB).CountUnused(user.ID)
+	require.NoError(t, err)
+	assert.Zero(t, remaining)
+}
+
+func TestTwoFactor_PasswordChecksThrottled(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("settings@example.com", "password123")
+	require.NoError(t, err)
+	enableTwoFactor(t, testApp, user)
+	cookie, err := testApp.SessionCookie(user)
+	require.NoError(t, err)
+
+	post := func(path, password string) *http.Response {
+		req, err := testApp.NewFormRequest("POST", path, url.Values{"password": {password}}, cookie)
+		require.NoError(t, err)
+		resp, err := testApp.App.Test(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Wrong guesses on either form count against the login limit
+	limit := services.DefaultLoginThrottleConfig().MaxPerEmail
+	for i := 0; i < limit; i++ {
+		path := "/account/2fa/recovery-codes"
+		if i%2 == 0 {
+			path = "/account/2fa/disable"
+		}
+		assert.Equal(t, http.StatusUnprocessableEntity, post(path, "wrongpassword").StatusCode, path)
+	}
+
+	for _, path := range []string{"/account/2fa/disable", "/account/2fa/recovery-codes"} {
+		resp := post(path, "password123")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, path)
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"), path)
+	}
+
+	stored, err := testApp.UserRepo.FindByID(user.ID)
+	require.NoError(t, err)
+	assert.True(t, stored.TwoFactorEnabled())
+
+	_, err = testApp.AuthService.Login(context.Background(), user.Email, "password123", "192.0.2.1")
+	var throttled *services.TooManyAttemptsError
+	assert.ErrorAs(t, err, &throttled, "the guesses throttle logins too")
+}
+
+func TestTwoFactor_CodeStepThrottled(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	user, err := testApp.CreateTestUser("guess@example.com", "password123")
+	require.NoError(t, err)
+	secret, _ := enableTwoFactor(t, testApp, user)
+
+	pending := passwordStep(t, testApp, "guess@example.com", "password123")
+
+	limit := services.DefaultLoginThrottleConfig().MaxPerEmail
+	for i := 0; i < limit; i++ {
+		resp := codeStep(t, testApp, pending, "000000")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Even the right code is refused until the window passes
+	resp := codeStep(t, testApp, pending, totpAt(t, secret, time.Now().Add(30*time.Second)))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Nil(t, sessionCookieFrom(resp))
+}
+
+func TestTwoFactor_ForgedPendingCookie(t *testing.T) {
+	testApp := SetupTestApp(t)
+	defer testApp.TeardownTestApp()
+
+	resp := codeStep(t, testApp, &http.Cookie{Name: "fresh_2fa", Value: "forged"}, "123456")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/login", resp.Header.Get("Location"))
+}